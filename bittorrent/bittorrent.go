@@ -18,16 +18,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/coreos/libtorrent-go"
+	log "github.com/Sirupsen/logrus"
 )
 
 // Client wraps libtorrent and allows us to download torrents easily.
@@ -35,10 +34,11 @@ type Client struct {
 	// Running reports the status of the underlying libtorrent session.
 	// It is set to true after a successfull Start() and set to false when Stop() is called.
 	// Using Download() only makes sense when Running equals true.
+	// It is guarded by torrentsLock, so that the session is not used once Stop destroys it.
 	Running bool
 
 	// The main libtorrent object.
-	session libtorrent.Session
+	session session
 
 	// Contains the active torrents' handles.
 	torrents     map[string]*torrent
@@ -46,6 +46,18 @@ type Client struct {
 
 	// Refers to the configuration that has been used in NewClient to configure libtorrent.
 	config ClientConfig
+
+	// Guards the cache index of the download paths.
+	cacheLock sync.Mutex
+
+	// Holds the sources of the finished torrents, kept once they are removed. Guarded by
+	// torrentsLock.
+	finishedSources map[string]downloadSources
+
+	// Count the pins of each save path, and the references to each active marker file written by
+	// the client, which is removed once no longer referenced. Guarded by torrentsLock.
+	pinned        map[string]int
+	activeMarkers map[string]int
 }
 
 // DownloadConfig represents extra configuration for downloading a specific torrent.
@@ -53,17 +65,90 @@ type DownloadConfig struct {
 	// SkipWebseed, if set to true, skips the webseed when downloading the torrent.
 	SkipWebseed bool
 
+	// WebSeedFallback, if not 0, keeps the web seeds of the torrent on standby: the torrent is
+	// downloaded from the peers only, until its download does not progress for that duration, after
+	// which the web seeds are used as well. This reduces the load on the origin of the web seeds,
+	// while still ensuring that the download completes. Ignored if SkipWebseed is set.
+	WebSeedFallback time.Duration
+
+	// WebSeed, if not empty, is the URL of the web seed replacing those of the torrent, e.g. to
+	// serve its content from a cache. Ignored if SkipWebseed is set.
+	WebSeed string
+
 	// CustomTrackers hold the domain names of the custom tracker(s) to use for downloading the
 	// torrent.
 	// If specified, the default tracker is not used.
 	CustomTrackers []string
+
+	// Header holds additional HTTP headers sent when downloading the .torrent file, such as an
+	// Authorization header.
+	Header http.Header
+
+	// MediaTypes holds the media types accepted for the .torrent file, in order of preference.
+	// If empty, only application/x-bittorrent is accepted.
+	MediaTypes []string
+
+	// Files holds the files to download from the torrent, designated by their path within the
+	// torrent or by their name. The other files are skipped. If empty, every file is downloaded.
+	// File selection is not supported for magnet links.
+	Files []string
+
+	// HighPriority, if set to true, gives the torrent precedence over the other torrents of the
+	// client for bandwidth and queuing, so that small torrents gatekeeping the use of the others,
+	// such as image configuration blobs, complete first.
+	HighPriority bool
+
+	// ContentPath is the path of a file holding the content of the torrent, if it is a single-file
+	// torrent whose content is already available locally, e.g. exported from a container engine.
+	// The file is moved into the save path before the torrent is added, so that its content is
+	// checked and seeded rather than downloaded.
+	ContentPath string
+
+	// ExpectedSize, if not 0, is the size of the content of the torrent declared by its origin,
+	// e.g. the size of the blob in the manifest of the image. The download fails if the downloaded
+	// content does not have that size. Ignored if Files is set.
+	ExpectedSize int64
+
+	// Pin, if set to true, pins the content of the torrent once downloaded, as Pin does, so that it
+	// is kept until Unpin is called with the path returned by Download, e.g. once it has been used,
+	// even if the torrent is no longer seeded by then.
+	Pin bool
 }
 
-// torrent stores the libtorrent handle referring an active torrent and a channel that is closed
-// once the torrent's download is finished.
+// torrent stores the handle referring an active torrent, the path where its content is
+// downloaded, the paths of its fast-resume data and of its active marker file (if any) and
+// channels that are closed once the torrent's download is finished, once it is cancelled and once
+// its fast-resume data is saved.
+//
+// Once the download is finished, sources holds the number of bytes downloaded from web seeds and
+// from peers, and keepSeeding is the channel closed once the torrent is removed from the client.
 type torrent struct {
-	handle     libtorrent.TorrentHandle
-	isFinished chan struct{}
+	handle          torrentHandle
+	downloadPath    string
+	resumePath      string
+	activePath      string
+	isFinished      chan struct{}
+	isCancelled     chan struct{}
+	resumeDataSaved chan struct{}
+	sources         downloadSources
+	keepSeeding     chan struct{}
+}
+
+// downloadSources holds the number of payload bytes of a torrent downloaded from web seeds and
+// from peers.
+type downloadSources struct {
+	webSeedBytes int64
+	peerBytes    int64
+}
+
+// finished returns whether the torrent's download is finished.
+func (t *torrent) finished() bool {
+	select {
+	case <-t.isFinished:
+		return true
+	default:
+		return false
+	}
 }
 
 // Status contains several pieces of information about the status of a torrent.
@@ -96,14 +181,78 @@ type Status struct {
 
 	// NumSeeds is the number of peers that are seeding that this client is currently connected to.
 	NumSeeds int
+
+	// NumPieces is the total number of pieces of this torrent.
+	NumPieces int
+
+	// NumPiecesDownloaded is the number of pieces of this torrent that have been downloaded and
+	// verified.
+	NumPiecesDownloaded int
+
+	// TotalDownload is the number of bytes downloaded for this torrent since it was added,
+	// including protocol overhead.
+	TotalDownload int64
+
+	// TotalUpload is the number of bytes uploaded for this torrent since it was added, including
+	// protocol overhead.
+	TotalUpload int64
+
+	// DownloadedBytes is the number of bytes of the wanted content of this torrent that have been
+	// downloaded and verified.
+	DownloadedBytes int64
+
+	// TotalBytes is the number of bytes of the wanted content of this torrent, i.e. excluding the
+	// skipped files. It is 0 until the metadata of the torrent is known.
+	TotalBytes int64
+
+	// Paused indicates whether this torrent has been paused via Pause.
+	Paused bool
+}
+
+// SessionStatus contains several pieces of information about the status of the whole client.
+type SessionStatus struct {
+	// DownloadRate is the total download rate for all torrents, expressed in kB/s.
+	DownloadRate float32
+
+	// UploadRate is the total upload rate for all torrents, expressed in kB/s.
+	UploadRate float32
+
+	// TotalDownload is the number of bytes downloaded since the client was started.
+	TotalDownload int64
+
+	// TotalUpload is the number of bytes uploaded since the client was started.
+	TotalUpload int64
+
+	// NumPeers is the total number of peer connections of the client.
+	NumPeers int
 }
 
 // TorrentState represents a torrent's current task.
 type TorrentState string
 
 const (
-	// alertPollInterval defines the time in milliseconds between each libtorrent alert poll.
-	alertPollInterval = 250
+	// resumeDataTimeout defines the maximum time to wait for the fast-resume data of the
+	// unfinished torrents to be saved when stopping.
+	resumeDataTimeout = 10 * time.Second
+
+	// defaultAlertPollInterval defines the maximum time to wait for a libtorrent alert before
+	// checking whether the client is still running, unless configured otherwise.
+	defaultAlertPollInterval = 250 * time.Millisecond
+
+	// fastShutdownTimeout defines the maximum time Stop waits for the session to be destroyed,
+	// when FastShutdown is set.
+	fastShutdownTimeout = 500 * time.Millisecond
+
+	// webSeedCheckInterval defines the time between each check of the progress of the torrents
+	// whose web seeds are on standby.
+	webSeedCheckInterval = time.Second
+
+	// maxTorrentPriority is the highest bandwidth priority of a torrent in libtorrent.
+	maxTorrentPriority = 255
+
+	// maxListenRangeShifts defines how many following port ranges Start tries when every port of
+	// the configured range is already in use.
+	maxListenRangeShifts = 10
 
 	// QueuedForChecking means that the torrent is in the queue for being checked. But there currently
 	// is another torrent that are being checked. This torrent will wait for its turn.
@@ -130,8 +279,7 @@ const (
 
 	// Allocating means that if the torrent was started in full allocation mode, this indicates
 	// that the (disk) storage for the torrent is allocated.
-	// As this library only uses the default allocation mode (sparse allocation), this state should
-	// never appear.
+	// This state only appears when the client is configured with AllocateStorage.
 	Allocating = "Allocating"
 
 	// CheckingResumeData means that the torrent is currently checking the fastresume data and
@@ -175,12 +323,34 @@ type ClientConfig struct {
 	LowerListenPort int
 
 	// UpperListenPort defines the highest port on which libtorrent will try to listen.
+	// If every port of the range is in use, Start tries the following ranges of the same size.
 	UpperListenPort int
 
+	// ExternalPort defines the port announced to the trackers and peers in place of the listen
+	// port, e.g. when a port is manually forwarded to it behind a NAT. A zero value means that the
+	// listen port is announced.
+	ExternalPort int
+
+	// AnnounceIP defines the IP address announced to the trackers, e.g. the public address of a
+	// machine behind a 1:1 NAT. If empty, the trackers use the address the announces come from.
+	AnnounceIP string
+
 	// ConnectionsPerSecond specifies the maximum number of outgoing connections per second
 	// libtorrent allows.
 	ConnectionsPerSecond int
 
+	// MaxConnectionsPerTorrent defines the maximum number of peer connections of each torrent,
+	// which ensures that a torrent does not starve the others. A zero value means unlimited.
+	MaxConnectionsPerTorrent int
+
+	// MaxConnections defines the maximum number of peer connections of the whole client. A zero
+	// value means libtorrent's default (200).
+	MaxConnections int
+
+	// MaxUploads defines the maximum number of peers that are unchoked, i.e. uploaded to, at once.
+	// A zero value means libtorrent's default (8).
+	MaxUploads int
+
 	// MaxDownloadRate defines the maximun bandwidth (in bytes/s) that libtorrent will use to download
 	// torrents. A zero value mean unlimited.
 	// Note that it does not apply for peers on the local network, which are not rate limited.
@@ -196,6 +366,57 @@ type ClientConfig struct {
 
 	// Debug, when set to true, makes libtorrent output every available alert.
 	Debug bool
+
+	// HTTPClient is the client used to download .torrent files.
+	// If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// MaxCacheSize is the maximum size, in bytes, of the completed torrents kept in a download
+	// path. When adding a torrent would exceed it, the least recently used completed torrents that
+	// are not active are removed first. A zero value means unlimited.
+	MaxCacheSize int64
+
+	// UserAgent is the User-Agent sent by libtorrent to the trackers and web seeds. If empty,
+	// libtorrent's default is used.
+	UserAgent string
+
+	// FastShutdown, if set to true, makes Stop wait at most fastShutdownTimeout for the UPnP and
+	// NAT-PMP port mappings to be removed and for the session to be destroyed, which then
+	// completes in the background.
+	FastShutdown bool
+
+	// PieceTimeout is the time after which a peer that has not sent any of the pieces requested
+	// from it is considered to be stalled, so that its requests are sent to other peers instead.
+	// Lowering it (e.g. to 5s) helps on high-latency links. If 0, libtorrent's default (20s) is
+	// used.
+	PieceTimeout time.Duration
+
+	// AggressiveEndgame, if set to true, disables libtorrent's strict end-game mode: the blocks of
+	// the last pieces of a torrent are then requested from several peers at once, even if they are
+	// not the last missing ones, so that a slow peer does not hold back the end of the download.
+	AggressiveEndgame bool
+
+	// PeerToS defines the type of service byte set on the IP packets of the peer connections, e.g.
+	// 32 (DSCP CS1) so that the network can deprioritize BitTorrent traffic relative to interactive
+	// traffic. If 0, libtorrent's default is used.
+	PeerToS int
+
+	// StorageMode defines how the files of the torrents are allocated on disk. SparseStorage, the
+	// default, only allocates the pieces as they are downloaded, while AllocateStorage allocates the
+	// whole files upfront, which avoids fragmentation, e.g. on spinning disks.
+	StorageMode StorageMode
+
+	// AlertPollInterval defines the maximum time to wait for a libtorrent alert, such as the one
+	// signaling that a torrent is finished, before checking whether the client is still running. If
+	// 0, 250ms is used.
+	AlertPollInterval time.Duration
+
+	// ReadOnlySeed, if set to true, makes the client seed content already present in the download
+	// path without ever writing to it, e.g. when it is on read-only media: the torrents are added in
+	// seed mode, their pieces being verified as they are first requested rather than upfront, no
+	// fast-resume data is read or written, and the cache is neither tracked nor pruned. Missing or
+	// corrupted pieces are never downloaded.
+	ReadOnlySeed bool
 }
 
 // EncryptionMode is the type that control the settings related to peer protocol encryption
@@ -210,85 +431,72 @@ const (
 	// ENABLED allows both encrypted and non-encryption connections.
 	// An incoming non-encrypted connection will be accepted, and if an outgoing encrypted
 	// connection fails, a non- encrypted connection will be tried.
-	ENABLED = 1
+	ENABLED EncryptionMode = 1
 
 	// DISABLED only allows only non-encrypted connections.
-	DISABLED = 2
+	DISABLED EncryptionMode = 2
+)
+
+// Valid returns whether the encryption mode is one of FORCED, ENABLED or DISABLED.
+func (m EncryptionMode) Valid() bool {
+	return m == FORCED || m == ENABLED || m == DISABLED
+}
+
+// StorageMode is the type that controls how the files of the torrents are allocated on disk.
+type StorageMode int
+
+const (
+	// SparseStorage allocates the files of the torrents sparsely, as their pieces are downloaded.
+	SparseStorage StorageMode = 0
+
+	// AllocateStorage allocates the whole files of the torrents before downloading them.
+	AllocateStorage StorageMode = 1
 )
 
 // NewClient initializes a new Bittorrent client using the specified configuration.
 func NewClient(config ClientConfig) *Client {
-	// Create session.
-	fingerprint := libtorrent.NewFingerprint(config.Fingerprint.ID, config.Fingerprint.Major,
-		config.Fingerprint.Minor, config.Fingerprint.Revision, config.Fingerprint.Tag)
-	session := libtorrent.NewSession(fingerprint, int(libtorrent.SessionAddDefaultPlugins))
-
-	// Configure client.
-	// Reference: http://www.rasterbar.com/products/libtorrent/reference-Settings.html
-	settings := session.Settings()
-	settings.SetAnnounceToAllTiers(true)
-	settings.SetAnnounceToAllTrackers(true)
-	settings.SetPeerConnectTimeout(2)
-	settings.SetRateLimitIpOverhead(true)
-	settings.SetRequestTimeout(5)
-	settings.SetTorrentConnectBoost(config.ConnectionsPerSecond * 10)
-	settings.SetConnectionSpeed(config.ConnectionsPerSecond)
-	settings.SetDownloadRateLimit(config.MaxDownloadRate)
-	settings.SetUploadRateLimit(config.MaxUploadRate)
-	session.SetSettings(settings)
-
-	// Configure encryption policies.
-	encryptionSettings := libtorrent.NewPeSettings()
-	defer libtorrent.DeletePeSettings(encryptionSettings)
-	encryptionSettings.SetOutEncPolicy(byte(config.Encryption))
-	encryptionSettings.SetInEncPolicy(byte(config.Encryption))
-	encryptionSettings.SetAllowedEncLevel(byte(libtorrent.PeSettingsBoth))
-	encryptionSettings.SetPreferRc4(true)
-	session.SetPeSettings(encryptionSettings)
-
-	// Enable alerts.
-	// - status_notification is used to determine when a torrent is finished.
-	// - error_notification is good to have at this point because the only error management that we do
-	//   is at the moment when we start to listen and add a torrent. There is not error management
-	//   except that. At least, we can output the errors to the user.
-	alertMask := libtorrent.AlertStatusNotification | libtorrent.AlertErrorNotification
-	if config.Debug {
-		alertMask = libtorrent.AlertAllCategories
-	}
-
-	session.SetAlertMask(uint(alertMask))
-
-	// Load smartban and peer exchange extensions.
-	session.AddExtensionByName("smart_ban")
-	session.AddExtensionByName("ut_pex")
+	return newClient(config, newLibtorrentSession(config))
+}
 
+// newClient initializes a new Bittorrent client using the specified configuration, on top of the
+// given session.
+func newClient(config ClientConfig, session session) *Client {
 	return &Client{
-		session:  session,
-		torrents: make(map[string]*torrent),
-		config:   config,
+		session:         session,
+		torrents:        make(map[string]*torrent),
+		config:          config,
+		finishedSources: make(map[string]downloadSources),
+		pinned:          make(map[string]int),
+		activeMarkers:   make(map[string]int),
 	}
 }
 
 // Start launches the configured Client and makes it ready to accept torrents.
 func (bt *Client) Start() error {
-	// Listen.
-	errCode := libtorrent.NewErrorCode()
-	defer libtorrent.DeleteErrorCode(errCode)
+	// Listen. If every port of the range is in use, e.g. by another quayctl process, the next
+	// ranges of the same size are tried.
+	lowerPort, upperPort := bt.config.LowerListenPort, bt.config.UpperListenPort
+	for shift := 0; ; shift++ {
+		err := bt.session.ListenOn(lowerPort, upperPort)
+		if err == nil {
+			break
+		}
 
-	ports := libtorrent.NewStdPairIntInt(bt.config.LowerListenPort, bt.config.UpperListenPort)
-	defer libtorrent.DeleteStdPairIntInt(ports)
+		size := upperPort - lowerPort + 1
+		if err != errAddressInUse || shift == maxListenRangeShifts || upperPort+size > 65535 {
+			return fmt.Errorf("Unable to start the Bittorrent client: %v", err)
+		}
 
-	bt.session.ListenOn(ports, errCode)
-	if errCode.Value() != 0 {
-		return fmt.Errorf("Unable to start the Bittorrent client: error code %v, %v", errCode.Value(), errCode.Message())
+		log.Warnf("bittorrent: Ports %d-%d are already in use, trying %d-%d", lowerPort, upperPort, lowerPort+size, upperPort+size)
+		lowerPort, upperPort = lowerPort+size, upperPort+size
 	}
 
 	// Start services.
-	bt.session.StartUpnp()
-	bt.session.StartNatpmp()
-	bt.session.StartLsd()
+	bt.session.StartServices()
 
+	bt.torrentsLock.Lock()
 	bt.Running = true
+	bt.torrentsLock.Unlock()
 
 	// Start alert monitoring.
 	go bt.alertsConsumer()
@@ -297,23 +505,79 @@ func (bt *Client) Start() error {
 }
 
 // Stop interrupts every active torrents and destroy the libtorrent session.
+//
+// The fast-resume data of the unfinished torrents is saved beforehand, so that their download can
+// be resumed later without checking the content that was already downloaded.
+//
+// If FastShutdown is set, Stop may return before the session is destroyed.
 func (bt *Client) Stop() {
-	bt.Running = false
+	bt.saveResumeData()
 
 	// Stop torrents.
 	bt.torrentsLock.Lock()
+	bt.Running = false
 	for sourcePath := range bt.torrents {
-		bt.deleteTorrent(sourcePath, nil)
+		bt.deleteTorrent(sourcePath)
 	}
 	bt.torrentsLock.Unlock()
 
-	// Stop services.
-	bt.session.StopLsd()
-	bt.session.StopUpnp()
-	bt.session.StopNatpmp()
+	// Stop services and delete session. Removing the port mappings may block while waiting on the
+	// router: with FastShutdown, the session is still deleted, but in the background.
+	closed := make(chan struct{})
+	go func() {
+		bt.session.StopServices()
+		bt.session.Close()
+		close(closed)
+	}()
+
+	if !bt.config.FastShutdown {
+		<-closed
+		return
+	}
 
-	// Delete session.
-	libtorrent.DeleteSession(bt.session)
+	select {
+	case <-closed:
+	case <-time.After(fastShutdownTimeout):
+		log.Debugln("bittorrent: Stopping without waiting for the session to be destroyed")
+	}
+}
+
+// Abort interrupts every active torrents and destroy the libtorrent session, like Stop, and removes
+// the partially downloaded content of the torrents whose download is not finished, unless seeding
+// read-only.
+func (bt *Client) Abort() {
+	if bt.config.ReadOnlySeed {
+		bt.Stop()
+		return
+	}
+
+	// Find the content and fast-resume data of the unfinished torrents.
+	var partialPaths []string
+
+	bt.torrentsLock.Lock()
+	for _, torrent := range bt.torrents {
+		if torrent.finished() {
+			continue
+		}
+
+		if torrent.resumePath != "" {
+			partialPaths = append(partialPaths, torrent.resumePath)
+		}
+
+		if torrent.handle.HasMetadata() {
+			partialPaths = append(partialPaths, path.Clean(torrent.downloadPath+"/"+torrent.handle.Name()))
+		}
+	}
+	bt.torrentsLock.Unlock()
+
+	bt.Stop()
+
+	// Remove the partially downloaded content.
+	for _, partialPath := range partialPaths {
+		if err := os.RemoveAll(partialPath); err != nil {
+			log.Warnf("bittorrent: Could not remove partially downloaded %v: %v", partialPath, err)
+		}
+	}
 }
 
 // Download submits a new torrent to be downloaded.
@@ -322,7 +586,7 @@ func (bt *Client) Stop() {
 // HTTP URL to a .torrent file.
 //
 // The function blocks until the torrent is fully downloaded and then returns the path where the
-// downloaded content sits.
+// downloaded content sits. If the download is cancelled beforehand, an error is returned.
 //
 // Once the torrent has been downloaded, it will keep being seeded for the specified amount of time,
 // the returned channel will be closed at the end of the seeding period.
@@ -333,14 +597,15 @@ func (bt *Client) Stop() {
 // keepSeedingChan closed after that duration.
 // - seedDuration == 0, seed forever: the torrent will not be removed and keepSeedingChan will not
 // be closed until Stop() is called.
+// Stop() and Abort() also make the pending calls return an error, and close keepSeedingChan.
 func (bt *Client) Download(sourcePath, downloadPath string, seedDuration *time.Duration, config DownloadConfig) (string, chan struct{}, error) {
-	if !bt.Running {
-		return "", nil, errors.New("Use Start() before Download()")
-	}
-
 	// Verify that the torrent is unique first, otherwise we'll have trouble detecting the finished
 	// state.
 	bt.torrentsLock.Lock()
+	if !bt.Running {
+		bt.torrentsLock.Unlock()
+		return "", nil, errors.New("Use Start() before Download()")
+	}
 	if _, found := bt.torrents[sourcePath]; found {
 		bt.torrentsLock.Unlock()
 		return "", nil, errors.New("This torrent is already being downloaded.")
@@ -352,102 +617,238 @@ func (bt *Client) Download(sourcePath, downloadPath string, seedDuration *time.D
 	// An issue in libtorrent prevents it from using web seeds when torrents are added by URLs.
 	// As a workaround, we download the .torrent files to temp files and pass them to libtorrent.
 	torrentPath := sourcePath
-	if strings.HasPrefix(torrentPath, "http://") || strings.HasPrefix(torrentPath, "https://") {
-		f, err := ioutil.TempFile("", "quayctl-torrent")
-		if err != nil {
-			return "", nil, fmt.Errorf("Unable to start torrent: could not create temp file for .torrent.")
+	if isTorrentURL(torrentPath) {
+		path, err := downloadTorrentFile(bt.httpClient(), torrentPath, config.Header, config.MediaTypes)
+		if err == errTorrentFileNotFound {
+			return "", nil, ErrTorrentNotFound
+		}
+		if torrentFileErr, ok := err.(*TorrentFileError); ok {
+			return "", nil, torrentFileErr
 		}
-		defer os.Remove(f.Name())
-
-		client := http.DefaultClient
-		request, err := http.NewRequest("GET", torrentPath, nil)
 		if err != nil {
-			return "", nil, err
+			return "", nil, fmt.Errorf("Unable to start torrent: %v", err)
 		}
+		defer os.Remove(path)
+
+		torrentPath = path
+	}
 
-		request.Header.Add("Accept", "application/x-bittorrent")
+	// Create torrent parameters.
+	//
+	// Each torrent is saved into its own folder, keyed off its info-hash, so that torrents whose
+	// content has the same name cannot overwrite each other.
+	var resumePath, infoHash string
+	var totalSize int64
+	var priorities []int
+	var standbyWebSeeds []string
+	savePath := downloadPath
+	torrentParams := addTorrentParams{}
+	if strings.HasPrefix(torrentPath, "magnet:") {
+		torrentParams.magnetLink = torrentPath
+
+		if infoHash = magnetInfoHash(torrentPath); infoHash != "" {
+			savePath = path.Join(downloadPath, infoHash)
+		}
 
-		resp, err := client.Do(request)
+		if len(config.Files) > 0 {
+			log.Warnln("bittorrent: File selection is not supported for magnet links, downloading every file")
+		}
+	} else {
+		info, err := InspectTorrentFile(nil, torrentPath)
 		if err != nil {
-			return "", nil, fmt.Errorf("Unable to start torrent: could not download .torrent file.")
+			return "", nil, fmt.Errorf("Unable to start torrent: %v", err)
 		}
 
-		if resp.StatusCode/100 >= 4 {
-			return "", nil, fmt.Errorf("Unable to start torrent: got %v for .torrent file", resp.StatusCode)
+		// Keep the web seeds on standby, if requested, so that they are only added to the torrent
+		// once its download from the peers stalls.
+		if config.WebSeedFallback > 0 && !config.SkipWebseed {
+			if config.WebSeed != "" {
+				standbyWebSeeds = []string{config.WebSeed}
+			} else {
+				standbyWebSeeds = info.WebSeeds
+			}
 		}
+		clearWebSeeds := config.SkipWebseed || len(standbyWebSeeds) > 0
 
-		defer resp.Body.Close()
+		webSeed := config.WebSeed
+		if clearWebSeeds {
+			webSeed = ""
+		}
 
-		io.Copy(f, resp.Body)
-		f.Close()
+		// Remove the default tracker and/or webseed from the torrent, or replace the webseed.
+		if len(config.CustomTrackers) > 0 || clearWebSeeds || webSeed != "" {
+			updateTorrentFile(torrentPath, clearWebSeeds, webSeed, len(config.CustomTrackers) > 0)
+		}
 
-		torrentPath = f.Name()
-	}
+		torrentParams.torrentPath = torrentPath
 
-	// Create torrent parameters.
-	torrentParams := libtorrent.NewAddTorrentParams()
-	if strings.HasPrefix(torrentPath, "magnet:") {
-		torrentParams.SetUrl(torrentPath)
-	} else {
-		// Remove the default tracker and/or webseed from the torrent.
-		if len(config.CustomTrackers) > 0 || config.SkipWebseed {
-			updateTorrentFile(torrentPath, config.SkipWebseed, len(config.CustomTrackers) > 0)
+		// Select the files to download, if requested.
+		if len(config.Files) > 0 {
+			if priorities, err = filePriorities(info.files, config.Files); err != nil {
+				return "", nil, fmt.Errorf("Unable to start torrent: %v", err)
+			}
 		}
 
-		torrentInfo := libtorrent.NewTorrentInfo(torrentPath)
-		torrentParams.SetTorrentInfo(torrentInfo)
+		// Resume the download from the saved fast-resume data, if any.
+		infoHash = info.InfoHash
+		totalSize = info.TotalSize
+		savePath = path.Join(downloadPath, infoHash)
+		if bt.config.ReadOnlySeed {
+			if config.ContentPath != "" {
+				log.Warnf("bittorrent: Ignoring the local content of %v, which cannot be staged when seeding read-only", info.Name)
+			}
+			config.ContentPath = ""
+		} else {
+			resumePath = resumeDataPath(downloadPath, info.InfoHash)
+		}
 
-		if len(config.CustomTrackers) > 0 {
-			torrentParams.GetTrackers().Clear()
-			for _, tracker := range config.CustomTrackers {
-				torrentParams.GetTrackers().PushBack(tracker)
+		// Move the local content into place, if any, in which case it must be checked in full
+		// rather than trusted from the fast-resume data.
+		staged := false
+		if config.ContentPath != "" {
+			if err := stageContent(config.ContentPath, savePath, info); err != nil {
+				log.Warnf("bittorrent: Could not use the local content of %v, downloading it: %v", info.Name, err)
+			} else {
+				staged = true
 			}
 		}
 
-		if config.SkipWebseed {
-			torrentParams.GetUrlSeeds().Clear()
+		if !staged && resumePath != "" {
+			torrentParams.resumeData = loadResumeData(resumePath)
 		}
+
+		torrentParams.trackers = config.CustomTrackers
+		torrentParams.clearWebSeeds = clearWebSeeds || webSeed != ""
 	}
-	torrentParams.SetSavePath(downloadPath)
+	torrentParams.savePath = savePath
 
-	// Set flags to 0 to disable auto-management !
-	torrentParams.SetFlags(0)
+	// When seeding read-only, the content is assumed to be complete (seed mode) and is never
+	// written to (upload mode), so that the files are opened read-only and are not allocated.
+	if bt.config.ReadOnlySeed {
+		torrentParams.readOnly = true
+		torrentParams.storageMode = SparseStorage
+	} else {
+		torrentParams.storageMode = bt.config.StorageMode
+	}
 
-	// Add torrent to the Bittorrent client.
-	errCode := libtorrent.NewErrorCode()
-	defer libtorrent.DeleteErrorCode(errCode)
+	// Make room for the torrent in the cache.
+	if infoHash != "" && !bt.config.ReadOnlySeed {
+		bt.evictCache(downloadPath, infoHash, totalSize)
+	}
 
+	// Add torrent to the Bittorrent client.
 	bt.torrentsLock.Lock()
 	if _, found := bt.torrents[sourcePath]; found {
 		bt.torrentsLock.Unlock()
 		return "", nil, errors.New("This torrent is already being downloaded.")
 	}
 
-	handle := bt.session.AddTorrent(torrentParams)
-	if errCode.Value() != 0 {
+	handle, err := bt.session.AddTorrent(torrentParams)
+	if err != nil {
 		bt.torrentsLock.Unlock()
-		return "", nil, fmt.Errorf("Unable to start torrent: error code %v, %v", errCode.Value(), errCode.Message())
+		return "", nil, fmt.Errorf("Unable to start torrent: %v", err)
+	}
+
+	if bt.config.MaxConnectionsPerTorrent > 0 {
+		handle.SetMaxConnections(bt.config.MaxConnectionsPerTorrent)
+	}
+
+	for index, priority := range priorities {
+		handle.SetFilePriority(index, priority)
+	}
+
+	if config.HighPriority {
+		handle.SetHighPriority()
 	}
 
-	torrent := &torrent{handle: handle, isFinished: make(chan struct{})}
+	// Mark the torrent as active, so that it is not pruned by other processes.
+	var torrentActivePath string
+	if infoHash != "" && !bt.config.ReadOnlySeed {
+		torrentActivePath = activePath(downloadPath, infoHash)
+		bt.acquireActiveMarker(torrentActivePath)
+	}
+
+	torrent := &torrent{
+		handle:          handle,
+		downloadPath:    savePath,
+		resumePath:      resumePath,
+		activePath:      torrentActivePath,
+		isFinished:      make(chan struct{}),
+		isCancelled:     make(chan struct{}),
+		resumeDataSaved: make(chan struct{}),
+	}
 	bt.torrents[sourcePath] = torrent
 	bt.torrentsLock.Unlock()
 
+	if len(standbyWebSeeds) > 0 {
+		go bt.watchWebSeedFallback(sourcePath, torrent, standbyWebSeeds, config.WebSeedFallback)
+	}
+
 	// Wait for the download to finish.
-	<-torrent.isFinished
-	path := path.Clean(downloadPath + "/" + handle.TorrentFile().Name())
+	select {
+	case <-torrent.isFinished:
+	case <-torrent.isCancelled:
+		return "", nil, errors.New("Torrent download cancelled")
+	}
 
-	// Seed for the specified duration.
-	keepSeedingChan := make(chan struct{})
-	if seedDuration == nil {
+	// The fast-resume data is useless once the download is finished.
+	if resumePath != "" {
+		os.Remove(resumePath)
+	}
+
+	if infoHash != "" && !bt.config.ReadOnlySeed {
+		bt.recordCacheAccess(downloadPath, infoHash)
+	}
+	path := path.Clean(savePath + "/" + handle.Name())
+
+	// Ensure that the whole content has been written, whichever source it came from, and that it
+	// has the size declared by its origin, if known. Otherwise, the torrent is not seeded.
+	err = checkDownloadedFiles(savePath, handle.Files(), priorities)
+	if err == nil && config.ExpectedSize > 0 && priorities == nil {
+		err = checkContentSize(path, handle.Files(), config.ExpectedSize)
+	}
+	if err != nil {
 		bt.torrentsLock.Lock()
-		bt.deleteTorrent(sourcePath, keepSeedingChan)
+		if bt.torrents[sourcePath] == torrent {
+			bt.deleteTorrent(sourcePath)
+		}
 		bt.torrentsLock.Unlock()
-	} else if *seedDuration > 0 {
+
+		return "", nil, err
+	}
+
+	// Report which sources did the work.
+	if total := torrent.sources.webSeedBytes + torrent.sources.peerBytes; total > 0 {
+		log.Printf("bittorrent: Downloaded %v: %d%% from web seeds, %d%% from peers", handle.Name(),
+			torrent.sources.webSeedBytes*100/total, torrent.sources.peerBytes*100/total)
+	}
+
+	// Seed for the specified duration. The torrent may have been removed in the meantime, e.g. by
+	// Stop, in which case it is no longer seeded.
+	keepSeedingChan := make(chan struct{})
+
+	bt.torrentsLock.Lock()
+	bt.finishedSources[sourcePath] = torrent.sources
+	if config.Pin && infoHash != "" && !bt.config.ReadOnlySeed {
+		bt.pin(savePath)
+	}
+	if bt.torrents[sourcePath] == torrent {
+		torrent.keepSeeding = keepSeedingChan
+		if seedDuration == nil {
+			bt.deleteTorrent(sourcePath)
+		}
+	} else {
+		close(keepSeedingChan)
+	}
+	bt.torrentsLock.Unlock()
+
+	if seedDuration != nil && *seedDuration > 0 {
 		go func() {
 			time.Sleep(*seedDuration)
 			bt.torrentsLock.Lock()
-			bt.deleteTorrent(sourcePath, keepSeedingChan)
+			if bt.torrents[sourcePath] == torrent {
+				bt.deleteTorrent(sourcePath)
+			}
 			bt.torrentsLock.Unlock()
 		}()
 	}
@@ -455,95 +856,390 @@ func (bt *Client) Download(sourcePath, downloadPath string, seedDuration *time.D
 	return path, keepSeedingChan, nil
 }
 
+// watchWebSeedFallback adds the given web seeds to the given torrent, added from the given source
+// path, once its download does not progress for the given duration, unless it finishes, is removed
+// from the client or the client is stopped beforehand.
+func (bt *Client) watchWebSeedFallback(sourcePath string, torrent *torrent, webSeeds []string, stallTimeout time.Duration) {
+	var lastDone int64 = -1
+	lastProgress := time.Now()
+
+	for {
+		select {
+		case <-torrent.isFinished:
+			return
+		case <-torrent.isCancelled:
+			return
+		case <-time.After(webSeedCheckInterval):
+		}
+
+		// The handle is only used while the torrent is still part of the running client.
+		bt.torrentsLock.Lock()
+		if !bt.Running || bt.torrents[sourcePath] != torrent {
+			bt.torrentsLock.Unlock()
+			return
+		}
+
+		done := torrent.handle.Status().DownloadedBytes
+		stalled := done == lastDone && time.Since(lastProgress) >= stallTimeout
+		if stalled {
+			log.Printf("bittorrent: Download of %v from peers stalled for %v, using its web seeds", torrent.handle.Name(), stallTimeout)
+			for _, webSeed := range webSeeds {
+				torrent.handle.AddWebSeed(webSeed)
+			}
+		}
+		bt.torrentsLock.Unlock()
+
+		if stalled {
+			return
+		}
+
+		if done != lastDone {
+			lastDone = done
+			lastProgress = time.Now()
+		}
+	}
+}
+
+// saveResumeData saves the fast-resume data of the unfinished torrents, waiting at most
+// resumeDataTimeout for it to be written.
+func (bt *Client) saveResumeData() {
+	var pending []chan struct{}
+
+	bt.torrentsLock.Lock()
+	for _, torrent := range bt.torrents {
+		if torrent.resumePath == "" || torrent.finished() {
+			continue
+		}
+
+		torrent.handle.SaveResumeData()
+		pending = append(pending, torrent.resumeDataSaved)
+	}
+	bt.torrentsLock.Unlock()
+
+	timeout := time.After(resumeDataTimeout)
+	for _, resumeDataSaved := range pending {
+		select {
+		case <-resumeDataSaved:
+		case <-timeout:
+			log.Warnln("bittorrent: Timed out while saving resume data")
+			return
+		}
+	}
+}
+
+// httpClient returns the HTTP client to use for downloading .torrent files.
+func (bt *Client) httpClient() *http.Client {
+	if bt.config.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return bt.config.HTTPClient
+}
+
+// Cancel interrupts the download of the specified torrent, which makes Download return an error.
+// The partially downloaded content is kept, so that the download can be resumed later.
+func (bt *Client) Cancel(sourcePath string) error {
+	bt.torrentsLock.Lock()
+	defer bt.torrentsLock.Unlock()
+
+	torrent, found := bt.torrents[sourcePath]
+	if !found {
+		return errors.New("torrent not found")
+	}
+
+	if torrent.finished() {
+		return errors.New("torrent already downloaded")
+	}
+
+	bt.deleteTorrent(sourcePath)
+	return nil
+}
+
+// Pause stops the download and the seeding of the specified torrent until Resume is called.
+func (bt *Client) Pause(sourcePath string) error {
+	bt.torrentsLock.Lock()
+	defer bt.torrentsLock.Unlock()
+
+	torrent, found := bt.torrents[sourcePath]
+	if !found {
+		return errors.New("torrent not found")
+	}
+
+	torrent.handle.Pause()
+	return nil
+}
+
+// Resume restarts the download or the seeding of the specified torrent, once paused by Pause.
+func (bt *Client) Resume(sourcePath string) error {
+	bt.torrentsLock.Lock()
+	defer bt.torrentsLock.Unlock()
+
+	torrent, found := bt.torrents[sourcePath]
+	if !found {
+		return errors.New("torrent not found")
+	}
+
+	torrent.handle.Resume()
+	return nil
+}
+
+// ActiveTorrents returns the source paths of the torrents currently downloaded or seeded by the
+// client, sorted alphabetically.
+func (bt *Client) ActiveTorrents() []string {
+	bt.torrentsLock.Lock()
+	defer bt.torrentsLock.Unlock()
+
+	sourcePaths := make([]string, 0, len(bt.torrents))
+	for sourcePath := range bt.torrents {
+		sourcePaths = append(sourcePaths, sourcePath)
+	}
+	sort.Strings(sourcePaths)
+
+	return sourcePaths
+}
+
+// TorrentCount returns the number of torrents currently downloaded or seeded by the client.
+func (bt *Client) TorrentCount() int {
+	bt.torrentsLock.Lock()
+	defer bt.torrentsLock.Unlock()
+
+	return len(bt.torrents)
+}
+
 // GetStatus queries and returns several informations about the specified torrent.
 // The torrent must be currently downloading or seed, an error will be thrown otherwise.
 func (bt *Client) GetStatus(sourcePath string) (Status, error) {
-	var s Status
-
 	bt.torrentsLock.Lock()
 	defer bt.torrentsLock.Unlock()
 
 	torrent, found := bt.torrents[sourcePath]
 	if !found {
-		return s, errors.New("torrent not found")
-	}
-	status := torrent.handle.Status(uint(0))
-
-	s.Name = torrent.handle.TorrentFile().Name()
-	s.Status = parseTorrentState(status.GetState())
-	s.Progress = status.GetProgress() * 100
-	s.DownloadRate = float32(status.GetDownloadRate()) / 1024
-	s.UploadRate = float32(status.GetUploadRate()) / 1024
-	s.NumConnectCandidates = status.GetConnectCandidates()
-	s.NumPeers = status.GetNumPeers()
-	s.NumSeeds = status.GetNumSeeds()
-
-	return s, nil
-}
-
-func parseTorrentState(state libtorrent.LibtorrentTorrent_statusState_t) TorrentState {
-	switch state {
-	case libtorrent.TorrentStatusQueuedForChecking:
-		return QueuedForChecking
-	case libtorrent.TorrentStatusCheckingFiles:
-		return CheckingFiles
-	case libtorrent.TorrentStatusDownloadingMetadata:
-		return DownloadingMetadata
-	case libtorrent.TorrentStatusDownloading:
-		return Downloading
-	case libtorrent.TorrentStatusFinished:
-		return Finished
-	case libtorrent.TorrentStatusSeeding:
-		return Seeding
-	case libtorrent.TorrentStatusAllocating:
-		return Allocating
-	case libtorrent.TorrentStatusCheckingResumeData:
-		return CheckingResumeData
-	default:
-		return Unknown
+		return Status{}, errors.New("torrent not found")
 	}
+
+	return torrent.handle.Status(), nil
 }
 
-func (bt *Client) deleteTorrent(sourcePath string, keepSeedingChan chan struct{}) {
-	if torrent, found := bt.torrents[sourcePath]; found {
-		delete(bt.torrents, sourcePath)
-		bt.session.RemoveTorrent(torrent.handle, 0)
+// GetDownloadSources returns the number of payload bytes of the torrent downloaded from the given
+// source that came from web seeds and from peers. It is only known once the download is finished,
+// and remains available after the torrent is removed from the client.
+func (bt *Client) GetDownloadSources(sourcePath string) (webSeedBytes, peerBytes int64, err error) {
+	bt.torrentsLock.Lock()
+	defer bt.torrentsLock.Unlock()
+
+	sources, found := bt.finishedSources[sourcePath]
+	if !found {
+		return 0, 0, errors.New("torrent not finished")
 	}
-	if keepSeedingChan != nil {
-		close(keepSeedingChan)
+
+	return sources.webSeedBytes, sources.peerBytes, nil
+}
+
+// GetSessionStatus queries and returns several informations about the whole client.
+// The client must be running, an error will be thrown otherwise.
+func (bt *Client) GetSessionStatus() (SessionStatus, error) {
+	bt.torrentsLock.Lock()
+	defer bt.torrentsLock.Unlock()
+
+	if !bt.Running {
+		return SessionStatus{}, errors.New("client not running")
+	}
+
+	return bt.session.Status(), nil
+}
+
+// deleteTorrent removes the torrent with the given source path from the client, cancelling its
+// download if it is not finished, or ending its seeding otherwise. torrentsLock must be held.
+func (bt *Client) deleteTorrent(sourcePath string) {
+	torrent, found := bt.torrents[sourcePath]
+	if !found {
+		return
+	}
+
+	delete(bt.torrents, sourcePath)
+	bt.session.RemoveTorrent(torrent.handle)
+
+	if torrent.activePath != "" {
+		bt.releaseActiveMarker(torrent.activePath)
+	}
+
+	if !torrent.finished() {
+		close(torrent.isCancelled)
+	}
+
+	if torrent.keepSeeding != nil {
+		close(torrent.keepSeeding)
 	}
 }
 
+// isRunning returns whether the client is running.
+func (bt *Client) isRunning() bool {
+	bt.torrentsLock.Lock()
+	defer bt.torrentsLock.Unlock()
+
+	return bt.Running
+}
+
 // alertsConsumer handles notifications that libtorrent sends.
-// At the moment, it is only used to mark a torrent as finished.
+// At the moment, it is only used to mark a torrent as finished and to save fast-resume data.
+//
+// Every pending alert is handled on each wake, so that a burst of alerts does not delay the
+// detection of the finished torrents.
 func (bt *Client) alertsConsumer() {
-	for bt.Running {
-		if bt.session.WaitForAlert(libtorrent.Milliseconds(alertPollInterval)).Swigcptr() != 0 {
-			alert := bt.session.PopAlert()
-			switch alert.Type() {
-			case libtorrent.TorrentFinishedAlertAlertType:
-				handle := libtorrent.SwigcptrTorrentFinishedAlert(alert.Swigcptr()).GetHandle()
-				if torrent := bt.findTorrent(handle); torrent != nil {
-					close(torrent.isFinished)
-				} else {
-					log.Printf("bittorrent: Unknown torrent %v finished", handle.InfoHash())
-				}
-			default:
-				if bt.config.Debug {
-					log.Printf("bittorrent: %s: %s", alert.What(), alert.Message())
-				}
+	pollInterval := bt.config.AlertPollInterval
+	if pollInterval <= 0 {
+		pollInterval = defaultAlertPollInterval
+	}
+
+	for bt.isRunning() {
+		if !bt.session.WaitForAlert(pollInterval) {
+			continue
+		}
+
+		for alert := bt.session.PopAlert(); alert != nil; alert = bt.session.PopAlert() {
+			bt.handleAlert(alert)
+		}
+	}
+}
+
+// handleAlert handles the given session alert.
+func (bt *Client) handleAlert(alert *alert) {
+	switch alert.kind {
+	case torrentFinishedAlert:
+		if torrent := bt.findTorrent(alert.handle); torrent != nil {
+			torrent.sources = alert.handle.DownloadSources()
+			close(torrent.isFinished)
+		} else {
+			log.Printf("bittorrent: Unknown torrent %v finished", alert.handle.InfoHash())
+		}
+	case saveResumeDataAlert:
+		if torrent := bt.findTorrent(alert.handle); torrent != nil {
+			if err := writeResumeData(torrent.resumePath, alert.resumeData); err != nil {
+				log.Warnf("bittorrent: Could not save resume data: %v", err)
+			}
+			close(torrent.resumeDataSaved)
+		}
+	case saveResumeDataFailedAlert:
+		if torrent := bt.findTorrent(alert.handle); torrent != nil {
+			log.Warnf("bittorrent: Could not save resume data: %s", alert.message)
+			close(torrent.resumeDataSaved)
+		}
+	default:
+		if bt.config.Debug {
+			log.Printf("bittorrent: %s: %s", alert.what, alert.message)
+		}
+	}
+}
+
+// filePriorities returns the file priorities of a torrent that select the given files, designated
+// by their path within the torrent or by their name, and skip the others.
+func filePriorities(files []contentFile, selectedFiles []string) ([]int, error) {
+	priorities := make([]int, len(files))
+	found := map[string]struct{}{}
+	for index, file := range files {
+		for _, selectedFile := range selectedFiles {
+			if selectedFile == file.path || selectedFile == file.name {
+				priorities[index] = 1
+				found[selectedFile] = struct{}{}
 			}
 		}
 	}
+
+	for _, selectedFile := range selectedFiles {
+		if _, ok := found[selectedFile]; !ok {
+			return nil, fmt.Errorf("file %v not found in torrent", selectedFile)
+		}
+	}
+
+	return priorities, nil
+}
+
+// checkDownloadedFiles ensures that the files of a torrent, saved in the given path, have the
+// expected size. If priorities is not nil, the skipped files (with a priority of 0) are ignored.
+func checkDownloadedFiles(savePath string, files []contentFile, priorities []int) error {
+	for index, file := range files {
+		if priorities != nil && priorities[index] == 0 {
+			continue
+		}
+
+		filePath := path.Join(savePath, file.path)
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return fmt.Errorf("Could not find downloaded file %v: %v", filePath, err)
+		}
+
+		if size, expectedSize := info.Size(), file.size; size != expectedSize {
+			return fmt.Errorf("Downloaded file %v has a size of %d bytes, but %d bytes were expected", filePath, size, expectedSize)
+		}
+	}
+
+	return nil
+}
+
+// checkContentSize ensures that the given files of a torrent, whose content is found at the given
+// path, add up to the given expected size.
+func checkContentSize(contentPath string, files []contentFile, expectedSize int64) error {
+	var size int64
+	for _, file := range files {
+		size += file.size
+	}
+
+	if size != expectedSize {
+		return fmt.Errorf("Downloaded content %v has a size of %d bytes, but its origin declares %d bytes", contentPath, size, expectedSize)
+	}
+
+	return nil
+}
+
+// stageContent moves the file found at contentPath, holding the content of the given single-file
+// torrent, into the given save path, where libtorrent expects it. The file is copied if it cannot
+// be renamed, e.g. because it is on a different file system. Any partial download found there is
+// overwritten.
+func stageContent(contentPath, savePath string, info TorrentFileInfo) error {
+	if len(info.files) != 1 {
+		return errors.New("not a single-file torrent")
+	}
+
+	targetPath := path.Join(savePath, info.files[0].path)
+	if err := os.MkdirAll(savePath, 0755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(contentPath, targetPath); err == nil {
+		return nil
+	}
+
+	source, err := os.Open(contentPath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.Create(targetPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(target, source); err != nil {
+		target.Close()
+		os.Remove(targetPath)
+		return err
+	}
+
+	if err := target.Close(); err != nil {
+		os.Remove(targetPath)
+		return err
+	}
+
+	return os.Remove(contentPath)
 }
 
 // findTorrent finds the torrent in our torrent list that corresponds to the specified handle.
 //
 // This is necessary because when a torrent is added, we don't know anything about it except
 // its .torrent file or its magnet link. So when libtorrent sends us a notification with an handle,
-// we have no common index to retrieve our torrent structure easily. Thus, we use .Equal() which is
-// an alias for the C++ == operator that will match the handle that we already have.
-func (bt *Client) findTorrent(torrent libtorrent.TorrentHandle) *torrent {
+// we have no common index to retrieve our torrent structure easily. Thus, we use .Equal() which
+// matches the handle that we already have.
+func (bt *Client) findTorrent(torrent torrentHandle) *torrent {
 	bt.torrentsLock.Lock()
 	defer bt.torrentsLock.Unlock()
 
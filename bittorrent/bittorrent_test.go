@@ -0,0 +1,362 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bittorrent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+const (
+	testInfoHash      = "0123456789abcdef0123456789abcdef01234567"
+	otherTestInfoHash = "89abcdef0123456789abcdef0123456789abcdef"
+)
+
+// newTestClient returns a started client on top of a fake session, and a download path that is
+// removed by the returned cleanup function, which also stops the client.
+func newTestClient(t *testing.T) (*Client, *fakeSession, string, func()) {
+	downloadPath, err := ioutil.TempDir("", "quayctl-bittorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := newFakeSession()
+	bt := newClient(ClientConfig{AlertPollInterval: 10 * time.Millisecond}, session)
+	if err := bt.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	return bt, session, downloadPath, func() {
+		if bt.isRunning() {
+			bt.Stop()
+		}
+		os.RemoveAll(downloadPath)
+	}
+}
+
+func magnetLink(infoHash string) string {
+	return "magnet:?xt=urn:btih:" + infoHash
+}
+
+// downloadResult holds the values returned by Client.Download.
+type downloadResult struct {
+	path        string
+	keepSeeding chan struct{}
+	err         error
+}
+
+// startDownload calls Download in the background, and returns the channel its result is sent on.
+func startDownload(bt *Client, infoHash, downloadPath string, seedDuration *time.Duration) chan downloadResult {
+	results := make(chan downloadResult, 1)
+	go func() {
+		path, keepSeeding, err := bt.Download(magnetLink(infoHash), downloadPath, seedDuration, DownloadConfig{})
+		results <- downloadResult{path, keepSeeding, err}
+	}()
+
+	return results
+}
+
+// writeContent writes the content of the torrent referred by the given handle, as libtorrent would
+// once it is downloaded.
+func writeContent(t *testing.T, handle *fakeHandle, downloadPath string) {
+	savePath := path.Join(downloadPath, handle.infoHash)
+	if err := os.MkdirAll(savePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(savePath, handle.name), make([]byte, handle.size), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// finishDownload writes the content of the torrent referred by the given handle and makes the
+// session report it as finished, then returns the result of the download.
+func finishDownload(t *testing.T, session *fakeSession, handle *fakeHandle, downloadPath string, results chan downloadResult) downloadResult {
+	writeContent(t, handle, downloadPath)
+	session.finish(handle)
+
+	select {
+	case result := <-results:
+		if result.err != nil {
+			t.Fatalf("Download returned an error: %v", result.err)
+		}
+		if expected := path.Join(downloadPath, handle.infoHash, handle.name); result.path != expected {
+			t.Fatalf("Download returned %v, expected %v", result.path, expected)
+		}
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download did not return once the torrent was finished")
+	}
+
+	return downloadResult{}
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestDownloadAlreadyDownloading(t *testing.T) {
+	bt, session, downloadPath, cleanup := newTestClient(t)
+	defer cleanup()
+
+	results := startDownload(bt, testInfoHash, downloadPath, nil)
+	handle := session.waitForTorrents(1)[0]
+
+	if _, _, err := bt.Download(magnetLink(testInfoHash), downloadPath, nil, DownloadConfig{}); err == nil {
+		t.Fatal("Download of a torrent already being downloaded did not return an error")
+	}
+
+	finishDownload(t, session, handle, downloadPath, results)
+
+	// The torrent can be downloaded again once it is no longer active.
+	results = startDownload(bt, testInfoHash, downloadPath, nil)
+	finishDownload(t, session, session.waitForTorrents(2)[1], downloadPath, results)
+}
+
+func TestDownloadResumeSquashed(t *testing.T) {
+	// The squashed image is a single torrent served by the squash endpoint of the registry.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", torrentMediaType)
+		w.Write(testTorrentFile)
+	}))
+	defer server.Close()
+	squashedURL := server.URL + "/c1/squash/coreos/etcd/latest"
+
+	// Interrupt the download of the squashed image.
+	bt, session, downloadPath, cleanup := newTestClient(t)
+	defer cleanup()
+
+	results := make(chan error, 1)
+	go func() {
+		_, _, err := bt.Download(squashedURL, downloadPath, nil, DownloadConfig{})
+		results <- err
+	}()
+
+	handle := session.waitForTorrents(1)[0]
+	bt.Stop()
+
+	select {
+	case err := <-results:
+		if err == nil {
+			t.Fatal("Download of an interrupted torrent did not return an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download did not return once the client was stopped")
+	}
+
+	resumePath := resumeDataPath(downloadPath, handle.infoHash)
+	if data, err := ioutil.ReadFile(resumePath); err != nil || !bytes.Equal(data, fakeResumeData(handle.infoHash)) {
+		t.Fatalf("the fast-resume data of the squashed image was not saved: %q, %v", data, err)
+	}
+
+	// Pull the squashed image again: the download resumes from the saved fast-resume data.
+	session = newFakeSession()
+	bt = newClient(ClientConfig{AlertPollInterval: 10 * time.Millisecond}, session)
+	if err := bt.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer bt.Stop()
+
+	downloads := make(chan downloadResult, 1)
+	go func() {
+		path, keepSeeding, err := bt.Download(squashedURL, downloadPath, nil, DownloadConfig{})
+		downloads <- downloadResult{path, keepSeeding, err}
+	}()
+
+	handle = session.waitForTorrents(1)[0]
+	if resumeData := session.params[0].resumeData; !bytes.Equal(resumeData, fakeResumeData(handle.infoHash)) {
+		t.Errorf("the squashed image was added with the fast-resume data %q, expected the saved one", resumeData)
+	}
+
+	finishDownload(t, session, handle, downloadPath, downloads)
+	if _, err := os.Stat(resumePath); !os.IsNotExist(err) {
+		t.Errorf("the fast-resume data was not removed once downloaded: %v", err)
+	}
+}
+
+func TestDownloadExpectedSize(t *testing.T) {
+	bt, session, downloadPath, cleanup := newTestClient(t)
+	defer cleanup()
+
+	results := make(chan error, 1)
+	go func() {
+		_, _, err := bt.Download(magnetLink(testInfoHash), downloadPath, nil, DownloadConfig{ExpectedSize: 5})
+		results <- err
+	}()
+
+	handle := session.waitForTorrents(1)[0]
+	writeContent(t, handle, downloadPath)
+	session.finish(handle)
+
+	select {
+	case err := <-results:
+		if err == nil {
+			t.Error("Download of content smaller than its expected size did not return an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download did not return once the torrent was finished")
+	}
+
+	if bt.TorrentCount() != 0 {
+		t.Error("the torrent whose content has an unexpected size is still active")
+	}
+}
+
+func TestDownloadSeedDuration(t *testing.T) {
+	noDuration := time.Duration(0)
+	shortDuration := 50 * time.Millisecond
+
+	tests := []struct {
+		name         string
+		seedDuration *time.Duration
+	}{
+		{"no seeding", nil},
+		{"seed forever", &noDuration},
+		{"seed for a duration", &shortDuration},
+	}
+
+	for _, test := range tests {
+		bt, session, downloadPath, cleanup := newTestClient(t)
+
+		results := startDownload(bt, testInfoHash, downloadPath, test.seedDuration)
+		handle := session.waitForTorrents(1)[0]
+		result := finishDownload(t, session, handle, downloadPath, results)
+
+		switch {
+		case test.seedDuration == nil:
+			if !isClosed(result.keepSeeding) {
+				t.Errorf("%s: the seeding channel is not closed once downloaded", test.name)
+			}
+			if bt.TorrentCount() != 0 {
+				t.Errorf("%s: the torrent is still active once downloaded", test.name)
+			}
+
+		case *test.seedDuration == 0:
+			time.Sleep(2 * shortDuration)
+			if isClosed(result.keepSeeding) || bt.TorrentCount() != 1 {
+				t.Errorf("%s: the torrent is no longer seeded before Stop", test.name)
+			}
+
+			bt.Stop()
+			if !isClosed(result.keepSeeding) {
+				t.Errorf("%s: the seeding channel is not closed by Stop", test.name)
+			}
+
+		default:
+			if isClosed(result.keepSeeding) || bt.TorrentCount() != 1 {
+				t.Errorf("%s: the torrent is not seeded once downloaded", test.name)
+			}
+
+			select {
+			case <-result.keepSeeding:
+			case <-time.After(5 * time.Second):
+				t.Errorf("%s: the seeding channel is not closed after the seed duration", test.name)
+			}
+			if bt.TorrentCount() != 0 {
+				t.Errorf("%s: the torrent is still active after the seed duration", test.name)
+			}
+		}
+
+		cleanup()
+	}
+}
+
+func TestDeleteTorrent(t *testing.T) {
+	bt, session, downloadPath, cleanup := newTestClient(t)
+	defer cleanup()
+
+	activePath := activePath(downloadPath, testInfoHash)
+	handle := &fakeHandle{infoHash: testInfoHash}
+	active := &torrent{
+		handle:          handle,
+		downloadPath:    path.Join(downloadPath, testInfoHash),
+		activePath:      activePath,
+		isFinished:      make(chan struct{}),
+		isCancelled:     make(chan struct{}),
+		resumeDataSaved: make(chan struct{}),
+		keepSeeding:     make(chan struct{}),
+	}
+
+	bt.torrentsLock.Lock()
+	bt.torrents["source"] = active
+	bt.acquireActiveMarker(activePath)
+	bt.deleteTorrent("source")
+	bt.deleteTorrent("unknown")
+	bt.torrentsLock.Unlock()
+
+	if bt.TorrentCount() != 0 {
+		t.Error("the torrent is still active once deleted")
+	}
+	if len(session.removed) != 1 || session.removed[0] != handle {
+		t.Error("the torrent was not removed from the session exactly once")
+	}
+	if !isClosed(active.isCancelled) {
+		t.Error("the unfinished torrent was not cancelled")
+	}
+	if !isClosed(active.keepSeeding) {
+		t.Error("the seeding channel was not closed")
+	}
+	if _, err := os.Stat(activePath); !os.IsNotExist(err) {
+		t.Errorf("the active marker was not removed: %v", err)
+	}
+
+	// A finished torrent is not cancelled.
+	finished := &torrent{
+		handle:      &fakeHandle{infoHash: otherTestInfoHash},
+		isFinished:  make(chan struct{}),
+		isCancelled: make(chan struct{}),
+	}
+	close(finished.isFinished)
+
+	bt.torrentsLock.Lock()
+	bt.torrents["finished"] = finished
+	bt.deleteTorrent("finished")
+	bt.torrentsLock.Unlock()
+
+	if isClosed(finished.isCancelled) {
+		t.Error("the finished torrent was cancelled")
+	}
+}
+
+func TestFindTorrent(t *testing.T) {
+	bt, _, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	first := &torrent{handle: &fakeHandle{infoHash: testInfoHash}, isFinished: make(chan struct{}), isCancelled: make(chan struct{})}
+	second := &torrent{handle: &fakeHandle{infoHash: otherTestInfoHash}, isFinished: make(chan struct{}), isCancelled: make(chan struct{})}
+
+	bt.torrentsLock.Lock()
+	bt.torrents["first"] = first
+	bt.torrents["second"] = second
+	bt.torrentsLock.Unlock()
+
+	// The handles of the alerts are distinct from those returned when adding the torrents.
+	if found := bt.findTorrent(&fakeHandle{infoHash: otherTestInfoHash}); found != second {
+		t.Errorf("findTorrent returned %v, expected the second torrent", found)
+	}
+	if found := bt.findTorrent(&fakeHandle{infoHash: "fedcba9876543210fedcba9876543210fedcba98"}); found != nil {
+		t.Errorf("findTorrent returned %v for an unknown torrent, expected nil", found)
+	}
+}
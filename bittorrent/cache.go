@@ -0,0 +1,260 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bittorrent
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// cacheIndexFile is the name of the file, within the download path, that records the size and the
+// last access time of the completed torrents saved there.
+const cacheIndexFile = ".cache-index.json"
+
+// cacheEntry describes a completed torrent saved in the download path.
+type cacheEntry struct {
+	Size       int64     `json:"size"`
+	LastAccess time.Time `json:"lastAccess"`
+}
+
+// cacheIndex maps the info-hashes of the completed torrents saved in a download path to their
+// cacheEntry.
+type cacheIndex map[string]cacheEntry
+
+// loadCacheIndex reads the cache index of the given download path. An empty index is returned if
+// it cannot be read.
+func loadCacheIndex(downloadPath string) cacheIndex {
+	index := cacheIndex{}
+
+	data, err := ioutil.ReadFile(path.Join(downloadPath, cacheIndexFile))
+	if err != nil {
+		return index
+	}
+
+	if err := json.Unmarshal(data, &index); err != nil {
+		return cacheIndex{}
+	}
+
+	return index
+}
+
+// save writes the cache index of the given download path.
+func (index cacheIndex) save(downloadPath string) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(downloadPath, cacheIndexFile), data, 0644)
+}
+
+// recordCacheAccess records that the torrent with the given info-hash, saved in the given
+// download path, has been completed or accessed.
+func (bt *Client) recordCacheAccess(downloadPath, infoHash string) {
+	bt.cacheLock.Lock()
+	defer bt.cacheLock.Unlock()
+
+	index := loadCacheIndex(downloadPath)
+	index[infoHash] = cacheEntry{
+		Size:       dirSize(path.Join(downloadPath, infoHash)),
+		LastAccess: time.Now(),
+	}
+
+	if err := index.save(downloadPath); err != nil {
+		log.Warnf("bittorrent: Could not save cache index: %v", err)
+	}
+}
+
+// Pin protects the content of the torrent found at contentPath, within the given download path,
+// from being evicted from the cache or pruned by other processes, even once the torrent is no
+// longer in the client, until Unpin is called with the same paths. It does nothing if contentPath
+// is not the content of a torrent saved in the download path, e.g. a blob downloaded from a
+// registry.
+func (bt *Client) Pin(downloadPath, contentPath string) {
+	savePath, ok := torrentSavePath(downloadPath, contentPath)
+	if !ok {
+		return
+	}
+
+	bt.torrentsLock.Lock()
+	defer bt.torrentsLock.Unlock()
+
+	bt.pin(savePath)
+}
+
+// Unpin releases a pin taken by Pin, or by Download for a torrent downloaded with Pin set, once
+// the content is no longer used.
+func (bt *Client) Unpin(downloadPath, contentPath string) {
+	savePath, ok := torrentSavePath(downloadPath, contentPath)
+	if !ok {
+		return
+	}
+
+	bt.torrentsLock.Lock()
+	defer bt.torrentsLock.Unlock()
+
+	if bt.pinned[savePath] == 0 {
+		return
+	}
+
+	bt.pinned[savePath]--
+	if bt.pinned[savePath] == 0 {
+		delete(bt.pinned, savePath)
+	}
+	bt.releaseActiveMarker(activePath(path.Dir(savePath), path.Base(savePath)))
+}
+
+// pin pins the torrent saved at the given save path, named after its info-hash. torrentsLock must
+// be held.
+func (bt *Client) pin(savePath string) {
+	savePath = path.Clean(savePath)
+
+	bt.pinned[savePath]++
+	bt.acquireActiveMarker(activePath(path.Dir(savePath), path.Base(savePath)))
+}
+
+// torrentSavePath returns the save path of the torrent whose content is found at contentPath,
+// within the given download path, i.e. the folder named after its info-hash.
+func torrentSavePath(downloadPath, contentPath string) (string, bool) {
+	rel, err := filepath.Rel(downloadPath, contentPath)
+	if err != nil {
+		return "", false
+	}
+
+	infoHash := strings.Split(filepath.ToSlash(rel), "/")[0]
+	if !isInfoHash(infoHash) {
+		return "", false
+	}
+
+	return path.Join(path.Clean(downloadPath), infoHash), true
+}
+
+// isInfoHash returns whether the given string is a hex-encoded info-hash.
+func isInfoHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// evictCache removes the least recently used completed torrents saved in the given download path
+// until the torrent with the given info-hash and size can be added without exceeding the maximum
+// cache size. The torrents that are active in the client, e.g. because they are being seeded,
+// pinned, or active in other processes, are never evicted.
+func (bt *Client) evictCache(downloadPath, incomingInfoHash string, incomingSize int64) {
+	if bt.config.MaxCacheSize <= 0 {
+		return
+	}
+
+	// Find the torrents that must be kept.
+	active := map[string]struct{}{}
+	bt.torrentsLock.Lock()
+	for _, torrent := range bt.torrents {
+		active[path.Clean(torrent.downloadPath)] = struct{}{}
+	}
+	for savePath := range bt.pinned {
+		active[savePath] = struct{}{}
+	}
+	bt.torrentsLock.Unlock()
+
+	bt.cacheLock.Lock()
+	defer bt.cacheLock.Unlock()
+
+	index := loadCacheIndex(downloadPath)
+
+	// The incoming torrent may already be saved, e.g. if it is pulled again.
+	if _, found := index[incomingInfoHash]; found {
+		incomingSize = 0
+	}
+
+	var totalSize int64
+	infoHashes := make([]string, 0, len(index))
+	for infoHash, entry := range index {
+		totalSize += entry.Size
+		if infoHash != incomingInfoHash {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+
+	// Evict the least recently used torrents first.
+	sort.Sort(byLastAccess{infoHashes, index})
+
+	for _, infoHash := range infoHashes {
+		if totalSize+incomingSize <= bt.config.MaxCacheSize {
+			break
+		}
+
+		savePath := path.Join(downloadPath, infoHash)
+		if _, found := active[savePath]; found || isTorrentActive(downloadPath, infoHash) {
+			continue
+		}
+
+		log.Printf("bittorrent: Evicting %v from the cache", infoHash)
+		if err := os.RemoveAll(savePath); err != nil {
+			log.Warnf("bittorrent: Could not evict %v from the cache: %v", infoHash, err)
+			continue
+		}
+		os.Remove(resumeDataPath(downloadPath, infoHash))
+
+		totalSize -= index[infoHash].Size
+		delete(index, infoHash)
+	}
+
+	if err := index.save(downloadPath); err != nil {
+		log.Warnf("bittorrent: Could not save cache index: %v", err)
+	}
+}
+
+// byLastAccess sorts info-hashes by the last access time of their cacheEntry.
+type byLastAccess struct {
+	infoHashes []string
+	index      cacheIndex
+}
+
+func (s byLastAccess) Len() int {
+	return len(s.infoHashes)
+}
+
+func (s byLastAccess) Swap(i, j int) {
+	s.infoHashes[i], s.infoHashes[j] = s.infoHashes[j], s.infoHashes[i]
+}
+
+func (s byLastAccess) Less(i, j int) bool {
+	return s.index[s.infoHashes[i]].LastAccess.Before(s.index[s.infoHashes[j]].LastAccess)
+}
+
+// dirSize returns the total size of the files found under the given path.
+func dirSize(root string) int64 {
+	var size int64
+	filepath.Walk(root, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
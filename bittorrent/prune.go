@@ -0,0 +1,223 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bittorrent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// activeFolder is the name of the folder, within the download path, that holds marker files for
+// the torrents active in running quayctl processes, e.g. because they are being seeded or their
+// content is being loaded. Each process writes its own marker file for a torrent, named after the
+// info-hash of the torrent and the PID of the process, and holding that PID.
+const activeFolder = ".active"
+
+// activePath returns the path of the marker file of the torrent with the given info-hash,
+// downloaded to the given path, for the current process.
+func activePath(downloadPath, infoHash string) string {
+	return path.Join(downloadPath, activeFolder, fmt.Sprintf("%s.%d", infoHash, os.Getpid()))
+}
+
+// markActive writes the marker file found at the given path, recording that the torrent is active
+// in the current process.
+func markActive(activePath string) error {
+	if err := os.MkdirAll(path.Dir(activePath), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(activePath, []byte(strconv.Itoa(os.Getpid())), 0644)
+}
+
+// acquireActiveMarker writes the marker file found at the given path, unless the client already
+// references it, and adds a reference to it. torrentsLock must be held.
+func (bt *Client) acquireActiveMarker(activePath string) {
+	if bt.activeMarkers[activePath] == 0 {
+		if err := markActive(activePath); err != nil {
+			log.Warnf("bittorrent: Could not mark torrent as active: %v", err)
+		}
+	}
+
+	bt.activeMarkers[activePath]++
+}
+
+// releaseActiveMarker removes a reference to the marker file found at the given path, which is
+// removed once no longer referenced. torrentsLock must be held.
+func (bt *Client) releaseActiveMarker(activePath string) {
+	if bt.activeMarkers[activePath] == 0 {
+		return
+	}
+
+	bt.activeMarkers[activePath]--
+	if bt.activeMarkers[activePath] == 0 {
+		delete(bt.activeMarkers, activePath)
+		os.Remove(activePath)
+	}
+}
+
+// isActive returns whether the marker file found at the given path exists and refers to a running
+// process. Marker files left behind by processes that did not exit cleanly are therefore ignored.
+func isActive(activePath string) bool {
+	data, err := ioutil.ReadFile(activePath)
+	if err != nil {
+		return false
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return false
+	}
+
+	return processExists(pid)
+}
+
+// isTorrentActive returns whether the torrent with the given info-hash, downloaded to the given
+// path, is active in any running process, including the markers written by older versions, which
+// are named after the info-hash only.
+func isTorrentActive(downloadPath, infoHash string) bool {
+	markers, _ := filepath.Glob(path.Join(downloadPath, activeFolder, infoHash+".*"))
+	markers = append(markers, path.Join(downloadPath, activeFolder, infoHash))
+
+	for _, marker := range markers {
+		if isActive(marker) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// processExists returns whether a process with the given PID is running.
+func processExists(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	// On Windows, finding the process is enough, as it fails if the process does not exist.
+	if runtime.GOOS == "windows" {
+		return true
+	}
+
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+// Prune removes from the given download path the torrents that are neither active in a running
+// quayctl process nor accessed for the given duration, along with their fast-resume data. The
+// temporary .torrent files left behind for that duration are removed as well.
+//
+// It returns the removed paths. If dryRun is true, the paths are only returned.
+func Prune(downloadPath string, olderThan time.Duration, dryRun bool) ([]string, error) {
+	entries, err := ioutil.ReadDir(downloadPath)
+	if err != nil {
+		return nil, err
+	}
+
+	index := loadCacheIndex(downloadPath)
+	threshold := time.Now().Add(-olderThan)
+
+	var removed []string
+	remove := func(removedPath string) {
+		if !dryRun {
+			if err := os.RemoveAll(removedPath); err != nil {
+				return
+			}
+		}
+
+		removed = append(removed, removedPath)
+	}
+
+	// Remove the torrents, which are saved in folders named after their info-hash.
+	for _, entry := range entries {
+		infoHash := entry.Name()
+		if !entry.IsDir() || strings.HasPrefix(infoHash, ".") {
+			continue
+		}
+
+		if isTorrentActive(downloadPath, infoHash) {
+			continue
+		}
+
+		lastAccess := entry.ModTime()
+		if cacheEntry, found := index[infoHash]; found {
+			lastAccess = cacheEntry.LastAccess
+		}
+
+		if lastAccess.After(threshold) {
+			continue
+		}
+
+		remove(path.Join(downloadPath, infoHash))
+		if _, err := os.Stat(resumeDataPath(downloadPath, infoHash)); err == nil {
+			remove(resumeDataPath(downloadPath, infoHash))
+		}
+		delete(index, infoHash)
+	}
+
+	// Remove the marker files left behind by the processes that did not exit cleanly.
+	pruneStaleFiles(path.Join(downloadPath, activeFolder), "", time.Now(), func(activePath string) bool {
+		return !isActive(activePath)
+	}, remove)
+
+	// Remove the fast-resume data of the torrents that were never completed.
+	pruneStaleFiles(path.Join(downloadPath, resumeDataFolder), "", threshold, func(resumePath string) bool {
+		infoHash := strings.TrimSuffix(path.Base(resumePath), path.Ext(resumePath))
+		return !isTorrentActive(downloadPath, infoHash)
+	}, remove)
+
+	// Remove the temporary .torrent files left behind by interrupted downloads.
+	pruneStaleFiles(os.TempDir(), tempTorrentFilePrefix, threshold, nil, remove)
+
+	if !dryRun {
+		if err := index.save(downloadPath); err != nil {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+// pruneStaleFiles calls remove for each file of the given folder whose name has the given prefix,
+// that was last modified before the given threshold and for which canRemove (if any) returns true.
+func pruneStaleFiles(folder, prefix string, threshold time.Time, canRemove func(string) bool, remove func(string)) {
+	entries, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		filePath := path.Join(folder, entry.Name())
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) || entry.ModTime().After(threshold) {
+			continue
+		}
+
+		if canRemove != nil && !canRemove(filePath) {
+			continue
+		}
+
+		remove(filePath)
+	}
+}
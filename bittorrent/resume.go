@@ -0,0 +1,54 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bittorrent
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// resumeDataFolder is the name of the folder, within the download path, that holds the
+// fast-resume data of the unfinished torrents.
+const resumeDataFolder = ".resume"
+
+// resumeDataPath returns the path of the file holding the fast-resume data of the torrent with the
+// given info-hash, downloaded to the given path.
+//
+// The fast-resume data is keyed off the info-hash, which identifies the content of the torrent,
+// so that it is found again whichever URL the torrent is added from.
+func resumeDataPath(downloadPath, infoHash string) string {
+	return path.Join(downloadPath, resumeDataFolder, infoHash+".fastresume")
+}
+
+// loadResumeData returns the fast-resume data found at the given path, if any, so that libtorrent
+// resumes the download without checking the whole content.
+func loadResumeData(resumePath string) []byte {
+	data, err := ioutil.ReadFile(resumePath)
+	if err != nil {
+		return nil
+	}
+
+	return data
+}
+
+// writeResumeData writes the given bencoded fast-resume data to the given path.
+func writeResumeData(resumePath string, data []byte) error {
+	if err := os.MkdirAll(path.Dir(resumePath), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(resumePath, data, 0644)
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bittorrent
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// ScrapeTrackers queries the trackers of the described torrent for its number of seeders and
+// leechers, using the scrape convention of HTTP trackers. The numbers reported by the first
+// tracker that answers are returned.
+func ScrapeTrackers(client *http.Client, info TorrentFileInfo) (seeders, leechers int, err error) {
+	infoHash, err := hex.DecodeString(info.InfoHash)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid info-hash %v: %v", info.InfoHash, err)
+	}
+
+	err = errors.New("the torrent has no tracker")
+	for _, tracker := range info.Trackers {
+		seeders, leechers, err = scrapeTracker(client, tracker, infoHash)
+		if err == nil {
+			return seeders, leechers, nil
+		}
+	}
+
+	return 0, 0, err
+}
+
+// scrapeTracker queries the tracker with the given announce URL for the number of seeders and
+// leechers of the torrent with the given raw info-hash.
+func scrapeTracker(client *http.Client, announceURL string, infoHash []byte) (int, int, error) {
+	scrapeURL, err := trackerScrapeURL(announceURL, infoHash)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	resp, err := client.Get(scrapeURL)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not scrape %v: %v", announceURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 >= 4 {
+		return 0, 0, fmt.Errorf("got %v when scraping %v", resp.StatusCode, announceURL)
+	}
+
+	result, err := bencode.Decode(resp.Body)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid scrape response from %v: %v", announceURL, err)
+	}
+
+	benmap, ok := result.(map[string]interface{})
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid scrape response from %v: not a dictionary", announceURL)
+	}
+
+	if reason, ok := benmap["failure reason"].(string); ok {
+		return 0, 0, fmt.Errorf("could not scrape %v: %v", announceURL, reason)
+	}
+
+	files, _ := benmap["files"].(map[string]interface{})
+	file, ok := files[string(infoHash)].(map[string]interface{})
+	if !ok {
+		return 0, 0, fmt.Errorf("the torrent is unknown to %v", announceURL)
+	}
+
+	complete, _ := file["complete"].(int64)
+	incomplete, _ := file["incomplete"].(int64)
+	return int(complete), int(incomplete), nil
+}
+
+// trackerScrapeURL returns the scrape URL of the torrent with the given raw info-hash, derived
+// from the given announce URL. By convention, it is obtained by replacing "announce" with "scrape"
+// in the last component of the announce URL's path.
+func trackerScrapeURL(announceURL string, infoHash []byte) (string, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("scraping %v trackers is not supported", u.Scheme)
+	}
+
+	index := strings.LastIndex(u.Path, "/")
+	if !strings.HasPrefix(u.Path[index+1:], "announce") {
+		return "", fmt.Errorf("tracker %v does not support scraping", announceURL)
+	}
+	u.Path = u.Path[:index+1] + "scrape" + strings.TrimPrefix(u.Path[index+1:], "announce")
+
+	query := u.Query()
+	query.Set("info_hash", string(infoHash))
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
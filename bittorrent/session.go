@@ -0,0 +1,559 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bittorrent
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/coreos/libtorrent-go"
+)
+
+// LibtorrentVersion is the version of libtorrent-rasterbar linked into the client.
+const LibtorrentVersion = libtorrent.LIBTORRENT_VERSION
+
+// errAddressInUse is returned by ListenOn when every port of the range is already in use.
+var errAddressInUse = errors.New("address already in use")
+
+// session represents the subset of a libtorrent session used by Client.
+//
+// It allows the download and seeding logic of Client to be exercised without a running
+// libtorrent session.
+type session interface {
+	// ListenOn makes the session listen for peer connections on the first available port
+	// within the specified range, or returns errAddressInUse if none is available.
+	ListenOn(lowerPort, upperPort int) error
+
+	// StartServices starts the UPnP, NAT-PMP and local service discovery services.
+	StartServices()
+
+	// StopServices stops the services started by StartServices.
+	StopServices()
+
+	// AddTorrent adds a torrent to the session and returns its handle.
+	AddTorrent(params addTorrentParams) (torrentHandle, error)
+
+	// RemoveTorrent removes the torrent referred by the handle from the session.
+	RemoveTorrent(handle torrentHandle)
+
+	// WaitForAlert blocks until an alert is available or the timeout expires, and returns whether
+	// an alert is available.
+	WaitForAlert(timeout time.Duration) bool
+
+	// PopAlert returns the oldest available alert, or nil if there is none.
+	PopAlert() *alert
+
+	// Status returns the status of the session.
+	Status() SessionStatus
+
+	// Close destroys the session.
+	Close()
+}
+
+// addTorrentParams describes a torrent to add to a session.
+type addTorrentParams struct {
+	// magnetLink is the magnet link of the torrent, if it is added from one.
+	magnetLink string
+
+	// torrentPath is the path of the .torrent file of the torrent, if it is not added from a
+	// magnet link.
+	torrentPath string
+
+	// savePath is the folder where the content of the torrent is saved.
+	savePath string
+
+	// trackers, if not empty, replace the trackers of the .torrent file.
+	trackers []string
+
+	// clearWebSeeds, if set to true, removes the web seeds of the .torrent file.
+	clearWebSeeds bool
+
+	// resumeData holds the fast-resume data of the torrent, if any.
+	resumeData []byte
+
+	// readOnly, if set to true, adds the torrent in seed and upload mode: its content is assumed
+	// to be complete, and is never written to.
+	readOnly bool
+
+	// storageMode defines how the files of the torrent are allocated on disk.
+	storageMode StorageMode
+}
+
+// torrentHandle represents the subset of a libtorrent torrent handle used by Client.
+type torrentHandle interface {
+	// Equal returns whether both handles refer to the same torrent.
+	Equal(other torrentHandle) bool
+
+	// InfoHash returns the hex-encoded info-hash of the torrent.
+	InfoHash() string
+
+	// Name returns the name of the torrent, once its metadata is known.
+	Name() string
+
+	// Files returns the files of the torrent, once its metadata is known.
+	Files() []contentFile
+
+	// HasMetadata returns whether the metadata of the torrent is known, which is not the case for
+	// magnet links until it is downloaded from the peers.
+	HasMetadata() bool
+
+	// Status returns the status of the torrent.
+	Status() Status
+
+	// DownloadSources returns the number of payload bytes downloaded from web seeds and from
+	// peers.
+	DownloadSources() downloadSources
+
+	// SetMaxConnections limits the number of peer connections of the torrent.
+	SetMaxConnections(maxConnections int)
+
+	// SetFilePriority sets the priority of the file with the given index, 0 skipping it.
+	SetFilePriority(index, priority int)
+
+	// SetHighPriority gives the torrent the highest bandwidth priority, and moves it to the top
+	// of the queue.
+	SetHighPriority()
+
+	// AddWebSeed adds the given web seed to the torrent.
+	AddWebSeed(url string)
+
+	// SaveResumeData requests the fast-resume data of the torrent, which is then delivered by a
+	// saveResumeDataAlert or a saveResumeDataFailedAlert.
+	SaveResumeData()
+
+	// Pause stops the download and the seeding of the torrent until Resume is called.
+	Pause()
+
+	// Resume restarts the download or the seeding of the torrent.
+	Resume()
+}
+
+// contentFile describes a file of the content of a torrent.
+type contentFile struct {
+	// path is the path of the file within the save path of the torrent.
+	path string
+
+	// name is the name of the file.
+	name string
+
+	// size is the size of the file, in bytes.
+	size int64
+}
+
+// alertKind is the kind of a session alert.
+type alertKind int
+
+const (
+	// otherAlert is any alert that Client does not act upon, which is only logged in debug mode.
+	otherAlert alertKind = iota
+
+	// torrentFinishedAlert signals that the download of a torrent is finished.
+	torrentFinishedAlert
+
+	// saveResumeDataAlert delivers the fast-resume data of a torrent.
+	saveResumeDataAlert
+
+	// saveResumeDataFailedAlert signals that the fast-resume data of a torrent could not be saved.
+	saveResumeDataFailedAlert
+)
+
+// alert is a notification sent by a session.
+type alert struct {
+	kind alertKind
+
+	// handle refers to the torrent the alert is about, if any.
+	handle torrentHandle
+
+	// resumeData holds the bencoded fast-resume data delivered by a saveResumeDataAlert.
+	resumeData []byte
+
+	// what and message describe the alert.
+	what    string
+	message string
+}
+
+// libtorrentSession implements session using a libtorrent session.
+type libtorrentSession struct {
+	session libtorrent.Session
+}
+
+// newLibtorrentSession creates a libtorrent session configured as specified.
+func newLibtorrentSession(config ClientConfig) *libtorrentSession {
+	// Create session.
+	fingerprint := libtorrent.NewFingerprint(config.Fingerprint.ID, config.Fingerprint.Major,
+		config.Fingerprint.Minor, config.Fingerprint.Revision, config.Fingerprint.Tag)
+	session := libtorrent.NewSession(fingerprint, int(libtorrent.SessionAddDefaultPlugins))
+
+	// Configure client.
+	// Reference: http://www.rasterbar.com/products/libtorrent/reference-Settings.html
+	settings := session.Settings()
+	settings.SetAnnounceToAllTiers(true)
+	settings.SetAnnounceToAllTrackers(true)
+	settings.SetPeerConnectTimeout(2)
+	settings.SetRateLimitIpOverhead(true)
+	settings.SetRequestTimeout(5)
+	settings.SetTorrentConnectBoost(config.ConnectionsPerSecond * 10)
+	settings.SetConnectionSpeed(config.ConnectionsPerSecond)
+	settings.SetDownloadRateLimit(config.MaxDownloadRate)
+	settings.SetUploadRateLimit(config.MaxUploadRate)
+	if config.MaxConnections > 0 {
+		settings.SetConnectionsLimit(config.MaxConnections)
+	}
+	if config.MaxUploads > 0 {
+		settings.SetUnchokeSlotsLimit(config.MaxUploads)
+	}
+	if config.UserAgent != "" {
+		settings.SetUserAgent(config.UserAgent)
+	}
+	if config.ExternalPort > 0 {
+		settings.SetAnnouncePort(config.ExternalPort)
+	}
+	if config.AnnounceIP != "" {
+		settings.SetAnnounceIp(config.AnnounceIP)
+	}
+	if config.PieceTimeout > 0 {
+		settings.SetPieceTimeout(int(config.PieceTimeout.Seconds()))
+	}
+	if config.AggressiveEndgame {
+		settings.SetStrictEndGameMode(false)
+	}
+	if config.PeerToS > 0 {
+		settings.SetPeerTos(byte(config.PeerToS))
+	}
+	session.SetSettings(settings)
+
+	// Configure encryption policies.
+	encryptionSettings := libtorrent.NewPeSettings()
+	defer libtorrent.DeletePeSettings(encryptionSettings)
+	inPolicy, outPolicy := encryptionPolicies(config.Encryption)
+	encryptionSettings.SetOutEncPolicy(outPolicy)
+	encryptionSettings.SetInEncPolicy(inPolicy)
+	encryptionSettings.SetAllowedEncLevel(byte(libtorrent.PeSettingsBoth))
+	encryptionSettings.SetPreferRc4(true)
+	session.SetPeSettings(encryptionSettings)
+
+	// Enable alerts.
+	// - status_notification is used to determine when a torrent is finished.
+	// - error_notification is good to have at this point because the only error management that we do
+	//   is at the moment when we start to listen and add a torrent. There is not error management
+	//   except that. At least, we can output the errors to the user.
+	// - storage_notification is used to save the fast-resume data of the unfinished torrents.
+	alertMask := libtorrent.AlertStatusNotification | libtorrent.AlertErrorNotification | libtorrent.AlertStorageNotification
+	if config.Debug {
+		alertMask = libtorrent.AlertAllCategories
+	}
+
+	session.SetAlertMask(uint(alertMask))
+
+	// Load smartban and peer exchange extensions.
+	session.AddExtensionByName("smart_ban")
+	session.AddExtensionByName("ut_pex")
+
+	return &libtorrentSession{session}
+}
+
+// encryptionPolicies returns the libtorrent encryption policies of the incoming and outgoing peer
+// connections implementing the given encryption mode. ENABLED is used for unknown modes.
+func encryptionPolicies(mode EncryptionMode) (inPolicy, outPolicy byte) {
+	policy := byte(libtorrent.PeSettingsEnabled)
+	switch mode {
+	case FORCED:
+		policy = byte(libtorrent.PeSettingsForced)
+	case DISABLED:
+		policy = byte(libtorrent.PeSettingsDisabled)
+	}
+
+	return policy, policy
+}
+
+func (s *libtorrentSession) ListenOn(lowerPort, upperPort int) error {
+	errCode := libtorrent.NewErrorCode()
+	defer libtorrent.DeleteErrorCode(errCode)
+
+	ports := libtorrent.NewStdPairIntInt(lowerPort, upperPort)
+	defer libtorrent.DeleteStdPairIntInt(ports)
+
+	// Do not fall back to a port picked by the system, which could not be forwarded by hand.
+	s.session.ListenOn(ports, errCode, "", int(libtorrent.SessionListenNoSystemPort))
+	if errCode.Value() == int(syscall.EADDRINUSE) {
+		return errAddressInUse
+	}
+	if errCode.Value() != 0 {
+		return fmt.Errorf("error code %v, %v", errCode.Value(), errCode.Message())
+	}
+
+	return nil
+}
+
+func (s *libtorrentSession) StartServices() {
+	s.session.StartUpnp()
+	s.session.StartNatpmp()
+	s.session.StartLsd()
+}
+
+func (s *libtorrentSession) StopServices() {
+	s.session.StopLsd()
+	s.session.StopUpnp()
+	s.session.StopNatpmp()
+}
+
+func (s *libtorrentSession) AddTorrent(params addTorrentParams) (torrentHandle, error) {
+	torrentParams := libtorrent.NewAddTorrentParams()
+	if params.magnetLink != "" {
+		torrentParams.SetUrl(params.magnetLink)
+	} else {
+		torrentParams.SetTorrentInfo(libtorrent.NewTorrentInfo(params.torrentPath))
+	}
+
+	if len(params.resumeData) > 0 {
+		resumeData := libtorrent.NewStdVectorChar()
+		defer libtorrent.DeleteStdVectorChar(resumeData)
+
+		for _, b := range params.resumeData {
+			resumeData.Add(b)
+		}
+
+		torrentParams.SetResumeData(resumeData)
+	}
+
+	if len(params.trackers) > 0 {
+		torrentParams.GetTrackers().Clear()
+		for _, tracker := range params.trackers {
+			torrentParams.GetTrackers().PushBack(tracker)
+		}
+	}
+
+	if params.clearWebSeeds {
+		torrentParams.GetUrlSeeds().Clear()
+	}
+
+	torrentParams.SetSavePath(params.savePath)
+
+	// Set flags to 0 to disable auto-management !
+	if params.readOnly {
+		torrentParams.SetFlags(uint64(libtorrent.AddTorrentParamsFlagSeedMode | libtorrent.AddTorrentParamsFlagUploadMode))
+	} else {
+		torrentParams.SetFlags(0)
+	}
+
+	if params.storageMode == AllocateStorage {
+		torrentParams.SetStorageMode(libtorrent.StorageModeAllocate)
+	} else {
+		torrentParams.SetStorageMode(libtorrent.StorageModeSparse)
+	}
+
+	errCode := libtorrent.NewErrorCode()
+	defer libtorrent.DeleteErrorCode(errCode)
+
+	handle := s.session.AddTorrent(torrentParams, errCode)
+	if errCode.Value() != 0 {
+		return nil, fmt.Errorf("error code %v, %v", errCode.Value(), errCode.Message())
+	}
+
+	return &libtorrentHandle{handle}, nil
+}
+
+func (s *libtorrentSession) RemoveTorrent(handle torrentHandle) {
+	s.session.RemoveTorrent(handle.(*libtorrentHandle).handle, 0)
+}
+
+func (s *libtorrentSession) WaitForAlert(timeout time.Duration) bool {
+	return s.session.WaitForAlert(libtorrent.Milliseconds(int(timeout/time.Millisecond))).Swigcptr() != 0
+}
+
+func (s *libtorrentSession) PopAlert() *alert {
+	a := s.session.PopAlert()
+	if a == nil || a.Swigcptr() == 0 {
+		return nil
+	}
+
+	result := &alert{kind: otherAlert, what: a.What(), message: a.Message()}
+
+	switch a.Type() {
+	case libtorrent.TorrentFinishedAlertAlertType:
+		result.kind = torrentFinishedAlert
+		result.handle = &libtorrentHandle{libtorrent.SwigcptrTorrentFinishedAlert(a.Swigcptr()).GetHandle()}
+	case libtorrent.SaveResumeDataAlertAlertType:
+		resumeAlert := libtorrent.SwigcptrSaveResumeDataAlert(a.Swigcptr())
+		resumeData := resumeAlert.ResumeData()
+		result.kind = saveResumeDataAlert
+		result.handle = &libtorrentHandle{resumeAlert.GetHandle()}
+		result.resumeData = []byte(libtorrent.Bencode(resumeData))
+		libtorrent.DeleteEntry(resumeData)
+	case libtorrent.SaveResumeDataFailedAlertAlertType:
+		result.kind = saveResumeDataFailedAlert
+		result.handle = &libtorrentHandle{libtorrent.SwigcptrSaveResumeDataFailedAlert(a.Swigcptr()).GetHandle()}
+	}
+
+	return result
+}
+
+func (s *libtorrentSession) Status() SessionStatus {
+	status := s.session.Status()
+
+	return SessionStatus{
+		DownloadRate:  float32(status.GetDownloadRate()) / 1024,
+		UploadRate:    float32(status.GetUploadRate()) / 1024,
+		TotalDownload: status.GetTotalDownload(),
+		TotalUpload:   status.GetTotalUpload(),
+		NumPeers:      status.GetNumPeers(),
+	}
+}
+
+func (s *libtorrentSession) Close() {
+	libtorrent.DeleteSession(s.session)
+}
+
+// libtorrentHandle implements torrentHandle using a libtorrent torrent handle.
+type libtorrentHandle struct {
+	handle libtorrent.TorrentHandle
+}
+
+// Equal uses the C++ == operator, as libtorrent hands out a new handle with each alert.
+func (h *libtorrentHandle) Equal(other torrentHandle) bool {
+	otherHandle, ok := other.(*libtorrentHandle)
+	return ok && h.handle.Equal(otherHandle.handle)
+}
+
+func (h *libtorrentHandle) InfoHash() string {
+	return hex.EncodeToString([]byte(h.handle.InfoHash().ToString()))
+}
+
+func (h *libtorrentHandle) Name() string {
+	return h.handle.TorrentFile().Name()
+}
+
+func (h *libtorrentHandle) Files() []contentFile {
+	storage := h.handle.TorrentFile().Files()
+
+	files := make([]contentFile, storage.NumFiles())
+	for index := range files {
+		files[index] = contentFile{
+			path: storage.FilePath(index),
+			name: storage.FileName(index),
+			size: storage.FileSize(index),
+		}
+	}
+
+	return files
+}
+
+func (h *libtorrentHandle) HasMetadata() bool {
+	return h.handle.Status(uint(0)).GetHasMetadata()
+}
+
+func (h *libtorrentHandle) Status() Status {
+	status := h.handle.Status(uint(0))
+	torrentFile := h.handle.TorrentFile()
+
+	return Status{
+		Name:                 torrentFile.Name(),
+		Status:               parseTorrentState(status.GetState()),
+		Progress:             status.GetProgress() * 100,
+		DownloadRate:         float32(status.GetDownloadRate()) / 1024,
+		UploadRate:           float32(status.GetUploadRate()) / 1024,
+		NumConnectCandidates: status.GetConnectCandidates(),
+		NumPeers:             status.GetNumPeers(),
+		NumSeeds:             status.GetNumSeeds(),
+		NumPieces:            torrentFile.NumPieces(),
+		NumPiecesDownloaded:  status.GetNumPieces(),
+		TotalDownload:        status.GetTotalDownload(),
+		TotalUpload:          status.GetTotalUpload(),
+		DownloadedBytes:      status.GetTotalWantedDone(),
+		TotalBytes:           status.GetTotalWanted(),
+		Paused:               status.GetPaused(),
+	}
+}
+
+// DownloadSources attributes the bytes downloaded from the connections that have been closed to
+// peers, as libtorrent only reports the bytes downloaded from the connections still open.
+func (h *libtorrentHandle) DownloadSources() downloadSources {
+	peers := libtorrent.NewStdVectorPeerInfo()
+	defer libtorrent.DeleteStdVectorPeerInfo(peers)
+
+	h.handle.GetPeerInfo(peers)
+
+	var sources downloadSources
+	for i := 0; i < int(peers.Size()); i++ {
+		peer := peers.Get(i)
+		if connectionType := peer.GetConnectionType(); connectionType == libtorrent.PeerInfoWebSeed || connectionType == libtorrent.PeerInfoHttpSeed {
+			sources.webSeedBytes += peer.GetTotalDownload()
+		}
+	}
+
+	sources.peerBytes = h.handle.Status(uint(0)).GetTotalPayloadDownload() - sources.webSeedBytes
+	if sources.peerBytes < 0 {
+		sources.peerBytes = 0
+	}
+
+	return sources
+}
+
+func (h *libtorrentHandle) SetMaxConnections(maxConnections int) {
+	h.handle.SetMaxConnections(maxConnections)
+}
+
+func (h *libtorrentHandle) SetFilePriority(index, priority int) {
+	h.handle.FilePriority(index, priority)
+}
+
+func (h *libtorrentHandle) SetHighPriority() {
+	h.handle.SetPriority(maxTorrentPriority)
+	h.handle.QueuePositionTop()
+}
+
+func (h *libtorrentHandle) AddWebSeed(url string) {
+	h.handle.AddUrlSeed(url)
+}
+
+func (h *libtorrentHandle) SaveResumeData() {
+	h.handle.SaveResumeData()
+}
+
+// Pause also prevents libtorrent's queuing from resuming the torrent on its own.
+func (h *libtorrentHandle) Pause() {
+	h.handle.AutoManaged(false)
+	h.handle.Pause()
+}
+
+func (h *libtorrentHandle) Resume() {
+	h.handle.Resume()
+}
+
+func parseTorrentState(state libtorrent.LibtorrentTorrent_statusState_t) TorrentState {
+	switch state {
+	case libtorrent.TorrentStatusQueuedForChecking:
+		return QueuedForChecking
+	case libtorrent.TorrentStatusCheckingFiles:
+		return CheckingFiles
+	case libtorrent.TorrentStatusDownloadingMetadata:
+		return DownloadingMetadata
+	case libtorrent.TorrentStatusDownloading:
+		return Downloading
+	case libtorrent.TorrentStatusFinished:
+		return Finished
+	case libtorrent.TorrentStatusSeeding:
+		return Seeding
+	case libtorrent.TorrentStatusAllocating:
+		return Allocating
+	case libtorrent.TorrentStatusCheckingResumeData:
+		return CheckingResumeData
+	default:
+		return Unknown
+	}
+}
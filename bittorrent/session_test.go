@@ -0,0 +1,210 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bittorrent
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/libtorrent-go"
+)
+
+// fakeSession implements session in memory, for the tests of Client. The torrents it adds are
+// never downloaded: they are finished by the tests via finish.
+type fakeSession struct {
+	lock    sync.Mutex
+	params  []addTorrentParams
+	added   []*fakeHandle
+	removed []torrentHandle
+	alerts  []*alert
+	closed  bool
+}
+
+func newFakeSession() *fakeSession {
+	return &fakeSession{}
+}
+
+func (s *fakeSession) ListenOn(lowerPort, upperPort int) error { return nil }
+func (s *fakeSession) StartServices()                          {}
+func (s *fakeSession) StopServices()                           {}
+
+// AddTorrent adds a torrent made of a single file. For a .torrent file, the torrent is described
+// by the file. For a magnet link, the file is named after the info-hash found in the link.
+func (s *fakeSession) AddTorrent(params addTorrentParams) (torrentHandle, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	infoHash := magnetInfoHash(params.magnetLink)
+	handle := &fakeHandle{
+		session:  s,
+		infoHash: infoHash,
+		name:     infoHash + ".tar",
+		size:     4,
+	}
+
+	if params.torrentPath != "" {
+		info, err := InspectTorrentFile(nil, params.torrentPath)
+		if err != nil {
+			return nil, err
+		}
+		handle.infoHash, handle.name, handle.size = info.InfoHash, info.Name, info.TotalSize
+	}
+
+	s.params = append(s.params, params)
+	s.added = append(s.added, handle)
+
+	return handle, nil
+}
+
+func (s *fakeSession) RemoveTorrent(handle torrentHandle) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.removed = append(s.removed, handle)
+}
+
+func (s *fakeSession) WaitForAlert(timeout time.Duration) bool {
+	if timeout > 10*time.Millisecond {
+		timeout = 10 * time.Millisecond
+	}
+	time.Sleep(timeout)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.alerts) > 0
+}
+
+func (s *fakeSession) PopAlert() *alert {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.alerts) == 0 {
+		return nil
+	}
+
+	alert := s.alerts[0]
+	s.alerts = s.alerts[1:]
+	return alert
+}
+
+func (s *fakeSession) Status() SessionStatus { return SessionStatus{} }
+
+func (s *fakeSession) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+}
+
+// finish sends the alert signaling that the download of the torrent referred by the given handle
+// is finished. As libtorrent does, the alert holds a distinct handle to the same torrent.
+func (s *fakeSession) finish(handle *fakeHandle) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	alertHandle := *handle
+	s.alerts = append(s.alerts, &alert{kind: torrentFinishedAlert, handle: &alertHandle})
+}
+
+// waitForTorrents waits for the given number of torrents to be added to the session, and returns
+// their handles.
+func (s *fakeSession) waitForTorrents(count int) []*fakeHandle {
+	for {
+		s.lock.Lock()
+		added := s.added
+		s.lock.Unlock()
+
+		if len(added) >= count {
+			return added
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// fakeHandle implements torrentHandle for the torrents of fakeSession.
+type fakeHandle struct {
+	session  *fakeSession
+	infoHash string
+	name     string
+	size     int64
+}
+
+func (h *fakeHandle) Equal(other torrentHandle) bool {
+	otherHandle, ok := other.(*fakeHandle)
+	return ok && h.infoHash == otherHandle.infoHash
+}
+
+func (h *fakeHandle) InfoHash() string { return h.infoHash }
+func (h *fakeHandle) Name() string     { return h.name }
+func (h *fakeHandle) HasMetadata() bool {
+	return true
+}
+
+func (h *fakeHandle) Files() []contentFile {
+	return []contentFile{{path: h.name, name: h.name, size: h.size}}
+}
+
+func (h *fakeHandle) Status() Status {
+	return Status{Name: h.name, TotalBytes: h.size}
+}
+
+func (h *fakeHandle) DownloadSources() downloadSources {
+	return downloadSources{peerBytes: h.size}
+}
+
+func (h *fakeHandle) SetMaxConnections(maxConnections int) {}
+func (h *fakeHandle) SetFilePriority(index, priority int)  {}
+func (h *fakeHandle) SetHighPriority()                     {}
+func (h *fakeHandle) AddWebSeed(url string)                {}
+func (h *fakeHandle) Pause()                               {}
+func (h *fakeHandle) Resume()                              {}
+
+// SaveResumeData sends the alert holding the fast-resume data of the torrent, which is made of its
+// info-hash.
+func (h *fakeHandle) SaveResumeData() {
+	h.session.lock.Lock()
+	defer h.session.lock.Unlock()
+
+	alertHandle := *h
+	h.session.alerts = append(h.session.alerts, &alert{
+		kind:       saveResumeDataAlert,
+		handle:     &alertHandle,
+		resumeData: fakeResumeData(h.infoHash),
+	})
+}
+
+func fakeResumeData(infoHash string) []byte {
+	return []byte("d11:info-hash40:" + infoHash + "e")
+}
+
+func TestEncryptionPolicies(t *testing.T) {
+	tests := []struct {
+		mode     EncryptionMode
+		expected byte
+	}{
+		{FORCED, byte(libtorrent.PeSettingsForced)},
+		{ENABLED, byte(libtorrent.PeSettingsEnabled)},
+		{DISABLED, byte(libtorrent.PeSettingsDisabled)},
+	}
+
+	for _, test := range tests {
+		inPolicy, outPolicy := encryptionPolicies(test.mode)
+		if inPolicy != test.expected || outPolicy != test.expected {
+			t.Errorf("encryptionPolicies(%d) = %d, %d, expected %d for both", test.mode, inPolicy, outPolicy, test.expected)
+		}
+	}
+}
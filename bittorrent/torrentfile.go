@@ -15,14 +15,357 @@
 package bittorrent
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/jackpal/bencode-go"
+	"golang.org/x/net/context"
 )
 
+// TorrentFileInfo contains information about a .torrent file.
+type TorrentFileInfo struct {
+	// Name is the suggested name of the downloaded file or directory.
+	Name string
+
+	// InfoHash is the hex-encoded SHA-1 hash of the torrent's info dictionary.
+	InfoHash string
+
+	// Trackers are the announce URLs of the torrent's tracker(s).
+	Trackers []string
+
+	// WebSeeds are the URLs of the torrent's web seeds.
+	WebSeeds []string
+
+	// PieceLength is the size of each piece, in bytes.
+	PieceLength int64
+
+	// NumPieces is the number of pieces of the torrent.
+	NumPieces int
+
+	// TotalSize is the total size of the torrent's content, in bytes.
+	TotalSize int64
+
+	// files holds the files of the torrent.
+	files []contentFile
+}
+
+// isTorrentURL returns true if the given torrent path refers to a .torrent file served over HTTP.
+func isTorrentURL(torrentPath string) bool {
+	return strings.HasPrefix(torrentPath, "http://") || strings.HasPrefix(torrentPath, "https://")
+}
+
+// magnetInfoHash returns the info-hash (hex or base32-encoded) specified by the given magnet link,
+// or an empty string if it cannot be found.
+func magnetInfoHash(magnet string) string {
+	magnetURL, err := url.Parse(magnet)
+	if err != nil {
+		return ""
+	}
+
+	for _, xt := range magnetURL.Query()["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+
+		infoHash := strings.ToLower(strings.TrimPrefix(xt, "urn:btih:"))
+		if infoHash == "" || strings.TrimLeft(infoHash, "0123456789abcdefghijklmnopqrstuvwxyz") != "" {
+			return ""
+		}
+
+		return infoHash
+	}
+
+	return ""
+}
+
+// torrentMediaType is the media type of .torrent files.
+const torrentMediaType = "application/x-bittorrent"
+
+// tempTorrentFilePrefix is the prefix of the temp files to which .torrent files are downloaded.
+const tempTorrentFilePrefix = "quayctl-torrent"
+
+const (
+	// torrentFileTimeout bounds the download of a .torrent file, so that a slow endpoint cannot
+	// hang the download of the torrent.
+	torrentFileTimeout = 60 * time.Second
+
+	// maxTorrentFileSize is the maximum size of a .torrent file, so that a malicious endpoint
+	// cannot fill the disk. Torrents of multi-GB layers are a few hundred KB.
+	maxTorrentFileSize = 10 << 20
+)
+
+// ErrTorrentNotFound is returned by Client.Download when the server of the .torrent file responds
+// with a 404, e.g. because it does not serve torrents at all.
+var ErrTorrentNotFound = errors.New("Unable to start torrent: got 404 for .torrent file")
+
+// errTorrentFileNotFound is returned by downloadTorrentFile when the server responds with a 404.
+var errTorrentFileNotFound = errors.New("got 404 for .torrent file")
+
+// TorrentFileError is returned by Client.Download when the .torrent file could not be downloaded,
+// either because its server responded with an error status, or because it could not be reached.
+type TorrentFileError struct {
+	// StatusCode is the status the server responded with, or 0 if no response was received.
+	StatusCode int
+
+	// Timeout is the timeout the download of the .torrent file exceeded, if it did.
+	Timeout time.Duration
+}
+
+func (e *TorrentFileError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("got %v for .torrent file", e.StatusCode)
+	}
+
+	if e.Timeout != 0 {
+		return fmt.Sprintf("could not download .torrent file within %v", e.Timeout)
+	}
+
+	// The underlying error is not included, as it may hold the credentials found in the URL.
+	return "could not download .torrent file"
+}
+
+// downloadTorrentFile downloads the .torrent file at the given URL to a temp file, and returns its
+// path. The given headers (if any) are added to the request, and the given media types (if any)
+// are the ones accepted, in order of preference. The caller is responsible for removing the file.
+func downloadTorrentFile(client *http.Client, torrentURL string, header http.Header, mediaTypes []string) (string, error) {
+	request, err := http.NewRequest("GET", torrentURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	for key, values := range header {
+		for _, value := range values {
+			request.Header.Add(key, value)
+		}
+	}
+
+	if len(mediaTypes) == 0 {
+		mediaTypes = []string{torrentMediaType}
+	}
+	request.Header.Set("Accept", strings.Join(mediaTypes, ", "))
+
+	// Bound the request, including the read of the response body.
+	ctx, cancel := context.WithTimeout(context.Background(), torrentFileTimeout)
+	defer cancel()
+	request.Cancel = ctx.Done()
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return "", &TorrentFileError{}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", errTorrentFileNotFound
+	}
+
+	if resp.StatusCode/100 >= 4 {
+		return "", &TorrentFileError{StatusCode: resp.StatusCode}
+	}
+
+	// Ensure that a torrent has been served, rather than e.g. an HTML error page.
+	if err := checkTorrentContentType(resp.Header.Get("Content-Type"), mediaTypes); err != nil {
+		return "", err
+	}
+
+	if resp.ContentLength > maxTorrentFileSize {
+		return "", fmt.Errorf("got .torrent file of %v bytes, larger than the maximum of %v bytes", resp.ContentLength, maxTorrentFileSize)
+	}
+
+	body := bufio.NewReader(io.LimitReader(resp.Body, maxTorrentFileSize+1))
+
+	// Decompress gzip-compressed .torrent files, served as .torrent.gz or with a gzip
+	// Content-Encoding that the transport did not handle, e.g. because Accept-Encoding was set
+	// explicitly. The decompressed size is bounded as well.
+	if magic, err := body.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		uncompressed, err := gzip.NewReader(body)
+		if err != nil {
+			return "", errors.New("got invalid gzip-compressed .torrent file")
+		}
+		defer uncompressed.Close()
+
+		body = bufio.NewReader(io.LimitReader(uncompressed, maxTorrentFileSize+1))
+	}
+
+	if start, err := body.Peek(1); err != nil || start[0] != 'd' {
+		return "", errors.New("got invalid .torrent file: not a bencoded dictionary")
+	}
+
+	f, err := ioutil.TempFile("", tempTorrentFilePrefix)
+	if err != nil {
+		return "", errors.New("could not create temp file for .torrent")
+	}
+	defer f.Close()
+
+	written, err := io.Copy(f, body)
+	if err != nil {
+		os.Remove(f.Name())
+
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", &TorrentFileError{Timeout: torrentFileTimeout}
+		}
+		return "", &TorrentFileError{}
+	}
+
+	if written > maxTorrentFileSize {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("got .torrent file larger than the maximum of %v bytes", maxTorrentFileSize)
+	}
+
+	return f.Name(), nil
+}
+
+// checkTorrentContentType ensures that the given Content-Type of a .torrent file response is one
+// of the accepted media types. Responses without a specific content type are accepted, since
+// some servers do not set it, as are gzip-compressed ones, which are checked once decompressed.
+func checkTorrentContentType(contentType string, mediaTypes []string) error {
+	if contentType == "" {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("got invalid content type %q for .torrent file", contentType)
+	}
+
+	switch mediaType {
+	case "application/octet-stream", "application/gzip", "application/x-gzip":
+		return nil
+	}
+
+	for _, accepted := range mediaTypes {
+		if mediaType == accepted {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("got unexpected content type %v for .torrent file (expected %v)", mediaType, strings.Join(mediaTypes, " or "))
+}
+
+// InspectTorrentFile reads the .torrent file found at the given path or HTTP URL, and returns
+// information about it. The client is used to download the .torrent file in the latter case.
+func InspectTorrentFile(client *http.Client, torrentPath string) (TorrentFileInfo, error) {
+	if isTorrentURL(torrentPath) {
+		path, err := downloadTorrentFile(client, torrentPath, nil, nil)
+		if err != nil {
+			return TorrentFileInfo{}, err
+		}
+		defer os.Remove(path)
+
+		torrentPath = path
+	}
+
+	torrentFile, err := os.Open(torrentPath)
+	if err != nil {
+		return TorrentFileInfo{}, err
+	}
+	defer torrentFile.Close()
+
+	result, err := bencode.Decode(torrentFile)
+	if err != nil {
+		return TorrentFileInfo{}, err
+	}
+
+	benmap, ok := result.(map[string]interface{})
+	if !ok {
+		return TorrentFileInfo{}, errors.New("invalid .torrent file: not a dictionary")
+	}
+
+	infoMap, ok := benmap["info"].(map[string]interface{})
+	if !ok {
+		return TorrentFileInfo{}, errors.New("invalid .torrent file: missing info dictionary")
+	}
+
+	// Compute the info-hash from the re-encoded info dictionary, which is identical to the
+	// original one as bencoded dictionaries have sorted keys.
+	var infoBuf bytes.Buffer
+	if err := bencode.Marshal(&infoBuf, infoMap); err != nil {
+		return TorrentFileInfo{}, err
+	}
+	infoHash := sha1.Sum(infoBuf.Bytes())
+
+	info := TorrentFileInfo{
+		InfoHash: hex.EncodeToString(infoHash[:]),
+		WebSeeds: bencodeStrings(benmap["url-list"]),
+	}
+	info.Name, _ = infoMap["name"].(string)
+	info.PieceLength, _ = infoMap["piece length"].(int64)
+
+	if pieces, ok := infoMap["pieces"].(string); ok {
+		info.NumPieces = len(pieces) / sha1.Size
+	}
+
+	// Single-file torrents have a length, multi-file torrents have a list of files, which are
+	// saved in a folder named after the torrent.
+	if length, ok := infoMap["length"].(int64); ok {
+		info.TotalSize = length
+		info.files = []contentFile{{path: info.Name, name: info.Name, size: length}}
+	} else if files, ok := infoMap["files"].([]interface{}); ok {
+		for _, file := range files {
+			if fileMap, ok := file.(map[string]interface{}); ok {
+				length, _ := fileMap["length"].(int64)
+				info.TotalSize += length
+
+				components := append([]string{info.Name}, bencodeStrings(fileMap["path"])...)
+				info.files = append(info.files, contentFile{
+					path: path.Join(components...),
+					name: components[len(components)-1],
+					size: length,
+				})
+			}
+		}
+	}
+
+	// The announce-list, if present, supersedes the announce URL.
+	if tiers, ok := benmap["announce-list"].([]interface{}); ok {
+		for _, tier := range tiers {
+			info.Trackers = append(info.Trackers, bencodeStrings(tier)...)
+		}
+	} else {
+		info.Trackers = bencodeStrings(benmap["announce"])
+	}
+
+	return info, nil
+}
+
+// bencodeStrings returns the strings contained in the given decoded bencode value, which is
+// either a string or a list of strings.
+func bencodeStrings(value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+
+	case []interface{}:
+		var strs []string
+		for _, item := range value {
+			if str, ok := item.(string); ok {
+				strs = append(strs, str)
+			}
+		}
+		return strs
+
+	default:
+		return nil
+	}
+}
+
 // updateTorrentFile updates the torrent file found at the given path, removing the web seeds
-// and/or trackers.
-func updateTorrentFile(torrentPath string, clearWebSeeds bool, clearTrackers bool) error {
+// and/or trackers. If webSeed is not empty, it replaces the web seeds instead.
+func updateTorrentFile(torrentPath string, clearWebSeeds bool, webSeed string, clearTrackers bool) error {
 	torrentFile, err := os.Open(torrentPath)
 	if err != nil {
 		torrentFile.Close()
@@ -39,6 +382,8 @@ func updateTorrentFile(torrentPath string, clearWebSeeds bool, clearTrackers boo
 	benmap := result.(map[string]interface{})
 	if clearWebSeeds {
 		delete(benmap, "url-list")
+	} else if webSeed != "" {
+		benmap["url-list"] = []interface{}{webSeed}
 	}
 
 	if clearTrackers {
@@ -0,0 +1,96 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bittorrent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// testTorrentFile is the content of a minimal .torrent file.
+var testTorrentFile = []byte("d8:announce23:http://tracker/announce4:infod6:lengthi4e4:name5:layer12:piece lengthi16384e6:pieces20:01234567890123456789ee")
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestDownloadTorrentFile(t *testing.T) {
+	oversized := append([]byte{'d'}, make([]byte, maxTorrentFileSize)...)
+
+	tests := []struct {
+		name            string
+		body            []byte
+		contentEncoding string
+		client          *http.Client
+		expectError     bool
+	}{
+		{"plain", testTorrentFile, "", http.DefaultClient, false},
+		{"gzip magic", gzipped(t, testTorrentFile), "", http.DefaultClient, false},
+		{"gzip content encoding", gzipped(t, testTorrentFile), "gzip", http.DefaultClient, false},
+		{"gzip content encoding not handled by the transport", gzipped(t, testTorrentFile), "gzip",
+			&http.Client{Transport: &http.Transport{DisableCompression: true}}, false},
+		{"not bencoded", []byte("<html>error</html>"), "", http.DefaultClient, true},
+		{"decompressed size above the maximum", gzipped(t, oversized), "", http.DefaultClient, true},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", torrentMediaType)
+			if test.contentEncoding != "" {
+				w.Header().Set("Content-Encoding", test.contentEncoding)
+			}
+			w.Write(test.body)
+		}))
+
+		path, err := downloadTorrentFile(test.client, server.URL+"/layer.torrent", nil, nil)
+		server.Close()
+
+		if test.expectError {
+			if err == nil {
+				os.Remove(path)
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+		os.Remove(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, testTorrentFile) {
+			t.Errorf("%s: got %q, expected the decompressed .torrent file", test.name, data)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bittorrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// trackerCheckTimeout defines the maximum time to wait for a tracker to answer CheckTracker.
+const trackerCheckTimeout = 10 * time.Second
+
+// udpTrackerProtocolID is the magic constant starting the connect requests of the UDP tracker
+// protocol (BEP 15).
+const udpTrackerProtocolID = 0x41727101980
+
+// CheckTracker ensures that the tracker with the given announce URL can be reached: HTTP trackers
+// must answer a request, UDP trackers a connect request. A tracker specified by its hostname only
+// must resolve.
+func CheckTracker(client *http.Client, announceURL string) error {
+	if !strings.Contains(announceURL, "://") {
+		host := announceURL
+		if h, _, err := net.SplitHostPort(announceURL); err == nil {
+			host = h
+		}
+
+		if _, err := net.LookupHost(host); err != nil {
+			return fmt.Errorf("could not resolve %v: %v", host, err)
+		}
+		return nil
+	}
+
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		// Trackers answer announces without parameters with an error, which is enough to know
+		// that they are reachable.
+		resp, err := client.Get(announceURL)
+		if err != nil {
+			return fmt.Errorf("could not reach %v: %v", announceURL, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode/100 == 5 {
+			return fmt.Errorf("got %v from %v", resp.StatusCode, announceURL)
+		}
+		return nil
+
+	case "udp":
+		return checkUDPTracker(u.Host)
+	}
+
+	return fmt.Errorf("unsupported tracker scheme %v in %v", u.Scheme, announceURL)
+}
+
+// checkUDPTracker sends a connect request to the UDP tracker at the given address and waits for
+// its answer.
+func checkUDPTracker(addr string) error {
+	conn, err := net.DialTimeout("udp", addr, trackerCheckTimeout)
+	if err != nil {
+		return fmt.Errorf("could not reach udp://%v: %v", addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(trackerCheckTimeout))
+
+	// The connect request is made of the protocol ID, the connect action (0) and a transaction ID,
+	// which the answer echoes after the action.
+	transactionID := rand.Uint32()
+	var request bytes.Buffer
+	binary.Write(&request, binary.BigEndian, uint64(udpTrackerProtocolID))
+	binary.Write(&request, binary.BigEndian, uint32(0))
+	binary.Write(&request, binary.BigEndian, transactionID)
+
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		return fmt.Errorf("could not reach udp://%v: %v", addr, err)
+	}
+
+	answer := make([]byte, 16)
+	n, err := conn.Read(answer)
+	if err != nil {
+		return fmt.Errorf("no answer from udp://%v: %v", addr, err)
+	}
+
+	if n < 16 || binary.BigEndian.Uint32(answer[0:4]) != 0 || binary.BigEndian.Uint32(answer[4:8]) != transactionID {
+		return fmt.Errorf("invalid answer from udp://%v", addr)
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/coreos/quayctl/engine"
+)
+
+// The exit codes of quayctl, which tell scripts the category of a failure, e.g. to retry the
+// network failures but not the pulls of images that do not exist.
+const (
+	exitFailure        = 1
+	exitAuthFailure    = 2
+	exitImageNotFound  = 3
+	exitNetworkFailure = 4
+	exitLoadFailure    = 5
+	exitTimeout        = 6
+)
+
+// exitCode returns the exit code corresponding to the category of the given error, or the status
+// of the `--on-complete` command if it failed.
+func exitCode(err error) int {
+	if hookErr, ok := err.(*onCompleteError); ok {
+		return hookErr.status
+	}
+
+	switch engine.FailureKindOf(err) {
+	case engine.AuthFailure:
+		return exitAuthFailure
+	case engine.ImageNotFoundFailure:
+		return exitImageNotFound
+	case engine.NetworkFailure:
+		return exitNetworkFailure
+	case engine.LoadFailure:
+		return exitLoadFailure
+	case engine.TimeoutFailure:
+		return exitTimeout
+	}
+
+	return exitFailure
+}
+
+// fatal logs the given error and exits with the exit code of its category.
+func fatal(err error) {
+	log.Error(err)
+	os.Exit(exitCode(err))
+}
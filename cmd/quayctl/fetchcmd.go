@@ -0,0 +1,76 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/quayctl/engine"
+)
+
+var torrentFetchCommand = &cobra.Command{
+	Use:   "fetch <reference>",
+	Short: "download the blobs of a manifest (e.g. an artifact) to a directory",
+	Run:   torrentFetchRun,
+}
+
+var torrentFetchOutput string
+
+func init() {
+	torrentFetchCommand.Flags().StringVar(&torrentFetchOutput, "output", "", "The directory to which the manifest and its blobs are written")
+	addTorrentClientFlags(torrentFetchCommand.Flags())
+	torrentToolsCommand.AddCommand(torrentFetchCommand)
+}
+
+func torrentFetchRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatal("failed to specify one reference to be fetched")
+	}
+
+	if torrentFetchOutput == "" {
+		log.Fatal("failed to specify the output directory via --output")
+	}
+
+	if err := checkRegistryFlags(); err != nil {
+		log.Fatal(err)
+	}
+
+	ref, insecure, err := resolveInsecure(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	clientConfig, err := buildClientConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := configureBlobSources(clientConfig); err != nil {
+		log.Fatal(err)
+	}
+
+	err = engine.FetchBlobs(ref, torrentFetchOutput, insecure, buildDownloadOptions(clientConfig), stopOnSignal())
+	if err == engine.ErrStopped {
+		log.Println("Cleanly shut down")
+		return
+	}
+
+	if err != nil {
+		fatal(err)
+	}
+
+	printResult("Successfully fetched %v to %v", ref, torrentFetchOutput)
+}
@@ -0,0 +1,104 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/quayctl/bittorrent"
+	"github.com/coreos/quayctl/dockerdist"
+	"github.com/coreos/quayctl/httpclient"
+)
+
+var torrentToolsCommand = &cobra.Command{
+	Use:   "torrent",
+	Short: "utilities for working with torrents",
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Usage()
+		os.Exit(1)
+	},
+}
+
+var torrentInspectCommand = &cobra.Command{
+	Use:   "inspect <file-or-url>",
+	Short: "print information about a .torrent file",
+	Run:   torrentInspectRun,
+}
+
+var torrentInspectScrape bool
+
+func init() {
+	torrentInspectCommand.Flags().BoolVar(&torrentInspectScrape, "scrape", false, "If specified, the trackers are queried for the number of seeders and leechers of the torrent")
+	torrentInspectCommand.Flags().StringVar(&torrentProxy, "proxy", "", "URL of the HTTP or SOCKS5 proxy used to download the .torrent file. If not specified, the HTTP_PROXY environment variable is used.")
+	torrentInspectCommand.Flags().BoolVar(&dockerdist.TLSSkipVerify, "tls-skip-verify", false, "If specified, the TLS certificate of the server is not verified, e.g. if it is self-signed")
+	torrentToolsCommand.AddCommand(torrentInspectCommand)
+}
+
+func torrentInspectRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatal("failed to specify one .torrent file to be inspected")
+	}
+
+	httpClient, err := httpclient.New(httpclient.Config{Proxy: torrentProxy, TLSSkipVerify: dockerdist.TLSSkipVerify, UserAgent: userAgent()})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	info, err := bittorrent.InspectTorrentFile(httpClient, args[0])
+	if err != nil {
+		log.Fatalf("Could not inspect %v: %v", args[0], err)
+	}
+
+	fmt.Printf("Name:         %s\n", info.Name)
+	fmt.Printf("Info-hash:    %s\n", info.InfoHash)
+	fmt.Printf("Total size:   %s (%d bytes)\n", humanize.Bytes(uint64(info.TotalSize)), info.TotalSize)
+	fmt.Printf("Piece length: %s (%d bytes)\n", humanize.Bytes(uint64(info.PieceLength)), info.PieceLength)
+	fmt.Printf("Pieces:       %d\n", info.NumPieces)
+
+	fmt.Println("Trackers:")
+	for _, tracker := range info.Trackers {
+		fmt.Printf("  %s\n", tracker)
+	}
+
+	fmt.Println("Web seeds:")
+	for _, webSeed := range info.WebSeeds {
+		fmt.Printf("  %s\n", webSeed)
+	}
+
+	if !torrentInspectScrape {
+		return
+	}
+
+	seeders, leechers, err := bittorrent.ScrapeTrackers(httpClient, info)
+	if err != nil {
+		log.Fatalf("Could not scrape the trackers of %v: %v", args[0], err)
+	}
+
+	fmt.Printf("Seeders:      %d\n", seeders)
+	fmt.Printf("Leechers:     %d\n", leechers)
+
+	if seeders == 0 {
+		if len(info.WebSeeds) > 0 {
+			log.Warnln("There is no seeder: a pull will rely entirely on the web seed")
+		} else {
+			log.Warnln("There is neither a seeder nor a web seed: a pull will not complete until a seeder appears")
+		}
+	}
+}
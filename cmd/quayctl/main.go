@@ -16,13 +16,29 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"os"
+	"runtime"
+	"strings"
 
+	log "github.com/Sirupsen/logrus"
+	"github.com/appc/spec/discovery"
 	"github.com/spf13/cobra"
 
+	"github.com/coreos/quayctl/dockerdist"
 	"github.com/coreos/quayctl/engine"
+	"github.com/coreos/quayctl/httpclient"
 )
 
+// quietFlag is the number of times the `--quiet` flag has been specified.
+var quietFlag int
+
+// logLevelFlag is the value of the `--log-level` flag.
+var logLevelFlag string
+
+// userAgentFlag is the value of the `--user-agent` flag.
+var userAgentFlag string
+
 var rootCommand = &cobra.Command{
 	Use:   "quayctl",
 	Short: "Quay cuddle",
@@ -31,14 +47,111 @@ var rootCommand = &cobra.Command{
 		cmd.Usage()
 		os.Exit(1)
 	},
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		configureLogging()
+		configureDiscoveryDial()
+		configureUserAgent()
+	},
+}
+
+// logFormatter formats log entries the same way as the standard log package, prefixing the
+// messages that are not informational with their level.
+type logFormatter struct{}
+
+func (f logFormatter) Format(entry *log.Entry) ([]byte, error) {
+	message := strings.TrimSuffix(entry.Message, "\n")
+	if entry.Level != log.InfoLevel {
+		message = fmt.Sprintf("%s: %s", entry.Level, message)
+	}
+
+	return []byte(fmt.Sprintf("%s %s\n", entry.Time.Format("2006/01/02 15:04:05"), message)), nil
+}
+
+// configureLogging configures the logger according to the flags. The `--quiet` flag takes
+// precedence over the `--log-level` flag when it is more restrictive.
+func configureLogging() {
+	log.SetFormatter(logFormatter{})
+
+	level, err := parseLogLevel(logLevelFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch {
+	case quietFlag == 1 && level > log.WarnLevel:
+		level = log.WarnLevel
+	case quietFlag > 1 && level > log.ErrorLevel:
+		level = log.ErrorLevel
+	}
+
+	log.SetLevel(level)
+}
+
+// parseLogLevel parses the value of the `--log-level` flag.
+func parseLogLevel(value string) (log.Level, error) {
+	switch value {
+	case "debug":
+		return log.DebugLevel, nil
+	case "info":
+		return log.InfoLevel, nil
+	case "warn":
+		return log.WarnLevel, nil
+	case "error":
+		return log.ErrorLevel, nil
+	}
+
+	return 0, fmt.Errorf("invalid value for --log-level: %v (expected 'debug', 'info', 'warn' or 'error')", value)
 }
 
+// userAgent returns the User-Agent sent in the outbound HTTP requests: the value of the
+// `--user-agent` flag, or one identifying the build of quayctl.
+func userAgent() string {
+	if userAgentFlag != "" {
+		return userAgentFlag
+	}
+
+	version := githash
+	if !gitHashRegexp.MatchString(version) {
+		version = "unknown"
+	}
+
+	return fmt.Sprintf("quayctl/%s (%s/%s)", version, runtime.GOOS, runtime.GOARCH)
+}
+
+// configureUserAgent sets the User-Agent of the HTTP clients that are not built by quayctl, i.e.
+// those talking to the registries and performing the discovery of rkt images.
+func configureUserAgent() {
+	dockerdist.UserAgent = userAgent()
+	discovery.Client.Transport = httpclient.WithUserAgent(discovery.Client.Transport, dockerdist.UserAgent)
+	discovery.ClientInsecureTLS.Transport = httpclient.WithUserAgent(discovery.ClientInsecureTLS.Transport, dockerdist.UserAgent)
+}
+
+// configureDiscoveryDial makes the HTTP clients performing the discovery of rkt images connect via
+// httpclient.Dial, so that the hostname overrides of the `--resolve` flags apply to them.
+func configureDiscoveryDial() {
+	for _, client := range []*http.Client{discovery.Client, discovery.ClientInsecureTLS} {
+		if transport, ok := client.Transport.(*http.Transport); ok {
+			transport.Dial = httpclient.Dial
+		}
+	}
+}
+
+// printResult prints the final result of a command. It is only silenced when the `--quiet` flag
+// is specified twice.
+func printResult(format string, args ...interface{}) {
+	if quietFlag < 2 {
+		fmt.Printf(format+"\n", args...)
+	}
+}
+
+// containerEngines are the container engines with which quayctl can interact.
+var containerEngines = []engine.ContainerEngine{&engine.RktEngine{}, &engine.DockerEngine{}, &engine.CRIEngine{}}
+
 // addEngineCommands adds a command for each container engine to the root command, as well
 // as generating the engine-specific commands.
 func addEngineCommands(rootCommand *cobra.Command) {
 	// Add each of the engines.
-	engines := []engine.ContainerEngine{&engine.RktEngine{}, &engine.DockerEngine{}}
-	for _, engine := range engines {
+	for _, engine := range containerEngines {
 		engineCommand := &cobra.Command{
 			Use:   engine.Name(),
 			Short: engine.Title(),
@@ -53,12 +166,24 @@ func addEngineCommands(rootCommand *cobra.Command) {
 
 		// Add the `torrent` commands to each of the engines.
 		addTorrentCommands(engine, engineCommand)
+
+		// Add the `manifest` diagnostic command to Docker.
+		if engine.Name() == "docker" {
+			engineCommand.AddCommand(dockerManifestCommand)
+		}
 	}
 }
 
 func init() {
+	rootCommand.PersistentFlags().StringVar(&logLevelFlag, "log-level", "info", "The verbosity of the logs, including those of the local registry used to load Docker images: debug, info, warn or error.")
+	rootCommand.PersistentFlags().StringVar(&userAgentFlag, "user-agent", "", "The User-Agent sent in the HTTP requests. If not specified, one identifying the version of quayctl is used.")
+	rootCommand.PersistentFlags().CountVarP(&quietFlag, "quiet", "q", "Suppress progress bars and informational messages. Specify twice to also suppress the final result.")
+
 	addEngineCommands(rootCommand)
+	rootCommand.AddCommand(torrentToolsCommand)
 	rootCommand.AddCommand(versionCommand)
+	rootCommand.AddCommand(updateCommand)
+	rootCommand.AddCommand(selftestCommand)
 }
 
 func main() {
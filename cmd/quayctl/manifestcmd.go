@@ -0,0 +1,99 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/quayctl/dockerdist"
+)
+
+var dockerManifestCommand = &cobra.Command{
+	Use:   "manifest <image>",
+	Short: "print the manifest of an image, as served by the registry",
+	Run:   dockerManifestRun,
+}
+
+func init() {
+	flags := dockerManifestCommand.Flags()
+	flags.BoolVar(&insecureFlag, "insecure", false, "If specified, HTTP is used in place of HTTPS to talk to the registry. If neither --insecure nor --secure is specified, HTTP is used for http:// images and for local registries (localhost, .local names and private IPs).")
+	flags.BoolVar(&secureFlag, "secure", false, "If specified, HTTPS is used to talk to the registry, even if it is local")
+	flags.StringVar(&defaultRegistryFlag, "default-registry", defaultRegistry, "Hostname of the registry of the images specified without one, e.g. yournamespace/yourrepository. Use docker.io for Docker Hub.")
+	flags.BoolVar(&dockerdist.TLSSkipVerify, "tls-skip-verify", false, "If specified, the TLS certificate of the registry is not verified, e.g. if it is self-signed")
+	flags.StringVar(&dockerdist.RegistryToken, "registry-token", "", "If specified, bearer token used to talk to the registry in place of the credentials of the docker config")
+	flags.StringVar(&dockerdist.RegistryUsername, "registry-username", "", "If specified with --registry-password, username used to talk to the registry in place of the credentials of the docker config")
+	flags.StringVar(&dockerdist.RegistryPassword, "registry-password", "", "Password used with --registry-username")
+	flags.StringSliceVar(&dockerdist.RegistryMirrors, "registry-mirror", []string{}, "If specified, hostname (e.g. mirror.internal:5000) of a registry mirror from which the manifest is downloaded, before falling back to the registry of the image. Can be repeated; mirrors are tried in order.")
+	flags.StringSliceVar(&resolveFlags, "resolve", []string{}, "If specified, host:ip (e.g. registry.staging:10.0.0.5) connecting to the given IP address in place of resolving the hostname, e.g. for a registry that is not in DNS. Can be repeated.")
+}
+
+func dockerManifestRun(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatal("failed to specify one image whose manifest is to be printed")
+	}
+
+	if err := checkRegistryFlags(); err != nil {
+		log.Fatal(err)
+	}
+
+	image, insecure, err := resolveInsecure(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, source, manifest, err := dockerdist.DownloadManifest(image, insecure, nil)
+	if err != nil {
+		log.Fatalf("Could not download image manifest: %v", err)
+	}
+
+	mediaType, payload, err := manifest.Payload()
+	if err != nil {
+		log.Fatalf("Could not read image manifest: %v", err)
+	}
+
+	manifestDigest, err := dockerdist.ManifestDigest(manifest)
+	if err != nil {
+		log.Fatalf("Could not compute the digest of the image manifest: %v", err)
+	}
+
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, payload, "", "  "); err != nil {
+		log.Fatalf("Could not format image manifest: %v", err)
+	}
+
+	fmt.Printf("Registry:   %s\n", source.Hostname())
+	fmt.Printf("Media type: %s\n", mediaType)
+	fmt.Printf("Digest:     %s\n", manifestDigest)
+
+	if list, ok := manifest.(*manifestlist.DeserializedManifestList); ok {
+		fmt.Println("Platforms:")
+		for _, descriptor := range list.Manifests {
+			platform := descriptor.Platform.OS + "/" + descriptor.Platform.Architecture
+			if descriptor.Platform.Variant != "" {
+				platform += "/" + descriptor.Platform.Variant
+			}
+
+			fmt.Printf("  %-16s %s\n", platform, descriptor.Digest)
+		}
+	}
+
+	fmt.Println(pretty.String())
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/quayctl/bittorrent"
+)
+
+var torrentPruneCommand = &cobra.Command{
+	Use:   "prune",
+	Short: "remove the downloaded torrents that are not being seeded from the torrent folder",
+	Run:   torrentPruneRun,
+}
+
+var (
+	torrentPruneOlderThan time.Duration
+	torrentPruneDryRun    bool
+)
+
+func init() {
+	torrentPruneCommand.Flags().DurationVar(&torrentPruneOlderThan, "older-than", 0, "If specified, only the torrents that have not been accessed for this duration (e.g. 24h) are removed")
+	torrentPruneCommand.Flags().BoolVar(&torrentPruneDryRun, "dry-run", false, "If specified, the files that would be removed are listed, but not removed")
+	torrentToolsCommand.AddCommand(torrentPruneCommand)
+}
+
+func torrentPruneRun(cmd *cobra.Command, args []string) {
+	removed, err := bittorrent.Prune(torrentFolder, torrentPruneOlderThan, torrentPruneDryRun)
+	if err != nil {
+		log.Fatalf("Could not prune torrent folder %v: %v", torrentFolder, err)
+	}
+
+	for _, removedPath := range removed {
+		if torrentPruneDryRun {
+			printResult("Would remove %v", removedPath)
+		} else {
+			printResult("Removed %v", removedPath)
+		}
+	}
+
+	if torrentPruneDryRun {
+		printResult("%d file(s) would be removed from %v", len(removed), torrentFolder)
+	} else {
+		printResult("Removed %d file(s) from %v", len(removed), torrentFolder)
+	}
+}
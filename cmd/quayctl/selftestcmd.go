@@ -0,0 +1,219 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/quayctl/bittorrent"
+	"github.com/coreos/quayctl/engine"
+)
+
+var selftestCommand = &cobra.Command{
+	Use:   "selftest",
+	Short: "check that this machine can pull images via BitTorrent",
+	Long:  "Check that the listen ports can be opened, that the trackers can be reached and that the container engine can be used, and optionally pull an image end-to-end",
+	Run:   selftestRun,
+}
+
+var (
+	selftestEngine      string
+	selftestPull        string
+	selftestPullTimeout time.Duration
+)
+
+func init() {
+	flags := selftestCommand.Flags()
+	flags.StringVar(&selftestEngine, "engine", "docker", "Container engine to check: 'docker', 'rkt' or 'crio'")
+	flags.StringVar(&selftestPull, "pull", "", "If specified, image (ideally a tiny one) pulled end-to-end via BitTorrent, every layer being downloaded")
+	flags.DurationVar(&selftestPullTimeout, "pull-timeout", 5*time.Minute, "Maximum duration of the pull of --pull, after which the check fails")
+
+	addTorrentClientFlags(flags)
+	for _, containerEngine := range containerEngines {
+		containerEngine.TorrentHandler().DecorateCommand(selftestCommand)
+	}
+}
+
+// selftestResult is the outcome of a check of the selftest command.
+type selftestResult string
+
+const (
+	selftestPass selftestResult = "PASS"
+	selftestFail selftestResult = "FAIL"
+	selftestSkip selftestResult = "SKIP"
+)
+
+func selftestRun(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		log.Fatal("selftest takes no argument")
+	}
+
+	var containerEngine engine.ContainerEngine
+	for _, e := range containerEngines {
+		if e.Name() == selftestEngine {
+			containerEngine = e
+		}
+	}
+	if containerEngine == nil {
+		log.Fatalf("invalid value for --engine: %v (expected 'docker', 'rkt' or 'crio')", selftestEngine)
+	}
+
+	if err := checkRegistryFlags(); err != nil {
+		log.Fatal(err)
+	}
+
+	clientConfig, err := buildClientConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := false
+	report := func(result selftestResult, check, detail string) {
+		fmt.Printf("%s  %-14s %s\n", result, check, detail)
+		failed = failed || result == selftestFail
+	}
+
+	// Ensure that peers can connect to at least one port of the listen range.
+	if port, err := checkListenPorts(torrentLowerPort, torrentUpperPort); err != nil {
+		report(selftestFail, "listen ports", err.Error())
+	} else {
+		report(selftestPass, "listen ports", fmt.Sprintf("port %d of %d-%d is available", port, torrentLowerPort, torrentUpperPort))
+	}
+
+	// Ensure that the trackers can be reached. Without custom trackers, those of the .torrent
+	// files served by the registry are used, which are only known when pulling.
+	downloadConfig := buildDownloadConfig()
+	if len(downloadConfig.CustomTrackers) == 0 {
+		report(selftestSkip, "trackers", "no tracker configured, the trackers of the registry are used")
+	}
+	for _, tracker := range downloadConfig.CustomTrackers {
+		if err := bittorrent.CheckTracker(clientConfig.HTTPClient, tracker); err != nil {
+			report(selftestFail, "tracker", err.Error())
+		} else {
+			report(selftestPass, "tracker", tracker+" is reachable")
+		}
+	}
+
+	// Ensure that the container engine can be used.
+	engineErr := containerEngine.TorrentHandler().CheckEngine()
+	if engineErr != nil {
+		report(selftestFail, "engine", fmt.Sprintf("%s: %v", containerEngine.Name(), engineErr))
+	} else {
+		report(selftestPass, "engine", containerEngine.Name()+" can be used")
+	}
+
+	// Pull the image end-to-end, if requested.
+	switch {
+	case selftestPull == "":
+		report(selftestSkip, "pull", "no image specified via --pull")
+	case engineErr != nil:
+		report(selftestSkip, "pull", "the container engine cannot be used")
+	default:
+		if err := selftestPullImage(containerEngine, clientConfig, downloadConfig); err != nil {
+			report(selftestFail, "pull", err.Error())
+		} else {
+			report(selftestPass, "pull", selftestPull+" was pulled")
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// checkListenPorts returns the first port of the given range on which both TCP and UDP (used by
+// uTP and the DHT) connections can be accepted.
+func checkListenPorts(lowerPort, upperPort int) (int, error) {
+	if lowerPort <= 0 || upperPort > 65535 || lowerPort > upperPort {
+		return 0, fmt.Errorf("invalid port range %d-%d", lowerPort, upperPort)
+	}
+
+	var errs []string
+	for port := lowerPort; port <= upperPort; port++ {
+		address := fmt.Sprintf(":%d", port)
+
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		listener.Close()
+
+		conn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		conn.Close()
+
+		return port, nil
+	}
+
+	return 0, errors.New("no port can be opened: " + strings.Join(errs, "; "))
+}
+
+// selftestPullImage pulls the image of the --pull flag into the given container engine via
+// BitTorrent, downloading every layer even if already present.
+func selftestPullImage(containerEngine engine.ContainerEngine, clientConfig bittorrent.ClientConfig, downloadConfig bittorrent.DownloadConfig) error {
+	image, insecure, err := resolveInsecure(selftestPull)
+	if err != nil {
+		return err
+	}
+
+	if err := configureBlobSources(clientConfig); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selftestPullTimeout)
+	defer cancel()
+
+	err = engine.Pull(ctx, image, engine.PullOptions{
+		Engine:   containerEngine,
+		Insecure: insecure,
+		Layers:   engine.AllLayers,
+		DownloadOptions: engine.DownloadOptions{
+			TorrentFolder:  torrentFolder,
+			ClientConfig:   clientConfig,
+			DownloadConfig: downloadConfig,
+			Progress:       engine.ProgressMode(torrentProgress),
+		},
+	})
+
+	// Report the category of the failure, e.g. a layer that could not be downloaded, as the pull
+	// check fails rather than quayctl exiting.
+	switch engine.FailureKindOf(err) {
+	case engine.TimeoutFailure:
+		return fmt.Errorf("timed out after %v", selftestPullTimeout)
+	case engine.AuthFailure:
+		return fmt.Errorf("authentication failure: %v", err)
+	case engine.ImageNotFoundFailure:
+		return fmt.Errorf("image not found: %v", err)
+	case engine.NetworkFailure:
+		return fmt.Errorf("network failure: %v", err)
+	case engine.LoadFailure:
+		return fmt.Errorf("load failure: %v", err)
+	}
+
+	return err
+}
@@ -15,30 +15,91 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/reference"
+	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/net/context"
 
 	"github.com/coreos/quayctl/bittorrent"
+	"github.com/coreos/quayctl/dockerdist"
 	"github.com/coreos/quayctl/engine"
+	"github.com/coreos/quayctl/httpclient"
+)
+
+// The default port ranges of the pulls and of the seeds are distinct, so that a long-running
+// seeder and interactive pulls on the same host do not compete for the same ports.
+const (
+	pullLowerPort = 6881
+	pullUpperPort = 6889
+	seedLowerPort = 6890
+	seedUpperPort = 6899
+)
+
+// The limits of the seed profile, which tunes the client for a seed box serving many peers.
+const (
+	seedProfileMaxConnections = 1000
+	seedProfileMaxUploads     = 100
 )
 
 var (
-	torrentFingerprint          bittorrent.ClientFingerprint
-	torrentFolder               string
-	torrentLowerPort            int
-	torrentUpperPort            int
-	torrentConnectionsPerSecond int
-	torrentMaxDowloadRate       int
-	torrentMaxUploadRate        int
-	torrentSeedDuration         time.Duration
-	torrentEncryptionMode       int
-	torrentDebug                bool
-	insecureFlag                bool
-	skipWebSeed                 bool
-	trackers                    []string
+	torrentFingerprint           bittorrent.ClientFingerprint
+	torrentFolder                string
+	torrentLowerPort             int
+	torrentUpperPort             int
+	torrentPeerPort              int
+	torrentAnnounceIP            string
+	torrentFastShutdown          bool
+	torrentPieceTimeout          time.Duration
+	torrentAggressiveEndgame     bool
+	torrentPeerToS               int
+	torrentConnectionsPerSecond  int
+	torrentConnectionsPerTorrent int
+	torrentMaxDowloadRate        int
+	torrentMaxUploadRate         int
+	torrentSeedDuration          time.Duration
+	torrentSeedAfterPull         bool
+	torrentSeedReadOnly          string
+	torrentSeedProfile           bool
+	torrentPullTimeout           time.Duration
+	torrentPullLayers            string
+	torrentPullForce             bool
+	torrentPullLockfile          string
+	torrentRegistryFallback      time.Duration
+	torrentEncryptionMode        int
+	torrentStorageMode           string
+	torrentDebug                 bool
+	torrentProxy                 string
+	torrentMetricsAddr           string
+	torrentOnComplete            string
+	torrentMaxCacheSize          string
+	torrentBlobCache             string
+	torrentMirrorManifest        string
+	torrentProgress              string
+	torrentProgressHTTPAddr      string
+	torrentControlSocket         string
+	torrentStartStagger          time.Duration
+	torrentStats                 bool
+	torrentWebSeed               string
+	insecureFlag                 bool
+	secureFlag                   bool
+	defaultRegistryFlag          string
+	resolveFlags                 []string
+	skipWebSeed                  bool
+	webSeedFallback              time.Duration
+	trackers                     []string
 )
 
 func init() {
@@ -84,18 +145,64 @@ func addTorrentCommands(engine engine.ContainerEngine, engineCommand *cobra.Comm
 
 	// Decorate the torrent command with any engine-specific flags.
 	engine.TorrentHandler().DecorateCommand(torrentCommand)
-	torrentCommand.PersistentFlags().IntVar(&torrentLowerPort, "lower-port", 6881, "Lower port that listens for peer connections")
-	torrentCommand.PersistentFlags().IntVar(&torrentUpperPort, "upper-port", 6889, "Upper port that listens for peer connections")
-	torrentCommand.PersistentFlags().IntVar(&torrentConnectionsPerSecond, "connections-per-second", 200, "Number of connection attempts that are made per second")
-	torrentCommand.PersistentFlags().IntVar(&torrentMaxDowloadRate, "download-rate", 0, "Maximum download rate in kB/s. 0 means unlimited.")
-	torrentCommand.PersistentFlags().IntVar(&torrentMaxUploadRate, "upload-rate", 0, "Maximum upload rate in kB/s. 0 means unlimited.")
-	torrentCommand.PersistentFlags().IntVar(&torrentEncryptionMode, "encryption-mode", int(bittorrent.FORCED), "Encryption mode for connections. 0 means that only encrypted connections are allowed, 1 that encryption is preferred but not enforced and 2 that encryption is disabled.")
-	torrentCommand.PersistentFlags().BoolVar(&torrentDebug, "debug", false, "BitTorrent protocol verbosity")
-	torrentCommand.PersistentFlags().BoolVar(&insecureFlag, "insecure", false, "If specified, HTTP is used in place of HTTPS to talk to the registry")
-	torrentCommand.PersistentFlags().BoolVar(&skipWebSeed, "skip-web-seed", false, "If true, the web seed will not be used when pulling")
-	torrentCommand.PersistentFlags().StringSliceVar(&trackers, "tracker", []string{}, "If specified, will override the tracker(s) used")
+	addTorrentClientFlags(torrentCommand.PersistentFlags())
 
 	torrentSeedCommand.Flags().DurationVar(&torrentSeedDuration, "duration", 0, "Duration of the seeding. If not specified, will seed forever.")
+	torrentSeedCommand.Flags().StringVar(&torrentSeedReadOnly, "read-only", "", "If specified, torrent folder, e.g. on read-only media, whose layers are seeded without writing to it: their pieces are verified as they are requested, and missing layers are not downloaded.")
+
+	torrentSeedCommand.Flags().BoolVar(&torrentSeedProfile, "seed-profile", false, fmt.Sprintf("If specified, the client is tuned for a seed box serving many peers: up to %d peers are uploaded to at once, up to %d peer connections are made and the download rate is not limited.", seedProfileMaxUploads, seedProfileMaxConnections))
+
+	torrentPullCommand.Flags().StringVar(&torrentPullLayers, "layers", "missing", "Layers to be pulled: 'missing' pulls only the layers missing from the container engine, 'all' pulls every layer.")
+	torrentPullCommand.Flags().BoolVar(&torrentPullForce, "force", false, "If specified, every layer is pulled and the image is loaded again, even if it is already present, overwriting it. Implies --layers=all.")
+	torrentPullCommand.Flags().DurationVar(&torrentRegistryFallback, "fallback-registry", 0, "If specified, the layers whose torrent download fails, or does not progress for this duration (e.g. 5m), are downloaded directly from the registry. If not specified, the pull fails in these cases.")
+	torrentPullCommand.Flags().BoolVar(&torrentSeedAfterPull, "seed-after-pull", false, "If specified, the image will keep being seeded once it has been pulled")
+	torrentPullCommand.Flags().DurationVar(&torrentPullTimeout, "timeout", 0, "Maximum duration of the pull, after which it fails. If not specified, the pull never times out.")
+	torrentPullCommand.Flags().StringVar(&torrentOnComplete, "on-complete", "", "Shell command run once the image has been pulled, with the image and its digest in the QUAYCTL_IMAGE and QUAYCTL_DIGEST environment variables. quayctl exits with the status of the command if it fails.")
+	torrentPullCommand.Flags().StringVar(&torrentPullLockfile, "lockfile", "", "If specified, path of a JSON object mapping image references to the digests of their expected manifests. The pull aborts if the manifest of the image does not match, or if the image is not listed.")
+	torrentPullCommand.Flags().DurationVar(&torrentSeedDuration, "seed-duration", 0, "Duration of the seeding when --seed-after-pull is specified. If not specified, will seed forever.")
+}
+
+// addTorrentClientFlags adds the flags configuring the BitTorrent client and the registry
+// requests to the given flag set.
+func addTorrentClientFlags(flags *pflag.FlagSet) {
+	flags.IntVar(&torrentLowerPort, "lower-port", pullLowerPort, fmt.Sprintf("Lower port that listens for peer connections. Seeds listen on %d-%d by default, so that a seeder and pulls can run side by side. If every port of the range is in use, the next ranges are tried.", seedLowerPort, seedUpperPort))
+	flags.IntVar(&torrentUpperPort, "upper-port", pullUpperPort, "Upper port that listens for peer connections")
+	flags.IntVar(&torrentPeerPort, "peer-port", 0, "If specified, port announced to trackers and peers in place of the listen port, e.g. when it is manually forwarded behind a NAT")
+	flags.StringVar(&torrentAnnounceIP, "announce-ip", "", "If specified, IP address announced to the trackers, e.g. the public address of a machine behind a 1:1 NAT")
+	flags.IntVar(&torrentConnectionsPerSecond, "connections-per-second", 200, "Number of connection attempts that are made per second")
+	flags.IntVar(&torrentConnectionsPerTorrent, "connections-per-torrent", 0, "Maximum number of peer connections of each torrent. 0 means unlimited.")
+	flags.DurationVar(&torrentPieceTimeout, "piece-timeout", 0, "If specified, time (e.g. 5s) after which a peer that has not sent the pieces requested from it is considered stalled, and its requests are sent to other peers. If not specified, libtorrent's default (20s) is used.")
+	flags.BoolVar(&torrentAggressiveEndgame, "aggressive-endgame", false, "If specified, the last pieces of each torrent are requested from several peers at once, so that a slow peer does not hold back the end of the download")
+	flags.IntVar(&torrentPeerToS, "peer-tos", 0, "If specified, type of service byte (0-255) set on the peer connections, e.g. 32 (DSCP CS1) so that the network deprioritizes BitTorrent traffic relative to interactive traffic")
+	flags.DurationVar(&torrentStartStagger, "start-stagger", 0, "If specified, delay (e.g. 100ms), jittered, between the starts of the torrents of an image, so that the connection attempts ramp up smoothly on images with many layers")
+	flags.BoolVar(&torrentStats, "stats", false, "If specified, a summary of the downloads (bytes downloaded from peers and from web seeds, peak rate and time elapsed, per layer and in total) is printed once they are complete or interrupted")
+	flags.IntVar(&torrentMaxDowloadRate, "download-rate", 0, "Maximum download rate in kB/s. 0 means unlimited.")
+	flags.IntVar(&torrentMaxUploadRate, "upload-rate", 0, "Maximum upload rate in kB/s. 0 means unlimited.")
+	flags.StringVar(&torrentMaxCacheSize, "max-cache-size", "0", "Maximum size (e.g. 20GB) of the downloaded torrents kept in the torrent folder. When exceeded, the least recently used ones that are not seeded are removed. 0 means unlimited.")
+	flags.StringVar(&torrentBlobCache, "blob-cache", "", "If specified, directory of a content-addressable cache (<dir>/sha256/<hex>) to which the downloaded blobs are added, and from which they are reused instead of being downloaded again, unless seeded")
+	flags.StringVar(&torrentMirrorManifest, "mirror-manifest", "", "If specified, URL or path of a JSON object mapping blobSums to alternative torrent URLs (e.g. on a local CDN), used instead of those of the registry")
+	flags.IntVar(&torrentEncryptionMode, "encryption-mode", int(bittorrent.FORCED), "Encryption mode for connections. 0 means that only encrypted connections are allowed, 1 that encryption is preferred but not enforced and 2 that encryption is disabled.")
+	flags.StringVar(&torrentStorageMode, "storage-mode", "sparse", "How the downloaded layers are allocated on disk: 'sparse' allocates them as they are downloaded, 'allocate' allocates them fully upfront, e.g. to avoid fragmentation on spinning disks.")
+	flags.StringVar(&torrentProgress, "progress", "per-layer", "Progress bars displayed during downloads: 'per-layer' displays one per layer, 'aggregate' a single one for the whole image and 'both' all of them, while 'json' writes the progress events of the downloads and of the load to stdout instead, one JSON object per line.")
+	flags.StringVar(&torrentProgressHTTPAddr, "progress-http", "", "If specified, address (e.g. :8080) on which the progress of the torrents is streamed as Server-Sent Events under /events, e.g. for a web dashboard")
+	flags.StringVar(&torrentControlSocket, "control-socket", "", "If specified, path of a unix socket on which a JSON API controlling the BitTorrent client is exposed, e.g. to list, pause or add torrents")
+	flags.BoolVar(&torrentFastShutdown, "fast-shutdown", false, "If specified, quayctl exits without waiting for the UPnP/NAT-PMP port mappings to be removed from the router, e.g. for short-lived CI pulls")
+	flags.BoolVar(&torrentDebug, "debug", false, "BitTorrent protocol verbosity")
+	flags.StringVar(&torrentProxy, "proxy", "", "URL of the HTTP or SOCKS5 proxy used to download .torrent files and signatures. If not specified, the HTTP_PROXY environment variable is used.")
+	flags.StringVar(&torrentMetricsAddr, "metrics-addr", "", "If specified, address (e.g. :9100) on which the BitTorrent metrics are exposed in the Prometheus format")
+	flags.BoolVar(&insecureFlag, "insecure", false, "If specified, HTTP is used in place of HTTPS to talk to the registry. If neither --insecure nor --secure is specified, HTTP is used for http:// images and for local registries (localhost, .local names and private IPs).")
+	flags.BoolVar(&secureFlag, "secure", false, "If specified, HTTPS is used to talk to the registry, even if it is local")
+	flags.StringVar(&defaultRegistryFlag, "default-registry", defaultRegistry, "Hostname of the registry of the images specified without one, e.g. yournamespace/yourrepository. Use docker.io for Docker Hub.")
+	flags.BoolVar(&dockerdist.TLSSkipVerify, "tls-skip-verify", false, "If specified, the TLS certificate of the registry is not verified, e.g. if it is self-signed")
+	flags.StringVar(&dockerdist.RegistryToken, "registry-token", "", "If specified, bearer token used to talk to the registry in place of the credentials of the docker config")
+	flags.StringVar(&dockerdist.RegistryUsername, "registry-username", "", "If specified with --registry-password, username used to talk to the registry in place of the credentials of the docker config")
+	flags.StringVar(&dockerdist.RegistryPassword, "registry-password", "", "Password used with --registry-username")
+	flags.StringSliceVar(&dockerdist.RegistryMirrors, "registry-mirror", []string{}, "If specified, hostname (e.g. mirror.internal:5000) of a registry mirror from which the manifest and the layers are downloaded, before falling back to the registry of the image. Can be repeated; mirrors are tried in order.")
+	flags.StringSliceVar(&resolveFlags, "resolve", []string{}, "If specified, host:ip (e.g. registry.staging:10.0.0.5) connecting to the given IP address in place of resolving the hostname, e.g. for a registry that is not in DNS. Can be repeated.")
+	flags.BoolVar(&skipWebSeed, "skip-web-seed", false, "If true, the web seed will not be used at all when pulling, even if no peer serves a layer")
+	flags.StringVar(&torrentWebSeed, "web-seed", "", "If specified, base URL (e.g. https://cache.internal/blobs/) of the web seed replacing the one of the registry; the blobSum of each layer is appended to it")
+	flags.DurationVar(&webSeedFallback, "web-seed-fallback", 0, "If specified, time (e.g. 30s) for which the download of a layer from the peers must stall before its web seed is used. If not specified, the web seed is used from the start, alongside the peers. Ignored with --skip-web-seed.")
+	flags.StringSliceVar(&trackers, "tracker", []string{}, "If specified, will override the tracker(s) used. If not specified, the trackers listed in the QUAYCTL_TRACKERS environment variable (comma-separated) are used, if any.")
 }
 
 func torrentPullRun(cmd *cobra.Command, args []string, containerEngine engine.ContainerEngine) {
@@ -103,37 +210,102 @@ func torrentPullRun(cmd *cobra.Command, args []string, containerEngine engine.Co
 		log.Fatal("failed to specify one image to be pulled")
 	}
 
-	image := args[0]
-	downloadConfig := bittorrent.DownloadConfig{skipWebSeed, trackers}
-	handler := containerEngine.TorrentHandler()
+	if err := checkRegistryFlags(); err != nil {
+		log.Fatal(err)
+	}
 
-	// Load the torrents for the image.
-	torrents, ctx, err := handler.RetrieveTorrents(image, insecureFlag, engine.MissingLayers)
+	layers := engine.MissingLayers
+	switch torrentPullLayers {
+	case "missing":
+	case "all":
+		layers = engine.AllLayers
+	default:
+		log.Fatalf("invalid value for --layers: %v (expected 'missing' or 'all')", torrentPullLayers)
+	}
+
+	image, insecure, err := resolveInsecure(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Re-pull the whole image when forced, to overwrite a possibly corrupted local copy.
+	if torrentPullForce {
+		log.Warnf("Forcing the re-pull of image %v: every layer will be downloaded and loaded again", image)
+		layers = engine.AllLayers
+	}
+
+	// Pin the manifest of the image, if requested.
+	var lockfile dockerdist.Lockfile
+	if torrentPullLockfile != "" {
+		if containerEngine.Name() == "rkt" {
+			log.Fatal("--lockfile is not supported for rkt images")
+		}
+
+		var err error
+		lockfile, err = dockerdist.LoadLockfile(torrentPullLockfile, defaultRegistryFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	clientConfig, err := buildClientConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Download the image layer(s).
-	clientConfig := bittorrent.ClientConfig{
-		Fingerprint:          torrentFingerprint,
-		LowerListenPort:      torrentLowerPort,
-		UpperListenPort:      torrentUpperPort,
-		ConnectionsPerSecond: torrentConnectionsPerSecond,
-		MaxDownloadRate:      torrentMaxDowloadRate * 1024,
-		MaxUploadRate:        torrentMaxUploadRate * 1024,
-		Encryption:           bittorrent.EncryptionMode(torrentEncryptionMode),
-		Debug:                torrentDebug,
+	if err := configureBlobSources(clientConfig); err != nil {
+		log.Fatal(err)
+	}
+
+	// Bound the duration of the pull, if requested.
+	ctx := context.Background()
+	if torrentPullTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, torrentPullTimeout)
+		defer cancel()
 	}
 
-	downloadInfo := engine.DownloadTorrents(torrents, torrentFolder, engine.TorrentNoSeed, torrentSeedDuration, clientConfig, downloadConfig)
+	// Pull the image.
+	downloadOptions := buildDownloadOptions(clientConfig)
+	downloadOptions.Seed = torrentSeedAfterPull
+	downloadOptions.SeedDuration = torrentSeedDuration
+	downloadOptions.RegistryFallback = torrentRegistryFallback
+
+	err = engine.Pull(ctx, image, engine.PullOptions{
+		Engine:          containerEngine,
+		Insecure:        insecure,
+		Layers:          layers,
+		Lock:            lockfile,
+		DownloadOptions: downloadOptions,
+		Stop:            stopOnSignal(),
+		OnPulled: func(digest string) error {
+			if torrentPullForce {
+				printResult("Successfully re-pulled image %v (forced)", image)
+			} else {
+				printResult("Successfully pulled image %v", image)
+			}
 
-	// Load the image.
-	lerr := handler.LoadImage(image, downloadInfo, ctx)
-	if lerr != nil {
-		log.Fatal(lerr)
+			// Run the completion hook, if any.
+			if torrentOnComplete != "" {
+				return runOnComplete(torrentOnComplete, image, digest)
+			}
+
+			return nil
+		},
+	})
+
+	if err == engine.ErrStopped {
+		log.Println("Cleanly shut down")
+		return
+	}
+
+	if engine.FailureKindOf(err) == engine.TimeoutFailure {
+		err = &engine.PullError{Kind: engine.TimeoutFailure, Err: fmt.Errorf("pull timed out after %v", torrentPullTimeout)}
 	}
 
-	log.Printf("Successfully pulled image %v", image)
+	if err != nil {
+		fatal(err)
+	}
 }
 
 func torrentSeedRun(cmd *cobra.Command, args []string, containerEngine engine.ContainerEngine) {
@@ -141,30 +313,363 @@ func torrentSeedRun(cmd *cobra.Command, args []string, containerEngine engine.Co
 		log.Fatal("failed to specify one image to be seeded")
 	}
 
-	image := args[0]
-	downloadConfig := bittorrent.DownloadConfig{skipWebSeed, trackers}
+	if err := checkRegistryFlags(); err != nil {
+		log.Fatal(err)
+	}
+
+	image, insecure, err := resolveInsecure(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	handler := containerEngine.TorrentHandler()
 
-	// Load the torrents for the image.
-	torrents, _, err := handler.RetrieveTorrents(image, insecureFlag, engine.AllLayers)
+	if !cmd.Flags().Changed("lower-port") && !cmd.Flags().Changed("upper-port") {
+		torrentLowerPort, torrentUpperPort = seedLowerPort, seedUpperPort
+	}
+
+	clientConfig, err := buildClientConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Seed the image layer(s).
-	clientConfig := bittorrent.ClientConfig{
-		Fingerprint:          torrentFingerprint,
-		LowerListenPort:      torrentLowerPort,
-		UpperListenPort:      torrentUpperPort,
-		ConnectionsPerSecond: torrentConnectionsPerSecond,
-		MaxDownloadRate:      torrentMaxDowloadRate * 1024,
-		MaxUploadRate:        torrentMaxUploadRate * 1024,
-		Encryption:           bittorrent.EncryptionMode(torrentEncryptionMode),
-		Debug:                torrentDebug,
+	if torrentSeedProfile {
+		applySeedProfile(&clientConfig)
+	}
+
+	folder := torrentFolder
+	if torrentSeedReadOnly != "" {
+		if torrentBlobCache != "" {
+			log.Fatal("--blob-cache cannot be used with --read-only")
+		}
+
+		folder = torrentSeedReadOnly
+		clientConfig.ReadOnlySeed = true
 	}
 
-	downloadInfo := engine.DownloadTorrents(torrents, torrentFolder, engine.TorrentSeedAfterPull, torrentSeedDuration, clientConfig, downloadConfig)
+	if err := configureBlobSources(clientConfig); err != nil {
+		log.Fatal(err)
+	}
+
+	// Load the torrents for the image.
+	torrents, _, err := handler.RetrieveTorrents(image, insecure, engine.AllLayers, nil)
+	if err != nil {
+		fatal(err)
+	}
+
+	// Seed the image layer(s).
+	downloadOptions := buildDownloadOptions(clientConfig)
+	downloadOptions.TorrentFolder = folder
+	downloadOptions.Seed = true
+	downloadOptions.SeedDuration = torrentSeedDuration
+
+	downloadInfo := engine.DownloadTorrents(torrents, downloadOptions)
+
+	stop := stopOnSignal()
+	go func() {
+		select {
+		case <-stop:
+			downloadInfo.Stop()
+		case <-downloadInfo.CompleteChannel:
+		}
+	}()
 
 	// Wait for seeding to complete.
-	<-downloadInfo.CompleteChannel
+	err = downloadInfo.Wait()
+	downloadInfo.Release()
+	if err == engine.ErrStopped {
+		log.Println("Cleanly shut down")
+		return
+	}
+
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// stopOnSignal returns a channel closed once a SIGINT or SIGTERM is received, so that the torrent
+// ops are stopped cleanly, keeping the partially downloaded data.
+func stopOnSignal() <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	stop := make(chan struct{})
+	go func() {
+		<-signals
+		log.Println("Received signal")
+		close(stop)
+	}()
+
+	return stop
+}
+
+// applySeedProfile tunes the given client configuration for a seed box serving many peers: more
+// peers are unchoked and connected to, and the download rate is not limited, since a seeder has
+// little to download.
+func applySeedProfile(clientConfig *bittorrent.ClientConfig) {
+	clientConfig.MaxConnections = seedProfileMaxConnections
+	clientConfig.MaxUploads = seedProfileMaxUploads
+
+	if clientConfig.MaxDownloadRate > 0 {
+		log.Warn("Ignoring --download-rate: the download rate is not limited with --seed-profile")
+		clientConfig.MaxDownloadRate = 0
+	}
+}
+
+// onCompleteError is returned when the `--on-complete` command fails, and holds the status quayctl
+// exits with once the pull is stopped.
+type onCompleteError struct {
+	status int
+	err    error
+}
+
+func (e *onCompleteError) Error() string {
+	return e.err.Error()
+}
+
+// runOnComplete runs the given shell command once the given image has been pulled, and returns an
+// onCompleteError holding the status of the command if it fails.
+func runOnComplete(command, image, digest string) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), "QUAYCTL_IMAGE="+image, "QUAYCTL_DIGEST="+digest)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() > 0 {
+			return &onCompleteError{status.ExitStatus(), fmt.Errorf("--on-complete command failed: %v", err)}
+		}
+	}
+
+	return &onCompleteError{exitFailure, fmt.Errorf("could not run --on-complete command: %v", err)}
+}
+
+// checkRegistryFlags ensures that the registry credentials specified by the flags, if any, are
+// complete, and that the registry mirrors are hostnames. It also installs the hostname overrides of
+// the `--resolve` flags in the HTTP clients.
+func checkRegistryFlags() error {
+	if (dockerdist.RegistryUsername == "") != (dockerdist.RegistryPassword == "") {
+		return errors.New("--registry-username and --registry-password must be specified together")
+	}
+
+	for _, mirror := range dockerdist.RegistryMirrors {
+		if mirror == "" || strings.Contains(mirror, "/") {
+			return fmt.Errorf("invalid value for --registry-mirror: %v (expected a hostname, e.g. mirror.internal:5000)", mirror)
+		}
+	}
+
+	if defaultRegistryFlag == "" || strings.Contains(defaultRegistryFlag, "/") {
+		return fmt.Errorf("invalid value for --default-registry: %v (expected a hostname, e.g. quay.io)", defaultRegistryFlag)
+	}
+
+	resolve := map[string]string{}
+	for _, override := range resolveFlags {
+		parts := strings.SplitN(override, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || net.ParseIP(strings.Trim(parts[1], "[]")) == nil {
+			return fmt.Errorf("invalid value for --resolve: %v (expected host:ip, e.g. registry.staging:10.0.0.5)", override)
+		}
+
+		resolve[strings.ToLower(parts[0])] = strings.Trim(parts[1], "[]")
+	}
+	httpclient.Resolve = resolve
+
+	return nil
+}
+
+// defaultRegistry is the registry of the images specified without a hostname, unless
+// --default-registry is specified. quayctl is meant for Quay, and Docker Hub does not serve
+// torrents anyway.
+const defaultRegistry = "quay.io"
+
+// withDefaultRegistry prefixes the given image reference with the hostname of the default
+// registry, if it does not specify one.
+func withDefaultRegistry(image string) string {
+	withRegistry := dockerdist.WithDefaultRegistry(image, defaultRegistryFlag)
+	if withRegistry != image {
+		log.Debugf("Using the default registry %v for image %v", defaultRegistryFlag, image)
+	}
+
+	return withRegistry
+}
+
+// resolveInsecure strips the http:// or https:// scheme (if any) from the given image reference,
+// prefixes it with the default registry if it has no hostname, and returns it along with whether
+// HTTP is used in place of HTTPS to talk to its registry.
+//
+// The --insecure and --secure flags take precedence over the scheme. Without either, HTTP is used
+// for the registries assumed to be local, with a warning, like Docker does for insecure registries.
+func resolveInsecure(image string) (string, bool, error) {
+	if insecureFlag && secureFlag {
+		return "", false, errors.New("--insecure and --secure cannot be specified together")
+	}
+
+	scheme := ""
+	for _, prefix := range []string{"http://", "https://"} {
+		if strings.HasPrefix(image, prefix) {
+			scheme = strings.TrimSuffix(prefix, "://")
+			image = strings.TrimPrefix(image, prefix)
+		}
+	}
+	image = withDefaultRegistry(image)
+
+	switch {
+	case insecureFlag:
+		return image, true, nil
+	case secureFlag:
+		return image, false, nil
+	case scheme != "":
+		return image, scheme == "http", nil
+	}
+
+	named, err := reference.ParseNamed(image)
+	if err == nil && dockerdist.IsLocalRegistry(named.Hostname()) {
+		log.Warnf("Using HTTP to talk to local registry %v. Specify --secure to use HTTPS.", named.Hostname())
+		return image, true, nil
+	}
+
+	return image, false, nil
+}
+
+// configureBlobSources loads the mirror manifest specified by the flags, if any, so that the
+// blobs it lists are downloaded from their alternative sources.
+func configureBlobSources(clientConfig bittorrent.ClientConfig) error {
+	if torrentMirrorManifest == "" {
+		return nil
+	}
+
+	mirrorManifest, err := engine.LoadMirrorManifest(torrentMirrorManifest, clientConfig.HTTPClient)
+	if err != nil {
+		return err
+	}
+
+	engine.BlobSources = mirrorManifest
+	return nil
+}
+
+// trackersEnv is the environment variable holding a comma-separated list of the trackers used
+// when the `--tracker` flag is not specified.
+const trackersEnv = "QUAYCTL_TRACKERS"
+
+// buildDownloadOptions returns the options of the torrent ops shared by the commands, as given on
+// the command line, around the given client configuration.
+func buildDownloadOptions(clientConfig bittorrent.ClientConfig) engine.DownloadOptions {
+	return engine.DownloadOptions{
+		TorrentFolder:    torrentFolder,
+		ClientConfig:     clientConfig,
+		DownloadConfig:   buildDownloadConfig(),
+		MetricsAddr:      torrentMetricsAddr,
+		BlobCache:        torrentBlobCache,
+		StartStagger:     torrentStartStagger,
+		WebSeed:          torrentWebSeed,
+		Progress:         engine.ProgressMode(torrentProgress),
+		ProgressHTTPAddr: torrentProgressHTTPAddr,
+		ControlSocket:    torrentControlSocket,
+		PrintStats:       torrentStats,
+	}
+}
+
+// buildDownloadConfig returns the download configuration specified by the flags.
+func buildDownloadConfig() bittorrent.DownloadConfig {
+	customTrackers := trackers
+	if len(customTrackers) == 0 {
+		for _, tracker := range strings.Split(os.Getenv(trackersEnv), ",") {
+			if tracker = strings.TrimSpace(tracker); tracker != "" {
+				customTrackers = append(customTrackers, tracker)
+			}
+		}
+	}
+
+	return bittorrent.DownloadConfig{SkipWebseed: skipWebSeed, WebSeedFallback: webSeedFallback, CustomTrackers: customTrackers}
+}
+
+// buildClientConfig returns the BitTorrent client configuration specified by the flags.
+func buildClientConfig() (bittorrent.ClientConfig, error) {
+	if torrentPeerPort < 0 || torrentPeerPort > 65535 {
+		return bittorrent.ClientConfig{}, fmt.Errorf("invalid value for --peer-port: %v (expected a port between 1 and 65535)", torrentPeerPort)
+	}
+
+	if torrentAnnounceIP != "" && net.ParseIP(torrentAnnounceIP) == nil {
+		return bittorrent.ClientConfig{}, fmt.Errorf("invalid value for --announce-ip: %v (expected an IP address)", torrentAnnounceIP)
+	}
+
+	if torrentPieceTimeout < 0 || (torrentPieceTimeout > 0 && torrentPieceTimeout < time.Second) {
+		return bittorrent.ClientConfig{}, fmt.Errorf("invalid value for --piece-timeout: %v (expected a duration of at least 1s)", torrentPieceTimeout)
+	}
+
+	if webSeedFallback < 0 {
+		return bittorrent.ClientConfig{}, fmt.Errorf("invalid value for --web-seed-fallback: %v (expected a positive duration)", webSeedFallback)
+	}
+
+	if torrentPeerToS < 0 || torrentPeerToS > 255 {
+		return bittorrent.ClientConfig{}, fmt.Errorf("invalid value for --peer-tos: %v (expected a number between 0 and 255)", torrentPeerToS)
+	}
+
+	if torrentStartStagger < 0 {
+		return bittorrent.ClientConfig{}, fmt.Errorf("invalid value for --start-stagger: %v (expected a positive duration)", torrentStartStagger)
+	}
+
+	if torrentWebSeed != "" {
+		if u, err := url.Parse(torrentWebSeed); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return bittorrent.ClientConfig{}, fmt.Errorf("invalid value for --web-seed: %v (expected an http:// or https:// URL)", torrentWebSeed)
+		}
+	}
+
+	encryptionMode := bittorrent.EncryptionMode(torrentEncryptionMode)
+	if !encryptionMode.Valid() {
+		return bittorrent.ClientConfig{}, fmt.Errorf("invalid value for --encryption-mode: %v (expected 0, 1 or 2)", torrentEncryptionMode)
+	}
+
+	var storageMode bittorrent.StorageMode
+	switch torrentStorageMode {
+	case "sparse":
+		storageMode = bittorrent.SparseStorage
+	case "allocate":
+		storageMode = bittorrent.AllocateStorage
+	default:
+		return bittorrent.ClientConfig{}, fmt.Errorf("invalid value for --storage-mode: %v (expected 'sparse' or 'allocate')", torrentStorageMode)
+	}
+
+	switch engine.ProgressMode(torrentProgress) {
+	case engine.PerLayerProgress, engine.AggregateProgress, engine.BothProgress, engine.JSONProgress:
+	default:
+		return bittorrent.ClientConfig{}, fmt.Errorf("invalid value for --progress: %v (expected 'per-layer', 'aggregate', 'both' or 'json')", torrentProgress)
+	}
+
+	maxCacheSize, err := humanize.ParseBytes(torrentMaxCacheSize)
+	if err != nil {
+		return bittorrent.ClientConfig{}, fmt.Errorf("invalid value for --max-cache-size: %v (expected a size, e.g. 20GB)", torrentMaxCacheSize)
+	}
+
+	httpClient, err := httpclient.New(httpclient.Config{Proxy: torrentProxy, TLSSkipVerify: dockerdist.TLSSkipVerify, UserAgent: userAgent()})
+	if err != nil {
+		return bittorrent.ClientConfig{}, err
+	}
+
+	return bittorrent.ClientConfig{
+		Fingerprint:              torrentFingerprint,
+		LowerListenPort:          torrentLowerPort,
+		UpperListenPort:          torrentUpperPort,
+		ExternalPort:             torrentPeerPort,
+		AnnounceIP:               torrentAnnounceIP,
+		ConnectionsPerSecond:     torrentConnectionsPerSecond,
+		MaxConnectionsPerTorrent: torrentConnectionsPerTorrent,
+		MaxDownloadRate:          torrentMaxDowloadRate * 1024,
+		MaxUploadRate:            torrentMaxUploadRate * 1024,
+		Encryption:               encryptionMode,
+		Debug:                    torrentDebug,
+		HTTPClient:               httpClient,
+		MaxCacheSize:             int64(maxCacheSize),
+		UserAgent:                userAgent(),
+		FastShutdown:             torrentFastShutdown,
+		PieceTimeout:             torrentPieceTimeout,
+		AggressiveEndgame:        torrentAggressiveEndgame,
+		PeerToS:                  torrentPeerToS,
+		StorageMode:              storageMode,
+	}, nil
 }
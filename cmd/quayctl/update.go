@@ -0,0 +1,278 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/quayctl/httpclient"
+)
+
+// releasesAPI is the URL of the GitHub API of the quayctl repository, from which the releases are
+// retrieved.
+const releasesAPI = "https://api.github.com/repos/coreos/quayctl"
+
+var updateCommand = &cobra.Command{
+	Use:   "update",
+	Short: "update quayctl to the latest release",
+	Run:   updateRun,
+}
+
+var (
+	updateCheck    bool
+	updateProxy    string
+	updateNoVerify bool
+)
+
+func init() {
+	updateCommand.Flags().BoolVar(&updateCheck, "check", false, "If specified, only reports whether a newer release exists, without updating")
+	updateCommand.Flags().BoolVar(&updateNoVerify, "no-verify", false, "If specified, installs the release even if it has no published checksum to verify its binary against")
+	updateCommand.Flags().StringVar(&updateProxy, "proxy", "", "URL of the HTTP or SOCKS5 proxy used to reach GitHub. If not specified, the HTTP_PROXY environment variable is used.")
+}
+
+// githubRelease describes a release, as returned by the GitHub API.
+type githubRelease struct {
+	TagName string        `json:"tag_name"`
+	HTMLURL string        `json:"html_url"`
+	Assets  []githubAsset `json:"assets"`
+}
+
+// githubAsset describes a file attached to a release, as returned by the GitHub API.
+type githubAsset struct {
+	Name        string `json:"name"`
+	DownloadURL string `json:"browser_download_url"`
+}
+
+// githubComparison describes the comparison of two commits, as returned by the GitHub API.
+type githubComparison struct {
+	AheadBy int `json:"ahead_by"`
+}
+
+// gitHashRegexp matches the git hashes embedded in the builds of quayctl.
+var gitHashRegexp = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+func updateRun(_ *cobra.Command, _ []string) {
+	if !gitHashRegexp.MatchString(githash) {
+		log.Fatal("Could not determine the version of quayctl: it was not built with a git hash")
+	}
+
+	client, err := httpclient.New(httpclient.Config{Proxy: updateProxy, UserAgent: userAgent()})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Compare the build with the latest release.
+	var release githubRelease
+	if err := getGitHubJSON(client, releasesAPI+"/releases/latest", &release); err != nil {
+		log.Fatalf("Could not retrieve the latest release: %v", err)
+	}
+
+	var comparison githubComparison
+	if err := getGitHubJSON(client, fmt.Sprintf("%s/compare/%s...%s", releasesAPI, githash, release.TagName), &comparison); err != nil {
+		log.Fatalf("Could not compare build %s with release %s: %v", githash, release.TagName, err)
+	}
+
+	if comparison.AheadBy == 0 {
+		fmt.Printf("quayctl is up to date (build %s, latest release %s)\n", githash, release.TagName)
+		return
+	}
+
+	fmt.Printf("A newer release of quayctl is available: %s (%s)\n", release.TagName, release.HTMLURL)
+	if updateCheck {
+		return
+	}
+
+	// Replace the running binary with the one of the release.
+	path, err := executablePath()
+	if err != nil {
+		log.Fatalf("Could not find the quayctl binary: %v", err)
+	}
+
+	if err := replaceBinary(client, release, path, updateNoVerify); err != nil {
+		log.Fatalf("Could not update quayctl: %v", err)
+	}
+
+	fmt.Printf("Updated quayctl to %s\n", release.TagName)
+}
+
+// getGitHubJSON retrieves the given URL of the GitHub API, and decodes its JSON response into v.
+func getGitHubJSON(client *http.Client, url string, v interface{}) error {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/vnd.github.v3+json")
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got %v from %v", resp.StatusCode, url)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// releaseAsset returns the asset of the given release holding the binary for the current
+// platform, and the asset holding its SHA-1 checksum (if any). Release binaries are named after
+// their platform, e.g. quayctl-linux-x64.
+func releaseAsset(release githubRelease) (githubAsset, *githubAsset, error) {
+	arch := runtime.GOARCH
+	switch arch {
+	case "amd64":
+		arch = "x64"
+	case "386":
+		arch = "x86"
+	}
+
+	platform := runtime.GOOS + "-" + arch
+	for _, asset := range release.Assets {
+		if !strings.Contains(asset.Name, platform) || strings.HasSuffix(asset.Name, ".sha") {
+			continue
+		}
+
+		for _, checksum := range release.Assets {
+			if checksum.Name == asset.Name+".sha" {
+				return asset, &checksum, nil
+			}
+		}
+
+		return asset, nil, nil
+	}
+
+	return githubAsset{}, nil, fmt.Errorf("release %s has no binary for %s", release.TagName, platform)
+}
+
+// replaceBinary downloads the binary of the given release for the current platform, verifies its
+// checksum and replaces the binary found at the given path with it. A binary without a published
+// checksum is only installed if noVerify is set.
+func replaceBinary(client *http.Client, release githubRelease, path string, noVerify bool) error {
+	asset, checksumAsset, err := releaseAsset(release)
+	if err != nil {
+		return err
+	}
+
+	if checksumAsset == nil {
+		if !noVerify {
+			return fmt.Errorf("release %s has no checksum for %v (use --no-verify to install it anyway)", release.TagName, asset.Name)
+		}
+
+		log.Warnf("Release %s has no checksum for %v, installing it without verification", release.TagName, asset.Name)
+	}
+
+	// Download the binary next to the current one, so that it can be renamed over it.
+	f, err := ioutil.TempFile(filepath.Dir(path), ".quayctl-update")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	log.Printf("Downloading %v", asset.DownloadURL)
+	resp, err := client.Get(asset.DownloadURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got %v for %v", resp.StatusCode, asset.DownloadURL)
+	}
+
+	hash := sha1.New()
+	if _, err := io.Copy(io.MultiWriter(f, hash), resp.Body); err != nil {
+		return err
+	}
+
+	if checksumAsset != nil {
+		expected, err := downloadChecksum(client, checksumAsset.DownloadURL)
+		if err != nil {
+			return fmt.Errorf("could not download checksum: %v", err)
+		}
+
+		if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+			return fmt.Errorf("checksum mismatch for %v: got %v, expected %v", asset.Name, actual, expected)
+		}
+	}
+
+	if err := f.Chmod(0755); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// downloadChecksum downloads the hex-encoded checksum found at the given URL.
+func downloadChecksum(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("got %v for %v", resp.StatusCode, url)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", errors.New("empty checksum")
+	}
+
+	return strings.ToLower(fields[0]), nil
+}
+
+// executablePath returns the absolute path of the running quayctl binary.
+func executablePath() (string, error) {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return "", err
+	}
+
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.EvalSymlinks(path)
+}
@@ -15,10 +15,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"runtime"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/spf13/cobra"
+
+	"github.com/coreos/quayctl/bittorrent"
 )
 
 // buildtime and githash are being defined at linking.
@@ -31,7 +36,44 @@ var versionCommand = &cobra.Command{
 	Run:   showVersion,
 }
 
+var versionJSON bool
+
+func init() {
+	versionCommand.Flags().BoolVar(&versionJSON, "json", false, "If specified, the version is printed as JSON")
+}
+
+// versionInfo describes the build of quayctl and the environment it runs in.
+type versionInfo struct {
+	GitHash           string `json:"gitHash"`
+	BuildTime         string `json:"buildTime"`
+	LibtorrentVersion string `json:"libtorrentVersion"`
+	GoVersion         string `json:"goVersion"`
+	OS                string `json:"os"`
+	Arch              string `json:"arch"`
+}
+
 func showVersion(_ *cobra.Command, _ []string) {
-	fmt.Printf("Build %s (%s)\n", githash, buildtime)
+	info := versionInfo{
+		GitHash:           githash,
+		BuildTime:         buildtime,
+		LibtorrentVersion: bittorrent.LibtorrentVersion,
+		GoVersion:         runtime.Version(),
+		OS:                runtime.GOOS,
+		Arch:              runtime.GOARCH,
+	}
+
+	if versionJSON {
+		data, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println(string(data))
+		os.Exit(0)
+	}
+
+	fmt.Printf("Build %s (%s)\n", info.GitHash, info.BuildTime)
+	fmt.Printf("libtorrent-rasterbar %s\n", info.LibtorrentVersion)
+	fmt.Printf("%s %s/%s\n", info.GoVersion, info.OS, info.Arch)
 	os.Exit(0)
 }
@@ -17,7 +17,9 @@ package dockerclient
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -27,10 +29,37 @@ import (
 
 const DOCKER_UNIX_SOCKET = "unix:///var/run/docker.sock"
 
-// HasImage returns true if the current Docker daemon reports that the image with the given
+// DaemonConfig specifies the Docker daemon to connect to.
+type DaemonConfig struct {
+	// Host is the address of the Docker daemon. If empty, the DOCKER_HOST environment variable is
+	// used, or the local unix socket if it is not set.
+	Host string
+
+	// CertPath is the directory containing the TLS certificates used to connect to the Docker
+	// daemon. If empty, the DOCKER_CERT_PATH environment variable is used.
+	CertPath string
+}
+
+// host returns the address of the Docker daemon, or an empty string for the local unix socket.
+func (c DaemonConfig) host() string {
+	if c.Host != "" {
+		return c.Host
+	}
+	return os.Getenv("DOCKER_HOST")
+}
+
+// certPath returns the directory containing the TLS certificates, if any.
+func (c DaemonConfig) certPath() string {
+	if c.CertPath != "" {
+		return c.CertPath
+	}
+	return os.Getenv("DOCKER_CERT_PATH")
+}
+
+// HasImage returns true if the configured Docker daemon reports that the image with the given
 // ID exists.
-func HasImage(imageId string) (bool, error) {
-	client, err := newDockerClient()
+func HasImage(config DaemonConfig, imageId string) (bool, error) {
+	client, err := newDockerClient(config)
 	if err != nil {
 		return false, err
 	}
@@ -43,14 +72,82 @@ func HasImage(imageId string) (bool, error) {
 	return found.ID == imageId, nil
 }
 
-// isLocalDockerDaemon returns true if the Docker daemon is running locally.
-func isLocalDockerDaemon() bool {
-	dockerHost := os.Getenv("DOCKER_HOST")
+// Ping returns an error if the configured Docker daemon cannot be reached.
+func Ping(config DaemonConfig) error {
+	dockerHost := config.host()
+	if dockerHost == "" {
+		dockerHost = DOCKER_UNIX_SOCKET
+	}
+
+	client, err := newDockerClient(config)
+	if err != nil {
+		return fmt.Errorf("Cannot connect to the Docker daemon at %s: %v", dockerHost, err)
+	}
+
+	if err := client.Ping(); err != nil {
+		return fmt.Errorf("Cannot connect to the Docker daemon at %s: %v", dockerHost, err)
+	}
+
+	return nil
+}
+
+// DaemonPlatform returns the operating system and the architecture of the configured Docker
+// daemon, e.g. linux and amd64.
+func DaemonPlatform(config DaemonConfig) (string, string, error) {
+	client, err := newDockerClient(config)
+	if err != nil {
+		return "", "", err
+	}
+
+	version, err := client.Version()
+	if err != nil {
+		return "", "", err
+	}
+
+	return version.Get("Os"), version.Get("Arch"), nil
+}
+
+// detectLocalIp returns the IP address of the local machine that the configured Docker daemon can
+// use to reach it: the address of the interface routing to the daemon if it is remote, or
+// localhost if it is local.
+func detectLocalIp(config DaemonConfig) (string, error) {
+	if isLocalDockerDaemon(config) {
+		return "localhost", nil
+	}
+
+	daemonURL, err := url.Parse(config.host())
+	if err != nil {
+		return "", err
+	}
+
+	// Dialing over UDP sends no packet, but selects the interface routing to the daemon. Daemons
+	// that are not reached over TCP, e.g. via a socket, use the default route.
+	target := "8.8.8.8:53"
+	if daemonURL.Scheme == "tcp" && daemonURL.Host != "" {
+		target = daemonURL.Host
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, "2375")
+		}
+	}
+
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+// isLocalDockerDaemon returns true if the configured Docker daemon is running locally.
+func isLocalDockerDaemon(config DaemonConfig) bool {
+	dockerHost := config.host()
 	return dockerHost == "" || dockerHost == DOCKER_UNIX_SOCKET
 }
 
-func newDockerClient() (*docker.Client, error) {
-	var dockerHost = os.Getenv("DOCKER_HOST")
+func newDockerClient(config DaemonConfig) (*docker.Client, error) {
+	var dockerHost = config.host()
+	var certPath = config.certPath()
 	if dockerHost == "" {
 		dockerHost = DOCKER_UNIX_SOCKET
 	} else {
@@ -60,7 +157,7 @@ func newDockerClient() (*docker.Client, error) {
 		}
 
 		// Change to an https connection if we have a cert path.
-		if os.Getenv("DOCKER_CERT_PATH") != "" {
+		if certPath != "" {
 			host.Scheme = "https"
 		}
 
@@ -73,8 +170,8 @@ func newDockerClient() (*docker.Client, error) {
 	}
 
 	// Set the client to use https.
-	if os.Getenv("DOCKER_CERT_PATH") != "" {
-		transport, err := buildTLSTransport(os.Getenv("DOCKER_CERT_PATH"))
+	if certPath != "" {
+		transport, err := buildTLSTransport(certPath)
 		if err != nil {
 			return nil, err
 		}
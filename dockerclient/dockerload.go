@@ -17,27 +17,23 @@
 package dockerclient
 
 import (
-	"bytes"
+	"archive/tar"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
+	"net"
+	"os"
+	"strconv"
 	"time"
 
-	logrus "github.com/Sirupsen/logrus"
+	log "github.com/Sirupsen/logrus"
 
-	"github.com/docker/distribution/configuration"
-	"github.com/docker/distribution/context"
 	"github.com/docker/distribution/manifest/schema1"
-	"github.com/docker/distribution/version"
 	"github.com/docker/docker/reference"
 	"github.com/fsouza/go-dockerclient"
 
-	"github.com/docker/distribution/registry/handlers"
-	"github.com/docker/distribution/registry/listener"
-	"github.com/docker/distribution/registry/storage/driver/factory"
+	"github.com/coreos/quayctl/dockerdist"
 )
 
 // V1LayerInfo holds information derived from a V1 history JSON blob.
@@ -56,9 +52,10 @@ func GetLayerInfo(layerHistory schema1.History) V1LayerInfo {
 	return layerInfo
 }
 
-// DockerLoadTar performs a `docker load` of a TAR containing the V1 docker load format.
-func DockerLoadTar(reader io.Reader) error {
-	client, err := newDockerClient()
+// DockerLoadTar performs a `docker load` of a TAR containing the V1 docker load format into the
+// configured Docker daemon.
+func DockerLoadTar(config DaemonConfig, reader io.Reader) error {
+	client, err := newDockerClient(config)
 	if err != nil {
 		return fmt.Errorf("Could not connect to Docker: %v", err)
 	}
@@ -72,44 +69,117 @@ func DockerLoadTar(reader io.Reader) error {
 	return nil
 }
 
-// DockerLoad performs a `docker load` of the given image with its manifest and layerPaths.
-func DockerLoad(image reference.Named, manifest *schema1.SignedManifest, layerPaths map[string]string, localIp string) error {
-	if !isLocalDockerDaemon() && localIp == "localhost" {
-		return errors.New("The `--local-ip` flag is required for non-local Docker daemon")
+// DockerSave writes the given image of the configured Docker daemon to w, in the format of
+// `docker save`.
+func DockerSave(config DaemonConfig, image string, w io.Writer) error {
+	client, err := newDockerClient(config)
+	if err != nil {
+		return fmt.Errorf("Could not connect to Docker: %v", err)
 	}
 
-	go func() {
-		err := runRegistry(image, manifest, layerPaths)
+	if err := client.ExportImage(docker.ExportImageOptions{Name: image, OutputStream: w}); err != nil {
+		return fmt.Errorf("Could not perform docker-save: %v", err)
+	}
+
+	return nil
+}
+
+const (
+	// pullAttempts is the number of times Docker is asked to pull an image from the temporary
+	// registry before giving up.
+	pullAttempts = 3
+
+	// pullRetryDelay is the delay before the second attempt to pull an image from the temporary
+	// registry, which grows linearly with the following attempts.
+	pullRetryDelay = time.Second
+)
+
+// LoadOptions holds the options of DockerLoad.
+type LoadOptions struct {
+	// RegistryAddr is the address on which the temporary registry serving the image listens. If its
+	// port is 0, a free port is chosen.
+	RegistryAddr string
+
+	// LocalIP is the address through which Docker reaches the temporary registry. If "auto", the
+	// address of the local machine on the route to Docker is used.
+	LocalIP string
+
+	// SpillThreshold, if not 0, is the size (in bytes) above which the data served by the
+	// temporary registry, such as the manifests, is written to temp files rather than kept in
+	// memory, so that the memory stays bounded when loading very large or numerous images.
+	SpillThreshold int64
+
+	// ProgressSink, if not nil, receives the progress of the load, which is otherwise displayed as
+	// progress bars.
+	ProgressSink ProgressSink
+}
+
+// DockerLoad performs a `docker load` of the given image with its manifest and layerPaths into the
+// configured Docker daemon.
+//
+// The layers are served to Docker by a temporary registry, as specified by the options.
+//
+// Docker pulls the image under a temporary name, which is then replaced by the name of the image.
+// The image previously known by that name (if any) is removed, unless Docker still needs it.
+func DockerLoad(config DaemonConfig, image reference.Named, manifest *schema1.SignedManifest, layerPaths map[string]string, opts LoadOptions) error {
+	localIp, registryAddr := opts.LocalIP, opts.RegistryAddr
+
+	registryHost, _, err := net.SplitHostPort(registryAddr)
+	if err != nil {
+		return fmt.Errorf("Invalid registry address %v: %v", registryAddr, err)
+	}
+
+	if localIp == "auto" {
+		localIp, err = detectLocalIp(config)
 		if err != nil {
-			log.Fatalf("Error running local registry: %v", err)
+			return fmt.Errorf("Could not detect the local IP address: %v", err)
 		}
-	}()
+
+		log.Printf("Using local IP address %v", localIp)
+	}
+
+	if !isLocalDockerDaemon(config) {
+		if localIp == "localhost" {
+			return errors.New("The `--local-ip` flag is required for non-local Docker daemon")
+		}
+
+		if registryHost == "localhost" || registryHost == "127.0.0.1" {
+			log.Warnln("The temporary registry only listens on localhost; use the `--registry-addr` flag to make it reachable by the Docker daemon")
+		}
+	}
+
+	// Serve the image from the registry, which is started by the first load.
+	registry, err := getRegistryServer(registryAddr)
+	if err != nil {
+		return fmt.Errorf("Error running local registry: %v", err)
+	}
+
+	// The data of the image is only served for the duration of the load, so that the registry does
+	// not accumulate the data (and open temp files) of every image loaded through it.
+	paths := registry.addImage(image, manifest, layerPaths, opts.SpillThreshold)
+	defer registry.removeImage(paths)
 
 	// Connect to Docker.
 	log.Println("Connecting to docker")
-	client, err := newDockerClient()
+	client, err := newDockerClient(config)
 	if err != nil {
 		return fmt.Errorf("Could not connect to Docker: %v", err)
 	}
 
-	// Wait a bit for the registry to start.
-	time.Sleep(2 * time.Second)
-
 	// Conduct a pull of the image.
 	log.Println("Pulling image")
 
-	var tagName = "latest"
-	if tagged, ok := image.(reference.NamedTagged); ok {
-		tagName = tagged.Tag()
-	}
+	tagName := dockerdist.TagName(image)
 
-	w := newPullProgressDisplay(tagName, len(layerPaths))
+	// Docker reports progress for each layer of the manifest, including the layers sharing the same
+	// blob, and for the image configuration.
+	w := newPullProgressDisplay(tagName, len(manifest.FSLayers)+1, opts.ProgressSink)
 	defer w.Done()
 
-	localRegistry := fmt.Sprintf("%s:5000", localIp)
+	localRegistry := net.JoinHostPort(localIp, strconv.Itoa(registry.port))
 	localRepository := fmt.Sprintf("%s/%s", localRegistry, image.RemoteName())
 
-	opts := docker.PullImageOptions{
+	pullOpts := docker.PullImageOptions{
 		Repository:    localRepository,
 		Registry:      localRegistry,
 		Tag:           tagName,
@@ -117,73 +187,218 @@ func DockerLoad(image reference.Named, manifest *schema1.SignedManifest, layerPa
 		RawJSONStream: true,
 	}
 
+	// Retry the pull on failure, since it may be transient, e.g. while a blob is being read. The
+	// errors met by the registry during previous loads are discarded beforehand.
 	auth := docker.AuthConfiguration{}
-	perr := client.PullImage(opts, auth)
+	registry.lastError()
+
+	var perr error
+	for attempt := 1; attempt <= pullAttempts; attempt++ {
+		if perr = client.PullImage(pullOpts, auth); perr == nil {
+			break
+		}
+
+		if attempt < pullAttempts {
+			log.Warnf("Could not pull image into Docker (attempt %d of %d), retrying: %v", attempt, pullAttempts, perr)
+			time.Sleep(time.Duration(attempt) * pullRetryDelay)
+		}
+	}
+
 	if perr != nil {
+		// The error of the Docker client is generic, so report the one of the registry (if any).
+		if rerr := registry.lastError(); rerr != nil {
+			return fmt.Errorf("Error pulling image into Docker: %v (local registry: %v)", perr, rerr)
+		}
+
 		return fmt.Errorf("Error pulling image into Docker: %v", perr)
 	}
 
-	// Tag the image to the name expected.
+	// The image is now known to Docker under its temporary name, which must not outlive the load,
+	// even if it fails.
+	localName := fmt.Sprintf("%s:%s", localRepository, tagName)
+	defer func() {
+		if err := client.RemoveImage(localName); err != nil && err != docker.ErrNoSuchImage {
+			log.Warnf("Could not remove temporary tag %v from Docker: %v", localName, err)
+		}
+	}()
+
+	loaded, err := client.InspectImage(localName)
+	if err != nil {
+		return fmt.Errorf("Could not inspect pulled image in Docker: %v", err)
+	}
+
+	// Tag the image to the name expected, by its ID, noting the image the name referred to before
+	// (if any).
+	finalName := fmt.Sprintf("%s:%s", image.FullName(), tagName)
+	var previousID string
+	if previous, err := client.InspectImage(finalName); err == nil {
+		previousID = previous.ID
+	}
+
 	tagOpts := docker.TagImageOptions{
 		Repo:  image.FullName(),
 		Tag:   tagName,
 		Force: true,
 	}
 
-	localName := fmt.Sprintf("%s:%s", localRepository, tagName)
-	terr := client.TagImage(localName, tagOpts)
-	if terr != nil {
-		return fmt.Errorf("Error re-tagging image in Docker: %v", terr)
+	if err := client.TagImage(loaded.ID, tagOpts); err != nil {
+		return fmt.Errorf("Error re-tagging image in Docker: %v", err)
+	}
+
+	// Ensure the name now refers to the loaded image.
+	tagged, err := client.InspectImage(finalName)
+	if err != nil {
+		return fmt.Errorf("Could not find image %v in Docker after re-tagging it: %v", finalName, err)
 	}
 
-	// Untag the image with its temporary name.
-	rerr := client.RemoveImage(localName)
-	if rerr != nil {
-		return fmt.Errorf("Error removing older tag in Docker: %v", rerr)
+	if tagged.ID != loaded.ID {
+		return fmt.Errorf("Image %v refers to %v in Docker after re-tagging it, instead of %v", finalName, tagged.ID, loaded.ID)
+	}
 
+	// Remove the image the name referred to before, unless it is still tagged otherwise or used by
+	// a container, in which case Docker refuses to remove it, so that it is not left dangling.
+	if previousID != "" && previousID != loaded.ID {
+		if err := client.RemoveImage(previousID); err != nil {
+			log.Printf("Image %v no longer refers to %v, which is kept: %v", finalName, previousID, err)
+		} else {
+			log.Printf("Removed image %v, previously referred to by %v", previousID, finalName)
+		}
 	}
 
 	return nil
 }
 
-func runRegistry(image reference.Named, manifest *schema1.SignedManifest, layerPaths map[string]string) error {
-	factory.Register("localserve", &localServeDriverFactory{
-		image:      image,
-		manifest:   manifest,
-		layerPaths: layerPaths,
-	})
+// TagImage tags the given image of the configured Docker daemon with each of the given names,
+// overwriting the tags that already exist.
+func TagImage(config DaemonConfig, image string, names []reference.NamedTagged) error {
+	client, err := newDockerClient(config)
+	if err != nil {
+		return fmt.Errorf("Could not connect to Docker: %v", err)
+	}
+
+	for _, name := range names {
+		tagOpts := docker.TagImageOptions{
+			Repo:  name.Name(),
+			Tag:   name.Tag(),
+			Force: true,
+		}
+
+		if err := client.TagImage(image, tagOpts); err != nil {
+			return fmt.Errorf("Error tagging image in Docker as %v: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// DockerLoadLayers performs a `docker load` of the given image with its manifest and layerPaths
+// into the configured Docker daemon, by streaming a TAR containing the V1 docker load format.
+//
+// Unlike DockerLoad, no temporary registry is needed, so the Docker daemon does not have to be
+// able to reach the local machine.
+func DockerLoadLayers(config DaemonConfig, image reference.Named, manifest *schema1.SignedManifest, layerPaths map[string]string) error {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeLoadTar(writer, image, manifest, layerPaths))
+	}()
+
+	err := DockerLoadTar(config, reader)
+	reader.Close()
+	return err
+}
+
+// writeLoadTar writes a TAR containing the V1 docker load format of the given image to the given
+// writer. Only the topmost layers whose blob is found in layerPaths are included; the others must
+// already be present in Docker.
+func writeLoadTar(w io.Writer, image reference.Named, manifest *schema1.SignedManifest, layerPaths map[string]string) error {
+	tw := tar.NewWriter(w)
+
+	var topLayerID string
+	for index, history := range manifest.History {
+		layerPath, found := layerPaths[manifest.FSLayers[index].BlobSum.String()]
+		if !found {
+			break
+		}
+
+		layerInfo := GetLayerInfo(history)
+		if index == 0 {
+			topLayerID = layerInfo.ID
+		}
+
+		if err := writeTarFile(tw, layerInfo.ID+"/VERSION", []byte("1.0")); err != nil {
+			return err
+		}
+
+		if err := writeTarFile(tw, layerInfo.ID+"/json", []byte(history.V1Compatibility)); err != nil {
+			return err
+		}
+
+		// The layer blobs are compressed, which Docker handles transparently when loading.
+		if err := writeTarLayer(tw, layerInfo.ID+"/layer.tar", layerPath); err != nil {
+			return err
+		}
+	}
+
+	if topLayerID == "" {
+		return errors.New("No layer to load")
+	}
+
+	tagName := dockerdist.TagName(image)
 
-	buf := bytes.NewBufferString(`
-version: 0.1
-log:
-  level: error
-  formatter: text
-http:
-  addr: localhost:5000
-storage:
-  localserve:
-compatibility:
-  schema1:
-    disablesignaturestore: true
-`)
-
-	logrus.SetLevel(logrus.PanicLevel)
-
-	ctx := context.WithVersion(context.Background(), version.Version)
-	config, err := configuration.Parse(buf)
+	repositories, err := json.Marshal(map[string]map[string]string{
+		image.FullName(): {tagName: topLayerID},
+	})
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	if err := writeTarFile(tw, "repositories", repositories); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// writeTarFile writes a file with the given name and contents to the TAR.
+func writeTarFile(tw *tar.Writer, name string, contents []byte) error {
+	header := &tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: int64(len(contents)),
 	}
 
-	handler := handlers.NewApp(ctx, config)
-	server := &http.Server{
-		Handler: handler,
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err := tw.Write(contents)
+	return err
+}
+
+// writeTarLayer writes a file with the given name to the TAR, copying the contents of the layer
+// blob found at the given path.
+func writeTarLayer(tw *tar.Writer, name string, layerPath string) error {
+	layerFile, err := os.Open(layerPath)
+	if err != nil {
+		return err
 	}
+	defer layerFile.Close()
 
-	ln, err := listener.NewListener(config.HTTP.Net, config.HTTP.Addr)
+	stat, err := layerFile.Stat()
 	if err != nil {
 		return err
 	}
 
-	return server.Serve(ln)
+	header := &tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: stat.Size(),
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, layerFile)
+	return err
 }
@@ -0,0 +1,106 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerclient
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// The phases of a pull whose progress is reported by ProgressEvents.
+const (
+	// DownloadPhase is the download (and seeding) of the torrents of the image.
+	DownloadPhase = "download"
+
+	// LoadPhase is the load of the downloaded image into Docker.
+	LoadPhase = "load"
+)
+
+// ProgressEvent describes the progress of one of the items of a pull: a torrent while it is
+// downloaded, or one of the IDs (layers or image configuration) of an image that Docker loads.
+type ProgressEvent struct {
+	// Phase is the phase of the pull the event belongs to, DownloadPhase or LoadPhase.
+	Phase string `json:"phase"`
+
+	// ID is the ID the event refers to, e.g. the digest of a torrent or the (shortened) ID reported
+	// by Docker, and Title its name, if any.
+	ID    string `json:"id"`
+	Title string `json:"title,omitempty"`
+
+	// Status is the status of the item, e.g. "Downloading", "Seeding" or "Pull complete".
+	Status string `json:"status"`
+
+	// Current and Total are the number of bytes processed and to process for the current status,
+	// if known.
+	Current int64 `json:"current,omitempty"`
+	Total   int64 `json:"total,omitempty"`
+
+	// DownloadRate and UploadRate, in bytes/s, and NumPeers and NumSeeds are only reported for
+	// the torrents.
+	DownloadRate int64 `json:"downloadRate,omitempty"`
+	UploadRate   int64 `json:"uploadRate,omitempty"`
+	NumPeers     int   `json:"numPeers,omitempty"`
+	NumSeeds     int   `json:"numSeeds,omitempty"`
+
+	// Done is true once the item is complete.
+	Done bool `json:"done,omitempty"`
+}
+
+// Percent returns the progress of the event, in percent. Events of the load phase without
+// progress details are complete, while torrents are not until their size is known.
+func (e ProgressEvent) Percent() int {
+	if e.Total <= 0 {
+		if e.Phase == DownloadPhase && !e.Done {
+			return 0
+		}
+		return 100
+	}
+
+	return int((float64(e.Current) / float64(e.Total)) * 100)
+}
+
+// ProgressSink receives the ProgressEvents reported while loading an image, e.g. to render them.
+type ProgressSink interface {
+	// Event is called for each event, in order.
+	Event(event ProgressEvent)
+
+	// Close is called once the image is loaded, or could not be.
+	Close()
+}
+
+// jsonProgressSink is a ProgressSink writing each event as a line of JSON.
+type jsonProgressSink struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewJSONProgressSink returns a ProgressSink writing each event to w as a line of JSON, e.g. for
+// tools running quayctl. The sink can be shared by the phases of a pull, as closing it does not
+// close w.
+func NewJSONProgressSink(w io.Writer) ProgressSink {
+	return &jsonProgressSink{encoder: json.NewEncoder(w)}
+}
+
+// Event implements ProgressSink.
+func (s *jsonProgressSink) Event(event ProgressEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.encoder.Encode(event)
+}
+
+// Close implements ProgressSink.
+func (s *jsonProgressSink) Close() {}
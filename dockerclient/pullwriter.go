@@ -19,12 +19,17 @@ import (
 	"encoding/json"
 	"io"
 	"io/ioutil"
-	"log"
 	"runtime"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/cheggaaa/pb"
 )
 
+// progressLogInterval is the minimum interval between two textual progress lines for the same
+// layer, when progress bars are not displayed.
+const progressLogInterval = 5 * time.Second
+
 // partialBuffer defines a buffer for holding partial JSON responses.
 type partialBuffer []byte
 
@@ -55,81 +60,172 @@ type progressDetail struct {
 	Total   int `json:"total,omitempty"`
 }
 
-// pullProgressDisplay is a writer which consumes the JSON form of Docker pull logs and displays
-// a nice set of progress bars.
+// finalStatuses holds the statuses reported by Docker once it is done with a layer.
+var finalStatuses = map[string]struct{}{
+	"Pull complete":  struct{}{},
+	"Already exists": struct{}{},
+}
+
+// pullProgressDisplay is a writer which consumes the JSON form of Docker pull logs and reports
+// them as ProgressEvents to a ProgressSink, which by default displays a nice set of progress bars.
 type pullProgressDisplay struct {
-	partialBuffer    *partialBuffer
-	hasPartialBuffer bool
-	pbMap            map[string]*pb.ProgressBar
-	pbCounter        int
-	bars             []*pb.ProgressBar
-	pool             *pb.Pool
-	hasProgressBars  bool
-	tagName          string
+	partialBuffer *partialBuffer
+	sink          ProgressSink
+	tagName       string
+}
+
+// newPullProgressDisplay creates a new pull progress display, reporting to the given sink, or else
+// to a barProgressSink for the given number of IDs expected to be reported by Docker.
+func newPullProgressDisplay(tagName string, layerCount int, sink ProgressSink) *pullProgressDisplay {
+	if sink == nil {
+		sink = newBarProgressSink(layerCount)
+	}
+
+	return &pullProgressDisplay{
+		tagName:       tagName,
+		partialBuffer: &partialBuffer{},
+		sink:          sink,
+	}
+}
+
+func (w *pullProgressDisplay) Done() {
+	w.sink.Close()
 }
 
-// newPullProgressDisplay creates a new pull progress display.
-func newPullProgressDisplay(tagName string, layerCount int) *pullProgressDisplay {
+func (w *pullProgressDisplay) updateStatus(m dockerResponse) {
+	if m.ID == "" || m.ID == w.tagName {
+		return
+	}
+
+	_, done := finalStatuses[m.Status]
+	w.sink.Event(ProgressEvent{
+		Phase:   LoadPhase,
+		ID:      m.ID,
+		Status:  m.Status,
+		Current: int64(m.ProgressDetail.Current),
+		Total:   int64(m.ProgressDetail.Total),
+		Done:    done,
+	})
+}
+
+// barProgressSink is a ProgressSink displaying a progress bar for each ID, or logging the events
+// if progress bars cannot be displayed.
+//
+// Each ID reported by Docker is assigned a bar. Once every bar is assigned, the bars of the IDs
+// that Docker is done with are reused for the new IDs, or else the bars are reused in turn.
+type barProgressSink struct {
+	pbMap           map[string]*pb.ProgressBar
+	pbCounter       int
+	bars            []*pb.ProgressBar
+	barIDs          []string
+	doneIDs         map[string]struct{}
+	pool            *pb.Pool
+	hasProgressBars bool
+	lastProgressLog map[string]time.Time
+}
+
+// newBarProgressSink creates a new bar progress sink, with a bar for each of the given number of
+// IDs expected to be reported by Docker.
+func newBarProgressSink(layerCount int) *barProgressSink {
 	var bars = make([]*pb.ProgressBar, 0, layerCount)
 	for i := 0; i < layerCount; i++ {
 		progressBar := pb.New(100).Postfix(" Initializing")
-		progressBar.SetMaxWidth(80)
+
+		// The bar follows the width of the terminal, falling back to 80 columns when it is unknown.
+		if _, err := pb.GetTerminalWidth(); err != nil {
+			progressBar.SetWidth(80)
+		}
+
 		progressBar.ShowCounters = false
 		progressBar.AlwaysUpdate = true
 		bars = append(bars, progressBar)
 	}
 
-	// Create a pool of progress bars.
-	pool, err := pb.StartPool(bars...)
+	// Create a pool of progress bars, unless informational messages are disabled.
+	var pool *pb.Pool
+	var hasProgressBars = false
+	if log.GetLevel() >= log.InfoLevel {
+		var err error
+		pool, err = pb.StartPool(bars...)
+		hasProgressBars = err == nil
+	}
 
-	return &pullProgressDisplay{
-		tagName:          tagName,
-		partialBuffer:    &partialBuffer{},
-		hasPartialBuffer: false,
-		bars:             bars,
-		pbMap:            map[string]*pb.ProgressBar{},
-		pbCounter:        0,
-		pool:             pool,
-		hasProgressBars:  err == nil,
+	return &barProgressSink{
+		bars:            bars,
+		barIDs:          make([]string, len(bars)),
+		doneIDs:         map[string]struct{}{},
+		pbMap:           map[string]*pb.ProgressBar{},
+		pbCounter:       0,
+		pool:            pool,
+		hasProgressBars: hasProgressBars,
+		lastProgressLog: map[string]time.Time{},
 	}
 }
 
-func (w *pullProgressDisplay) Done() {
-	if w.hasProgressBars {
-		w.pool.Stop()
+// Close implements ProgressSink.
+func (s *barProgressSink) Close() {
+	if s.hasProgressBars {
+		s.pool.Stop()
 	}
 }
 
-func (w *pullProgressDisplay) updateStatus(m dockerResponse) {
-	if m.ID == "" || m.ID == w.tagName {
-		return
-	}
+// Event implements ProgressSink.
+func (s *barProgressSink) Event(event ProgressEvent) {
+	if !s.hasProgressBars {
+		if event.Total == 0 {
+			log.Printf("%v: %v\n", event.ID, event.Status)
+			return
+		}
 
-	if !w.hasProgressBars {
-		if m.ProgressDetail.Total == 0 {
-			log.Printf("%v: %v\n", m.ID, m.Status)
+		// Throttle the progress lines, as Docker reports progress many times per second.
+		if time.Since(s.lastProgressLog[event.ID]) < progressLogInterval {
+			return
 		}
+
+		s.lastProgressLog[event.ID] = time.Now()
+		log.Printf("%v: %v %d%%\n", event.ID, event.Status, event.Percent())
 		return
 	}
 
-	if _, found := w.pbMap[m.ID]; !found {
-		if w.pbCounter >= len(w.bars) {
+	if _, found := s.pbMap[event.ID]; !found {
+		if len(s.bars) == 0 {
 			return
 		}
 
-		w.pbMap[m.ID] = w.bars[w.pbCounter]
-		w.pbMap[m.ID].Prefix(m.ID + " ")
-		w.pbCounter++
+		index := s.nextBar()
+		if previousID := s.barIDs[index]; previousID != "" {
+			delete(s.pbMap, previousID)
+		}
+
+		s.barIDs[index] = event.ID
+		s.pbMap[event.ID] = s.bars[index]
+		s.pbMap[event.ID].Prefix(event.ID + " ")
+		s.pbCounter++
+	}
+
+	if event.Done {
+		s.doneIDs[event.ID] = struct{}{}
 	}
 
-	if m.ProgressDetail.Total > 0 {
-		current := int((float64(m.ProgressDetail.Current) / float64(m.ProgressDetail.Total)) * 100)
-		w.pbMap[m.ID].Set(current)
-	} else {
-		w.pbMap[m.ID].Set(100)
+	s.pbMap[event.ID].Set(event.Percent())
+	s.pbMap[event.ID].Postfix(" " + event.Status)
+}
+
+// nextBar returns the index of the bar to assign to a new ID: the next unassigned bar, or else a
+// bar of an ID that Docker is done with, or else the next bar in turn.
+func (s *barProgressSink) nextBar() int {
+	if s.pbCounter < len(s.bars) {
+		return s.pbCounter
+	}
+
+	for i := range s.bars {
+		index := (s.pbCounter + i) % len(s.bars)
+		if _, done := s.doneIDs[s.barIDs[index]]; done {
+			return index
+		}
 	}
 
-	w.pbMap[m.ID].Postfix(" " + m.Status)
+	return s.pbCounter % len(s.bars)
 }
 
 func (w *pullProgressDisplay) Write(p []byte) (n int, err error) {
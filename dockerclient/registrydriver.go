@@ -19,40 +19,131 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"sync"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/docker/reference"
 
 	storagedriver "github.com/docker/distribution/registry/storage/driver"
+
+	"github.com/coreos/quayctl/dockerdist"
 )
 
 // localServeDriver implements the Docker Registry storage engine to serve the specified
 // layer data.
 type localServeDriver struct {
-	contentPaths         map[string][]byte // Map of request path to direct data.
-	externalContentPaths map[string]string // Map of request path to on-system files.
+	contentPaths         map[string][]byte   // Map of request path to direct data.
+	spilledContentPaths  map[string]*os.File // Map of request path to data spilled to temp files.
+	externalContentPaths map[string]string   // Map of request path to on-system files.
+	pathRefs             map[string]int      // Map of request path to number of images using it.
+	pathsLock            sync.RWMutex        // Guards the maps, as images are added while serving.
+	errs                 chan<- error        // Receives the errors met while reading the files.
+}
+
+// newLocalServeDriver returns a driver serving no image, which reports the errors met while reading
+// the files it serves to errs.
+func newLocalServeDriver(errs chan<- error) *localServeDriver {
+	return &localServeDriver{
+		contentPaths:         map[string][]byte{},
+		spilledContentPaths:  map[string]*os.File{},
+		externalContentPaths: map[string]string{},
+		pathRefs:             map[string]int{},
+		errs:                 errs,
+	}
+}
+
+// reportError reports the given error, met while reading a served file, without blocking, and
+// returns it.
+func (d *localServeDriver) reportError(err error) error {
+	select {
+	case d.errs <- err:
+	default:
+	}
+
+	return err
+}
+
+// addImage adds the given image, with its manifest and layerPaths, to the driver. The data larger
+// than the given threshold (if not 0) is spilled to temp files.
+//
+// It returns the request paths of the image, to be given to removeImage once it is loaded.
+func (d *localServeDriver) addImage(image reference.Named, manifest *schema1.SignedManifest, layerPaths map[string]string, spillThreshold int64) []string {
+	d.pathsLock.Lock()
+	defer d.pathsLock.Unlock()
+
+	// Determine the current tag.
+	tagName := dockerdist.TagName(image)
+
+	// Add the manifest as a linked file.
+	manifestJson, _ := manifest.MarshalJSON()
+	digest, paths := d.addLinkedData(image.RemoteName(), "_manifests/revisions", manifestJson, spillThreshold)
+
+	// Add a link from the tag to the manifest.
+	paths = append(paths, d.addLink(image.RemoteName(),
+		fmt.Sprintf("_manifests/tags/%s/current/link", tagName),
+		digest))
+
+	// Add each blob layer.
+	for blobDigest, blobLocation := range layerPaths {
+		paths = append(paths, d.addLinkedFile(image.RemoteName(), "_layers", blobDigest, blobLocation)...)
+	}
+
+	for _, path := range paths {
+		d.pathRefs[path]++
+	}
+
+	return paths
 }
 
-// addLink adds a link from a prefix to a blob.
-func (d *localServeDriver) addLink(repository string, location string, digest string) {
+// removeImage removes the data served at the given request paths of an image, as returned by
+// addImage, except the data still used by other images. The spilled files are closed, so that their
+// space is freed.
+func (d *localServeDriver) removeImage(paths []string) {
+	d.pathsLock.Lock()
+	defer d.pathsLock.Unlock()
+
+	for _, path := range paths {
+		d.pathRefs[path]--
+		if d.pathRefs[path] > 0 {
+			continue
+		}
+
+		if file, found := d.spilledContentPaths[path]; found {
+			file.Close()
+			delete(d.spilledContentPaths, path)
+		}
+
+		delete(d.contentPaths, path)
+		delete(d.externalContentPaths, path)
+		delete(d.pathRefs, path)
+	}
+}
+
+// addLink adds a link from a prefix to a blob, and returns its request path.
+func (d *localServeDriver) addLink(repository string, location string, digest string) string {
 	linkPath := fmt.Sprintf(
 		"/docker/registry/v2/repositories/%s/%s",
 		repository,
 		location)
 
 	d.contentPaths[linkPath] = []byte(digest)
+	return linkPath
 }
 
-func (d *localServeDriver) addDigestLink(repository, prefix string, digest string) {
+func (d *localServeDriver) addDigestLink(repository, prefix string, digest string) string {
 	hexSha := digest[len("sha256:"):]
-	d.addLink(repository, fmt.Sprintf("%s/sha256/%s/link", prefix, hexSha), digest)
+	return d.addLink(repository, fmt.Sprintf("%s/sha256/%s/link", prefix, hexSha), digest)
 }
 
-// addLinkedFile adds a linked external file to the driver.
-func (d *localServeDriver) addLinkedFile(repository string, prefix string, digest string, filePath string) {
+// addLinkedFile adds a linked external file to the driver, and returns its request paths.
+func (d *localServeDriver) addLinkedFile(repository string, prefix string, digest string, filePath string) []string {
 	// Define a link from the prefix-ed SHA to the SHA itself.
-	d.addDigestLink(repository, prefix, digest)
+	linkPath := d.addDigestLink(repository, prefix, digest)
 
 	// Define the data path.
 	hexSha := digest[len("sha256:"):]
@@ -62,16 +153,18 @@ func (d *localServeDriver) addLinkedFile(repository string, prefix string, diges
 		hexSha)
 
 	d.externalContentPaths[dataPath] = filePath
+	return []string{linkPath, dataPath}
 }
 
-// addLinkedData adds a piece of linked data to the driver.
-func (d *localServeDriver) addLinkedData(repository string, prefix string, data []byte) string {
+// addLinkedData adds a piece of linked data to the driver, spilled to a temp file if larger than
+// the given threshold (if not 0). It returns the digest of the data and its request paths.
+func (d *localServeDriver) addLinkedData(repository string, prefix string, data []byte, spillThreshold int64) (string, []string) {
 	shaBytes := sha256.Sum256(data)
 	hexSha := hex.EncodeToString(shaBytes[:])
 	digest := fmt.Sprintf("sha256:%s", hexSha)
 
 	// Define a link from the prefix-ed SHA to the SHA itself.
-	d.addDigestLink(repository, prefix, digest)
+	linkPath := d.addDigestLink(repository, prefix, digest)
 
 	// Define the actual data.
 	dataPath := fmt.Sprintf(
@@ -79,8 +172,58 @@ func (d *localServeDriver) addLinkedData(repository string, prefix string, data
 		hexSha[0:2],
 		hexSha)
 
+	paths := []string{linkPath, dataPath}
+
+	// The data may already be served for another image, under the same digest.
+	if _, found := d.spilledContentPaths[dataPath]; found {
+		return digest, paths
+	}
+
+	if spillThreshold > 0 && int64(len(data)) > spillThreshold {
+		file, err := spillData(data)
+		if err == nil {
+			d.spilledContentPaths[dataPath] = file
+			return digest, paths
+		}
+
+		log.Warnf("Could not write data of %v to a temp file, keeping it in memory: %v", digest, err)
+	}
+
 	d.contentPaths[dataPath] = data
-	return digest
+	return digest, paths
+}
+
+// spillData writes the given data to a temp file, and returns the file open for reading. The file
+// is removed right away, so that it does not outlive the process: its content remains available
+// until it is closed by removeImage.
+func spillData(data []byte) (*os.File, error) {
+	file, err := ioutil.TempFile("", "quayctl-registry")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// spilledContent returns a reader of the content of the given spilled file, served at the given
+// path, from the given offset.
+func spilledContent(file *os.File, path string, offset int64) (io.Reader, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > stat.Size() {
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset}
+	}
+
+	return io.NewSectionReader(file, offset, stat.Size()-offset), nil
 }
 
 func (d *localServeDriver) Name() string {
@@ -88,10 +231,22 @@ func (d *localServeDriver) Name() string {
 }
 
 func (d *localServeDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	d.pathsLock.RLock()
+	defer d.pathsLock.RUnlock()
+
 	if contentBytes, found := d.contentPaths[path]; found {
 		return contentBytes, nil
 	}
 
+	if file, found := d.spilledContentPaths[path]; found {
+		content, err := spilledContent(file, path, 0)
+		if err != nil {
+			return nil, d.reportError(err)
+		}
+
+		return ioutil.ReadAll(content)
+	}
+
 	return nil, fmt.Errorf("Unknown file")
 }
 
@@ -100,13 +255,30 @@ func (d *localServeDriver) PutContent(ctx context.Context, subPath string, conte
 }
 
 func (d *localServeDriver) ReadStream(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	d.pathsLock.RLock()
 	contentLocation, found := d.externalContentPaths[path]
+	spilledFile, foundSpilled := d.spilledContentPaths[path]
+	d.pathsLock.RUnlock()
+
+	if foundSpilled {
+		content, err := spilledContent(spilledFile, path, offset)
+		if _, invalidOffset := err.(storagedriver.InvalidOffsetError); invalidOffset {
+			return nil, err
+		}
+		if err != nil {
+			return nil, d.reportError(err)
+		}
+
+		return ioutil.NopCloser(content), nil
+	}
+
 	if !found {
 		return nil, fmt.Errorf("Unknown file")
 	}
 
 	file, err := os.OpenFile(contentLocation, os.O_RDONLY, 0644)
 	if err != nil {
+		d.reportError(err)
 		if os.IsNotExist(err) {
 			return nil, storagedriver.PathNotFoundError{Path: path}
 		}
@@ -117,7 +289,7 @@ func (d *localServeDriver) ReadStream(ctx context.Context, path string, offset i
 	seekPos, err := file.Seek(int64(offset), os.SEEK_SET)
 	if err != nil {
 		file.Close()
-		return nil, err
+		return nil, d.reportError(err)
 	} else if seekPos < int64(offset) {
 		file.Close()
 		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset}
@@ -131,20 +303,35 @@ func (d *localServeDriver) WriteStream(ctx context.Context, subPath string, offs
 }
 
 func (d *localServeDriver) Stat(ctx context.Context, subPath string) (storagedriver.FileInfo, error) {
-	if contentBytes, found := d.contentPaths[subPath]; found {
+	d.pathsLock.RLock()
+	contentBytes, foundBytes := d.contentPaths[subPath]
+	spilledFile, foundSpilled := d.spilledContentPaths[subPath]
+	contentLocation, foundLocation := d.externalContentPaths[subPath]
+	d.pathsLock.RUnlock()
+
+	if foundBytes {
 		return fileInfo{subPath, int64(len(contentBytes))}, nil
 	}
 
-	if contentLocation, found := d.externalContentPaths[subPath]; found {
+	if foundSpilled {
+		stat, err := spilledFile.Stat()
+		if err != nil {
+			return fileInfo{}, d.reportError(err)
+		}
+
+		return fileInfo{subPath, stat.Size()}, nil
+	}
+
+	if foundLocation {
 		contentFile, err := os.Open(contentLocation)
 		if err != nil {
-			return fileInfo{}, err
+			return fileInfo{}, d.reportError(err)
 		}
 
 		defer contentFile.Close()
 		stat, err := contentFile.Stat()
 		if err != nil {
-			return fileInfo{}, err
+			return fileInfo{}, d.reportError(err)
 		}
 
 		return fileInfo{subPath, stat.Size()}, nil
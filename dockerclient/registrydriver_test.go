@@ -0,0 +1,68 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerclient
+
+import (
+	"testing"
+
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/docker/reference"
+)
+
+func TestRemoveImageClosesSpilledFiles(t *testing.T) {
+	driver := newLocalServeDriver(make(chan error, 1))
+
+	manifest := &schema1.SignedManifest{}
+	manifest.Name = "coreos/etcd"
+	manifest.Tag = "latest"
+	layerPaths := map[string]string{
+		"sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4": "/tmp/layer.tar",
+	}
+
+	// Both images share the same manifest, spilled to a single temp file.
+	var images [][]string
+	for _, image := range []string{"quay.io/coreos/etcd:latest", "quay.io/coreos/etcd:v3"} {
+		named, err := reference.ParseNamed(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, driver.addImage(named, manifest, layerPaths, 1))
+	}
+
+	if len(driver.spilledContentPaths) != 1 {
+		t.Fatalf("got %d spilled files, expected 1", len(driver.spilledContentPaths))
+	}
+	var spilledPath string
+	for path := range driver.spilledContentPaths {
+		spilledPath = path
+	}
+	spilledFile := driver.spilledContentPaths[spilledPath]
+
+	// The data still used by the second image is kept.
+	driver.removeImage(images[0])
+	if _, err := driver.GetContent(nil, spilledPath); err != nil {
+		t.Fatalf("the manifest of the second image is no longer served: %v", err)
+	}
+
+	driver.removeImage(images[1])
+	if _, err := spilledFile.Stat(); err == nil {
+		t.Error("the spilled file is still open once every image is removed")
+	}
+
+	if len(driver.contentPaths) != 0 || len(driver.spilledContentPaths) != 0 || len(driver.externalContentPaths) != 0 || len(driver.pathRefs) != 0 {
+		t.Errorf("the driver still serves data once every image is removed: %v, %v, %v",
+			driver.contentPaths, driver.spilledContentPaths, driver.externalContentPaths)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerclient
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/version"
+	"github.com/docker/docker/reference"
+
+	"github.com/docker/distribution/registry/handlers"
+	"github.com/docker/distribution/registry/listener"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+)
+
+// registryServer is a local registry serving images to the Docker daemon. It keeps running once
+// started, and images are added to it incrementally, so that any number of images can be loaded
+// through a single registry.
+//
+// The errors met by the registry while serving, e.g. when reading a layer, are sent to errs.
+type registryServer struct {
+	driver *localServeDriver
+	port   int
+	errs   chan error
+}
+
+// registryErrorsBuffer is the number of errors of a registry server kept until they are read.
+const registryErrorsBuffer = 16
+
+var (
+	registryServersLock sync.Mutex
+	registryServers     = map[string]*registryServer{} // Map from registry address -> server
+)
+
+// getRegistryServer returns the registry server listening on registryAddr, starting it if it is
+// not running yet.
+func getRegistryServer(registryAddr string) (*registryServer, error) {
+	registryServersLock.Lock()
+	defer registryServersLock.Unlock()
+
+	if server, found := registryServers[registryAddr]; found {
+		return server, nil
+	}
+
+	server, err := startRegistryServer(registryAddr, len(registryServers))
+	if err != nil {
+		return nil, err
+	}
+
+	registryServers[registryAddr] = server
+	return server, nil
+}
+
+// startRegistryServer starts a registry server listening on registryAddr. Since storage drivers
+// cannot be unregistered, the driver of each server is registered under a distinct name, derived
+// from the given index.
+func startRegistryServer(registryAddr string, index int) (*registryServer, error) {
+	errs := make(chan error, registryErrorsBuffer)
+	driver := newLocalServeDriver(errs)
+	driverName := fmt.Sprintf("localserve%d", index)
+	factory.Register(driverName, &localServeDriverFactory{driver})
+
+	buf := bytes.NewBufferString(fmt.Sprintf(`
+version: 0.1
+log:
+  level: error
+  formatter: text
+http:
+  addr: %s
+storage:
+  %s:
+compatibility:
+  schema1:
+    disablesignaturestore: true
+`, registryAddr, driverName))
+
+	// Use a logger distinct from our own, with the same level, except that the informational
+	// messages of the registry (logged for every request) are only shown when debugging.
+	registryLogger := log.New()
+	registryLogger.Level = log.GetLevel()
+	if registryLogger.Level == log.InfoLevel {
+		registryLogger.Level = log.WarnLevel
+	}
+
+	ctx := context.WithLogger(context.Background(), log.NewEntry(registryLogger))
+	ctx = context.WithVersion(ctx, version.Version)
+	config, err := configuration.Parse(buf)
+	if err != nil {
+		panic(err)
+	}
+
+	handler := handlers.NewApp(ctx, config)
+	server := &http.Server{
+		Handler: handler,
+	}
+
+	ln, err := listener.NewListener(config.HTTP.Net, config.HTTP.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		err := server.Serve(ln)
+		if err != nil {
+			log.Errorf("Error running local registry: %v", err)
+			driver.reportError(fmt.Errorf("registry stopped serving: %v", err))
+		}
+	}()
+
+	return &registryServer{
+		driver: driver,
+		port:   ln.Addr().(*net.TCPAddr).Port,
+		errs:   errs,
+	}, nil
+}
+
+// lastError returns the last error met by the registry since the previous call, if any.
+func (s *registryServer) lastError() error {
+	var lastErr error
+	for {
+		select {
+		case err := <-s.errs:
+			lastErr = err
+		default:
+			return lastErr
+		}
+	}
+}
+
+// addImage makes the registry serve the given image, with its manifest and layerPaths, spilling
+// the data larger than the given threshold (if not 0) to temp files. It returns the request paths
+// of the image, to be given to removeImage once the image is loaded.
+func (s *registryServer) addImage(image reference.Named, manifest *schema1.SignedManifest, layerPaths map[string]string, spillThreshold int64) []string {
+	return s.driver.addImage(image, manifest, layerPaths, spillThreshold)
+}
+
+// removeImage stops serving the image whose request paths are given, as returned by addImage.
+func (s *registryServer) removeImage(paths []string) {
+	s.driver.removeImage(paths)
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerdist
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/docker/docker/cliconfig"
+	"github.com/docker/engine-api/types"
+)
+
+const (
+	// credentialHelperPrefix is the prefix of the name of the credential helper binaries.
+	credentialHelperPrefix = "docker-credential-"
+
+	// credentialsNotFound is the message returned by credential helpers when they have no
+	// credentials for the requested server.
+	credentialsNotFound = "credentials not found in native keychain"
+
+	// identityTokenUsername is the username returned by credential helpers when the secret is an
+	// identity token rather than a password.
+	identityTokenUsername = "<token>"
+)
+
+// credentialHelpersConfig holds the credential helper settings of a docker config file, which
+// are not all exposed by cliconfig.ConfigFile.
+type credentialHelpersConfig struct {
+	CredentialsStore  string            `json:"credsStore,omitempty"`
+	CredentialHelpers map[string]string `json:"credHelpers,omitempty"`
+}
+
+// credentialHelperResponse is the output of the `get` command of a credential helper.
+type credentialHelperResponse struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+// credentialHelper returns the name of the credential helper configured for the given registry
+// hostname in the given docker config file, if any.
+func credentialHelper(configFile *cliconfig.ConfigFile, hostname string) (string, error) {
+	file, err := os.Open(configFile.Filename())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer file.Close()
+
+	var config credentialHelpersConfig
+	if err := json.NewDecoder(file).Decode(&config); err != nil {
+		return "", fmt.Errorf("%s - %v", configFile.Filename(), err)
+	}
+
+	if helper, found := config.CredentialHelpers[hostname]; found {
+		return helper, nil
+	}
+
+	return config.CredentialsStore, nil
+}
+
+// getHelperCredentials retrieves the credentials for the given server from the given credential
+// helper. The returned boolean is false if the helper has no credentials for the server.
+func getHelperCredentials(helper string, serverAddress string) (types.AuthConfig, bool, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(credentialHelperPrefix+helper, "get")
+	cmd.Stdin = strings.NewReader(serverAddress)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		output := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(output, credentialsNotFound) {
+			return types.AuthConfig{}, false, nil
+		}
+
+		return types.AuthConfig{}, false, fmt.Errorf("Could not get credentials from %s%s: %v: %s", credentialHelperPrefix, helper, err, output)
+	}
+
+	var response credentialHelperResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return types.AuthConfig{}, false, fmt.Errorf("Could not parse credentials from %s%s: %v", credentialHelperPrefix, helper, err)
+	}
+
+	if response.Username == identityTokenUsername {
+		return types.AuthConfig{}, false, fmt.Errorf("Could not use credentials from %s%s: identity tokens are not supported", credentialHelperPrefix, helper)
+	}
+
+	return types.AuthConfig{
+		Username:      response.Username,
+		Password:      response.Secret,
+		ServerAddress: serverAddress,
+	}, true, nil
+}
@@ -17,26 +17,71 @@
 package dockerdist
 
 import (
+	"crypto/tls"
 	"errors"
-	"log"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	distlib "github.com/docker/distribution"
 	"github.com/docker/distribution/digest"
 	"github.com/docker/distribution/manifest/schema1"
+	distreference "github.com/docker/distribution/reference"
 	"github.com/docker/distribution/registry/client"
+	"github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/distribution/registry/client/transport"
 	"github.com/docker/docker/cliconfig"
-	"github.com/docker/docker/distribution"
 	"github.com/docker/docker/reference"
 	"github.com/docker/docker/registry"
 	"github.com/docker/engine-api/types"
-	"github.com/docker/go-connections/tlsconfig"
+	registrytypes "github.com/docker/engine-api/types/registry"
 
 	"golang.org/x/net/context"
+
+	"github.com/coreos/quayctl/httpclient"
+)
+
+// TLSSkipVerify disables the verification of the TLS certificates of the registries, e.g. to
+// talk to an internal registry with a self-signed certificate. Unlike the insecure option, HTTPS
+// is still used.
+var TLSSkipVerify bool
+
+// RegistryToken, or RegistryUsername and RegistryPassword, are the credentials used to talk to the
+// registries in place of those found in the user's docker config, e.g. in ephemeral environments
+// without one. The token takes precedence.
+var (
+	RegistryToken    string
+	RegistryUsername string
+	RegistryPassword string
+)
+
+// RegistryMirrors are the hostnames of the registries from which the manifests (and then the
+// blobs) of the images are downloaded, in order of preference, before falling back to the registry
+// of each image.
+var RegistryMirrors []string
+
+// UserAgent is the User-Agent sent in the requests to the registries. If empty, the default one of
+// each client is used.
+var UserAgent string
+
+// challengeManagers are the authentication challenges of the registries pinged so far, keyed by
+// the URL of their /v2/ endpoint.
+var (
+	challengeManagersLock sync.Mutex
+	challengeManagers     = make(map[string]auth.ChallengeManager)
 )
 
 // getRepositoryClient returns a client for performing registry operations against the given named
 // image.
+//
+// The client is assembled here rather than via distribution.NewV2Repository, as the latter dials
+// the registry with its own transport, which ignores httpclient.Resolve and UserAgent.
 func getRepositoryClient(image reference.Named, insecure bool, scopes ...string) (distlib.Repository, error) {
 	// Lookup the index information for the name.
 	indexInfo, err := registry.ParseSearchIndexInfo(image.String())
@@ -44,45 +89,162 @@ func getRepositoryClient(image reference.Named, insecure bool, scopes ...string)
 		return nil, err
 	}
 
-	// Retrieve the user's Docker configuration file (if any).
-	configFile, err := cliconfig.Load(cliconfig.ConfigDir())
+	// Resolve the authentication information for the registry specified.
+	authConfig, err := resolveAuthConfig(indexInfo)
 	if err != nil {
 		return nil, err
 	}
 
-	// Resolve the authentication information for the registry specified, via the config file.
-	authConfig := registry.ResolveAuthConfig(configFile.AuthConfigs, indexInfo)
+	endpointURL := EndpointURL(image, insecure)
+	challengeManager, err := getChallengeManager(endpointURL)
+	if err != nil {
+		return nil, err
+	}
 
-	repoInfo := &registry.RepositoryInfo{
-		image,
-		indexInfo,
-		false,
+	// Authorize the requests with the registry token, if any, or with the token obtained with the
+	// credentials, or else with the credentials themselves.
+	base := registryTransport()
+	var authorizer transport.RequestModifier
+	if authConfig.RegistryToken != "" {
+		authorizer = auth.NewAuthorizer(challengeManager, registryTokenHandler{authConfig.RegistryToken})
+	} else {
+		credentials := authConfigCredentialStore{authConfig}
+		authorizer = auth.NewAuthorizer(challengeManager,
+			auth.NewTokenHandler(base, credentials, image.RemoteName(), scopes...),
+			auth.NewBasicHandler(credentials))
 	}
 
-	metaHeaders := map[string][]string{}
-	tlsConfig := tlsconfig.ServerDefault
+	repoName, err := distreference.ParseNamed(image.RemoteName())
+	if err != nil {
+		return nil, err
+	}
 
-	url, err := url.Parse("https://" + image.Hostname())
-	if insecure {
-		url, err = url.Parse("http://" + image.Hostname())
+	return client.NewRepository(context.Background(), repoName, endpointURL.String(), transport.NewTransport(base, authorizer))
+}
+
+// getChallengeManager returns the authentication challenges of the registry found at the given
+// endpoint. The registry is only pinged the first time, its challenges being then shared by all
+// the requests made to it.
+func getChallengeManager(endpointURL *url.URL) (auth.ChallengeManager, error) {
+	pingURL := *endpointURL
+	pingURL.Path = "/v2/"
+
+	challengeManagersLock.Lock()
+	defer challengeManagersLock.Unlock()
+
+	if challengeManager, ok := challengeManagers[pingURL.String()]; ok {
+		return challengeManager, nil
 	}
+
+	// Ping the registry to retrieve its authentication challenges.
+	pingClient := &http.Client{Transport: registryTransport(), Timeout: 15 * time.Second}
+	resp, err := pingClient.Get(pingURL.String())
 	if err != nil {
 		return nil, err
 	}
+	resp.Body.Close()
 
-	endpoint := registry.APIEndpoint{
-		URL:          url,
-		Version:      registry.APIVersion2,
-		Official:     false,
-		TrimHostname: true,
-		TLSConfig:    &tlsConfig,
+	challengeManager := auth.NewSimpleChallengeManager()
+	if err := challengeManager.AddResponse(resp); err != nil {
+		return nil, err
 	}
 
-	ctx := context.Background()
-	repo, _, err := distribution.NewV2Repository(ctx, repoInfo, endpoint, metaHeaders, &authConfig, scopes...)
-	return repo, err
+	challengeManagers[pingURL.String()] = challengeManager
+	return challengeManager, nil
+}
+
+// registryTokenHandler authorizes the requests to a registry with a bearer token obtained
+// beforehand.
+type registryTokenHandler struct {
+	token string
+}
+
+func (h registryTokenHandler) Scheme() string {
+	return "bearer"
+}
+
+func (h registryTokenHandler) AuthorizeRequest(req *http.Request, params map[string]string) error {
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", h.token))
+	return nil
+}
+
+// EndpointURL returns the URL of the registry hosting the given named image, which uses HTTP in
+// place of HTTPS if insecure is true.
+func EndpointURL(image reference.Named, insecure bool) *url.URL {
+	// The hostname of the image includes its port, if any.
+	endpointURL := &url.URL{
+		Scheme: "https",
+		Host:   image.Hostname(),
+	}
+	if insecure {
+		endpointURL.Scheme = "http"
+	}
+
+	return endpointURL
+}
+
+// privateNetworks are the networks of the loopback and private addresses, whose registries are
+// assumed to be insecure, like Docker does for 127.0.0.0/8.
+var privateNetworks = []string{"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "::1/128", "fc00::/7"}
+
+// WithDefaultRegistry prefixes the given image reference with the given default registry hostname,
+// if it does not specify one. Like Docker, the first component of the reference is only a hostname
+// if it contains a '.' or a ':', or if it is localhost.
+func WithDefaultRegistry(image, defaultRegistry string) string {
+	slash := strings.Index(image, "/")
+	if slash >= 0 {
+		if first := image[:slash]; strings.ContainsAny(first, ".:") || first == "localhost" {
+			return image
+		}
+	}
+
+	return defaultRegistry + "/" + image
+}
+
+// IsLocalRegistry returns whether the given registry hostname, which may include a port, refers
+// to the local machine or to a local network, i.e. localhost, a .local name or a loopback or
+// private IP address. Such registries are usually served over HTTP.
+func IsLocalRegistry(hostname string) bool {
+	host := hostname
+	if splitHost, _, err := net.SplitHostPort(hostname); err == nil {
+		host = splitHost
+	}
+
+	if host == "localhost" || strings.HasSuffix(host, ".local") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range privateNetworks {
+		if _, ipNet, err := net.ParseCIDR(network); err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
 }
 
+// TagName returns the tag of the given image reference, or the default tag (latest) if the
+// reference has no tag.
+//
+// References by digest also have no tag, so callers must handle them beforehand when the tag
+// is meant to identify the image.
+func TagName(image reference.Named) string {
+	if tagged, ok := image.(reference.NamedTagged); ok {
+		return tagged.Tag()
+	}
+
+	return reference.DefaultTag
+}
+
+// ErrTagUnavailable is returned when the registry refuses to resolve the tag of an image, which
+// happens both when the tag does not exist and when it cannot be accessed.
+var ErrTagUnavailable = errors.New("Received error when trying to fetch the specified tag: it might not exist or you do not have access")
+
 // getDigest returns the digest for the given image.
 func getDigest(ctx context.Context, repo distlib.Repository, image reference.Named) (digest.Digest, error) {
 	if withDigest, ok := image.(reference.Canonical); ok {
@@ -92,21 +254,15 @@ func getDigest(ctx context.Context, repo distlib.Repository, image reference.Nam
 	// Get TagService.
 	tagSvc := repo.Tags(ctx)
 
-	// Get Tag name.
-	tag := "latest"
-	if withTag, ok := image.(reference.NamedTagged); ok {
-		tag = withTag.Tag()
-	}
-
 	// Get Tag's Descriptor.
-	descriptor, err := tagSvc.Get(ctx, tag)
+	descriptor, err := tagSvc.Get(ctx, TagName(image))
 	if err != nil {
 		// Docker returns an UnexpectedHTTPResponseError if it cannot parse the JSON body of an
 		// unexpected error. Unfortunately, HEAD requests *by definition* don't have bodies, so
 		// Docker will return this error for non-200 HEAD requests. We therefore have to hack
 		// around it... *sigh*.
 		if _, ok := err.(*client.UnexpectedHTTPResponseError); ok {
-			return "", errors.New("Received error when trying to fetch the specified tag: it might not exist or you do not have access")
+			return "", ErrTagUnavailable
 		}
 
 		return "", err
@@ -115,6 +271,23 @@ func getDigest(ctx context.Context, repo distlib.Repository, image reference.Nam
 	return descriptor.Digest, nil
 }
 
+// GetTagDigest returns the digest of the manifest currently referenced by the given tag of the
+// named image.
+func GetTagDigest(named reference.Named, tag string, insecure bool) (digest.Digest, error) {
+	tagged, err := reference.WithTag(named, tag)
+	if err != nil {
+		return "", err
+	}
+
+	// Create a reference to a repository client for the repo.
+	repo, err := getRepositoryClient(tagged, insecure, "pull")
+	if err != nil {
+		return "", err
+	}
+
+	return getDigest(context.Background(), repo, tagged)
+}
+
 // GetAuthCredentials returns the auth credentials (if any found) for the given repository, as found
 // in the user's docker config.
 func GetAuthCredentials(image string) (types.AuthConfig, error) {
@@ -124,35 +297,223 @@ func GetAuthCredentials(image string) (types.AuthConfig, error) {
 		return types.AuthConfig{}, err
 	}
 
+	// Resolve the authentication information for the registry specified.
+	return resolveAuthConfig(indexInfo)
+}
+
+// authConfigCredentialStore provides the basic auth credentials of an AuthConfig to the registry
+// token flow.
+type authConfigCredentialStore struct {
+	authConfig types.AuthConfig
+}
+
+func (s authConfigCredentialStore) Basic(*url.URL) (string, string) {
+	return s.authConfig.Username, s.authConfig.Password
+}
+
+// GetAuthorizationHeader returns the value of the Authorization header granting pull access to
+// the given repository, as obtained via the token flow of its registry using the credentials found
+// in the user's docker config. An empty string is returned if the registry does not use bearer
+// tokens.
+func GetAuthorizationHeader(image string, insecure bool) (string, error) {
+	named, err := reference.ParseNamed(image)
+	if err != nil {
+		return "", err
+	}
+
+	// Resolve the authentication information for the registry specified.
+	indexInfo, err := registry.ParseSearchIndexInfo(image)
+	if err != nil {
+		return "", err
+	}
+
+	authConfig, err := resolveAuthConfig(indexInfo)
+	if err != nil {
+		return "", err
+	}
+
+	if authConfig.RegistryToken != "" {
+		return fmt.Sprintf("Bearer %s", authConfig.RegistryToken), nil
+	}
+
+	endpointURL := EndpointURL(named, insecure)
+	challengeManager, err := getChallengeManager(endpointURL)
+	if err != nil {
+		return "", err
+	}
+
+	pingURL := *endpointURL
+	pingURL.Path = "/v2/"
+	challenges, err := challengeManager.GetChallenges(pingURL.String())
+	if err != nil {
+		return "", err
+	}
+
+	// Request a token for the bearer challenge (if any).
+	for _, challenge := range challenges {
+		if challenge.Scheme != "bearer" {
+			continue
+		}
+
+		request, err := http.NewRequest("GET", pingURL.String(), nil)
+		if err != nil {
+			return "", err
+		}
+
+		tokenHandler := auth.NewTokenHandler(registryTransport(), authConfigCredentialStore{authConfig}, named.RemoteName(), "pull")
+		if err := tokenHandler.AuthorizeRequest(request, challenge.Parameters); err != nil {
+			return "", err
+		}
+
+		return request.Header.Get("Authorization"), nil
+	}
+
+	return "", nil
+}
+
+// registryTransport returns the transport used for the requests made directly to the registries,
+// which connects to the hostnames overridden by httpclient.Resolve at their given IP addresses.
+func registryTransport() http.RoundTripper {
+	base := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		Dial:                httpclient.Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
+	if TLSSkipVerify {
+		base.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return httpclient.WithUserAgent(base, UserAgent)
+}
+
+// resolveAuthConfig returns the auth credentials (if any found) for the given registry index, as
+// found in the user's docker config.
+//
+// The docker config is read from the directory specified by the DOCKER_CONFIG environment
+// variable, or from ~/.docker if it is not set. If the config specifies a credential helper
+// (credsStore or credHelpers) for the registry, the credentials are retrieved from it.
+//
+// If credentials are given explicitly via RegistryToken or RegistryUsername, the docker config is
+// not used.
+func resolveAuthConfig(indexInfo *registrytypes.IndexInfo) (types.AuthConfig, error) {
+	if RegistryToken != "" {
+		return types.AuthConfig{RegistryToken: RegistryToken}, nil
+	}
+
+	if RegistryUsername != "" {
+		return types.AuthConfig{Username: RegistryUsername, Password: RegistryPassword}, nil
+	}
+
 	// Retrieve the user's Docker configuration file (if any).
 	configFile, err := cliconfig.Load(cliconfig.ConfigDir())
 	if err != nil {
 		return types.AuthConfig{}, err
 	}
 
+	// Retrieve the credentials from the credential helper configured for the registry (if any).
+	helper, err := credentialHelper(configFile, indexInfo.Name)
+	if err != nil {
+		return types.AuthConfig{}, err
+	}
+
+	if helper != "" {
+		authConfig, found, err := getHelperCredentials(helper, registry.GetAuthConfigKey(indexInfo))
+		if err != nil {
+			return types.AuthConfig{}, err
+		}
+
+		if found {
+			return authConfig, nil
+		}
+	}
+
 	// Resolve the authentication information for the registry specified, via the config file.
 	return registry.ResolveAuthConfig(configFile.AuthConfigs, indexInfo), nil
 }
 
-// DownloadManifest the manifest for the given image, using the given credentials.
-func DownloadManifest(image string, insecure bool) (reference.Named, distlib.Manifest, error) {
+// DownloadManifest downloads the manifest for the given image, trying the RegistryMirrors (if
+// any) in order before the registry of the image itself. If the given lockfile is not nil, the
+// manifest must have the digest it records for the image.
+//
+// Along with the named image and its manifest, it returns the named image on the registry that
+// served the manifest, i.e. rewritten with the hostname of the mirror (if any), from which the
+// blobs of the image should be downloaded.
+func DownloadManifest(image string, insecure bool, lock Lockfile) (reference.Named, reference.Named, distlib.Manifest, error) {
 	// Parse the image name as a docker image reference.
 	named, err := reference.ParseNamed(image)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
+	for _, mirror := range RegistryMirrors {
+		mirrored, err := withHostname(named, mirror)
+		if err != nil {
+			log.Warnf("Could not use registry mirror %v: %v", mirror, err)
+			continue
+		}
+
+		manifest, err := downloadManifest(mirrored, insecure)
+		if err != nil {
+			log.Warnf("Could not download manifest for image %v from registry mirror %v: %v", image, mirror, err)
+			continue
+		}
+
+		return checkImageLock(lock, named, mirrored, manifest)
+	}
+
+	manifest, err := downloadManifest(named, insecure)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return checkImageLock(lock, named, named, manifest)
+}
+
+// checkImageLock verifies the given manifest of the named image against the given lockfile, if
+// any, and passes the results of DownloadManifest through if it matches.
+func checkImageLock(lock Lockfile, named, source reference.Named, manifest distlib.Manifest) (reference.Named, reference.Named, distlib.Manifest, error) {
+	if lock != nil {
+		if err := lock.verify(named, manifest); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return named, source, manifest, nil
+}
+
+// withHostname returns the given named image, with its hostname replaced by the given one.
+func withHostname(named reference.Named, hostname string) (reference.Named, error) {
+	renamed, err := reference.WithName(hostname + "/" + named.RemoteName())
+	if err != nil {
+		return nil, err
+	}
+
+	switch ref := named.(type) {
+	case reference.Canonical:
+		return reference.WithDigest(renamed, ref.Digest())
+	case reference.NamedTagged:
+		return reference.WithTag(renamed, ref.Tag())
+	}
+
+	return renamed, nil
+}
+
+// downloadManifest downloads the manifest for the given named image from its registry.
+func downloadManifest(named reference.Named, insecure bool) (distlib.Manifest, error) {
+	image := named.String()
+
 	// Create a reference to a repository client for the repo.
 	repo, err := getRepositoryClient(named, insecure, "pull")
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	// Get the digest.
 	ctx := context.Background()
 	digest, err := getDigest(ctx, repo, named)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	// Retrieve the manifest for the tag.
@@ -160,12 +521,12 @@ func DownloadManifest(image string, insecure bool) (reference.Named, distlib.Man
 
 	manSvc, err := repo.Manifests(ctx)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	manifest, err := manSvc.Get(ctx, digest)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	// Verify the manifest if it's signed.
@@ -173,11 +534,43 @@ func DownloadManifest(image string, insecure bool) (reference.Named, distlib.Man
 	case *schema1.SignedManifest:
 		_, verr := schema1.Verify(manifest.(*schema1.SignedManifest))
 		if verr != nil {
-			return nil, nil, verr
+			return nil, verr
 		}
 	default:
 		log.Printf("Could not verify manifest for image %v: not signed", image)
 	}
 
-	return named, manifest, nil
+	return manifest, nil
+}
+
+// DownloadBlob downloads the blob with the given digest directly from the repository of the named
+// image, and writes it to w once its digest has been verified.
+func DownloadBlob(named reference.Named, blobDigest digest.Digest, insecure bool, w io.Writer) error {
+	// Create a reference to a repository client for the repo.
+	repo, err := getRepositoryClient(named, insecure, "pull")
+	if err != nil {
+		return err
+	}
+
+	verifier, err := digest.NewDigestVerifier(blobDigest)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	blob, err := repo.Blobs(ctx).Open(ctx, blobDigest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	if _, err := io.Copy(io.MultiWriter(w, verifier), blob); err != nil {
+		return err
+	}
+
+	if !verifier.Verified() {
+		return fmt.Errorf("content of blob %v does not match its digest", blobDigest)
+	}
+
+	return nil
 }
@@ -0,0 +1,95 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerdist
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/docker/docker/reference"
+)
+
+func TestTagName(t *testing.T) {
+	tests := []struct {
+		image    string
+		expected string
+	}{
+		{"quay.io/coreos/etcd", "latest"},
+		{"quay.io/coreos/etcd:v3.0.0", "v3.0.0"},
+		{"quay.io/coreos/etcd@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", "latest"},
+		{"busybox", "latest"},
+		{"localhost:5000/busybox:1.25", "1.25"},
+	}
+
+	for _, test := range tests {
+		named, err := reference.ParseNamed(test.image)
+		if err != nil {
+			t.Fatalf("could not parse %v: %v", test.image, err)
+		}
+
+		if tag := TagName(named); tag != test.expected {
+			t.Errorf("TagName(%v) = %v, expected %v", test.image, tag, test.expected)
+		}
+	}
+}
+
+func TestRegistryPingedOnce(t *testing.T) {
+	RegistryUsername, RegistryPassword = "user", "password"
+	defer func() { RegistryUsername, RegistryPassword = "", "" }()
+
+	var pings int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			atomic.AddInt32(&pings, 1)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/token":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"token": "secret"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	image := strings.TrimPrefix(server.URL, "http://") + "/coreos/etcd"
+	named, err := reference.ParseNamed(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		header, err := GetAuthorizationHeader(image, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != "Bearer secret" {
+			t.Errorf("got Authorization header %q, expected %q", header, "Bearer secret")
+		}
+
+		if _, err := getRepositoryClient(named, true, "pull"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if pings != 1 {
+		t.Errorf("the registry was pinged %d times, expected once", pings)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerdist
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	distlib "github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/docker/reference"
+)
+
+// Lockfile maps image references to the digests of the manifests they are expected to refer to,
+// so that a tag cannot be changed to point to another image behind the user's back. It is encoded
+// as a JSON object, e.g. {"quay.io/ns/repo:v1": "sha256:4a5b..."}.
+type Lockfile map[string]digest.Digest
+
+// LoadLockfile reads the lockfile found at the given path. Its image references are normalized
+// like those given on the command line, e.g. ns/repo refers to <defaultRegistry>/ns/repo:latest.
+func LoadLockfile(path, defaultRegistry string) (Lockfile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read lockfile: %v", err)
+	}
+	defer f.Close()
+
+	var entries map[string]string
+	if err := json.NewDecoder(f).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("Could not parse lockfile %v: %v", path, err)
+	}
+
+	lockfile := make(Lockfile, len(entries))
+	for image, value := range entries {
+		named, err := reference.ParseNamed(WithDefaultRegistry(image, defaultRegistry))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid image %v in lockfile: %v", image, err)
+		}
+
+		lockedDigest, err := digest.ParseDigest(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid digest for image %v in lockfile: %v", image, err)
+		}
+
+		lockfile[reference.WithDefaultTag(named).String()] = lockedDigest
+	}
+
+	return lockfile, nil
+}
+
+// verify ensures that the given manifest of the named image has the digest recorded in the
+// lockfile.
+func (lockfile Lockfile) verify(named reference.Named, manifest distlib.Manifest) error {
+	image := reference.WithDefaultTag(named).String()
+	lockedDigest, found := lockfile[image]
+	if !found {
+		return fmt.Errorf("Image %v is not listed in the lockfile", image)
+	}
+
+	manifestDigest, err := ManifestDigest(manifest)
+	if err != nil {
+		return err
+	}
+
+	if manifestDigest != lockedDigest {
+		return fmt.Errorf("Manifest of image %v has digest %v, but the lockfile expects %v", image, manifestDigest, lockedDigest)
+	}
+
+	return nil
+}
+
+// ManifestDigest returns the digest identifying the given manifest in the registry. The digest of
+// signed schema1 manifests is the one of their payload, without the signatures.
+func ManifestDigest(manifest distlib.Manifest) (digest.Digest, error) {
+	if signed, ok := manifest.(*schema1.SignedManifest); ok {
+		return digest.FromBytes(signed.Canonical), nil
+	}
+
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		return "", err
+	}
+
+	return digest.FromBytes(payload), nil
+}
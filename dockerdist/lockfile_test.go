@@ -0,0 +1,75 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerdist
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestLoadLockfile(t *testing.T) {
+	f, err := ioutil.TempFile("", "quayctl-lockfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`{
+		"coreos/etcd": "` + testDigest + `",
+		"quay.io/coreos/flannel:v0.6.0": "` + testDigest + `",
+		"localhost:5000/busybox": "` + testDigest + `"
+	}`)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lockfile, err := LoadLockfile(f.Name(), "quay.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, image := range []string{"quay.io/coreos/etcd:latest", "quay.io/coreos/flannel:v0.6.0", "localhost:5000/busybox:latest"} {
+		if lockfile[image] != testDigest {
+			t.Errorf("image %v is not locked to %v: %v", image, testDigest, lockfile)
+		}
+	}
+
+	if len(lockfile) != 3 {
+		t.Errorf("got %d locked images, expected 3: %v", len(lockfile), lockfile)
+	}
+}
+
+func TestWithDefaultRegistry(t *testing.T) {
+	tests := []struct {
+		image    string
+		expected string
+	}{
+		{"busybox", "quay.io/busybox"},
+		{"coreos/etcd:v3.0.0", "quay.io/coreos/etcd:v3.0.0"},
+		{"registry.example.com/coreos/etcd", "registry.example.com/coreos/etcd"},
+		{"localhost/busybox", "localhost/busybox"},
+		{"registry:5000/busybox", "registry:5000/busybox"},
+	}
+
+	for _, test := range tests {
+		if image := WithDefaultRegistry(test.image, "quay.io"); image != test.expected {
+			t.Errorf("WithDefaultRegistry(%v) = %v, expected %v", test.image, image, test.expected)
+		}
+	}
+}
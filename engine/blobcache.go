@@ -0,0 +1,161 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution/digest"
+)
+
+// blobCachePath returns the path of the blob identified by the given torrent ID in the
+// content-addressable blob cache, i.e. <blobCache>/<algorithm>/<hex>. False is returned if the
+// torrent ID is not the digest of a blob, e.g. for squashed images.
+func blobCachePath(blobCache, id string) (string, bool) {
+	blobDigest, err := digest.ParseDigest(id)
+	if err != nil {
+		return "", false
+	}
+
+	return filepath.Join(blobCache, string(blobDigest.Algorithm()), blobDigest.Hex()), true
+}
+
+// lookupBlobCache returns the path of the blob identified by the given torrent ID in the blob
+// cache, if it is present.
+func lookupBlobCache(blobCache, id string) (string, bool) {
+	cachePath, ok := blobCachePath(blobCache, id)
+	if !ok {
+		return "", false
+	}
+
+	if _, err := os.Stat(cachePath); err != nil {
+		return "", false
+	}
+
+	return cachePath, true
+}
+
+// storeBlobCache adds the downloaded blob found at blobPath, and identified by the given torrent
+// ID, to the blob cache, once its digest has been verified. The blob is hard-linked into the
+// cache, or copied if it is on a different file system.
+func storeBlobCache(blobCache, id, blobPath string) error {
+	cachePath, ok := blobCachePath(blobCache, id)
+	if !ok {
+		return nil
+	}
+
+	if _, err := os.Stat(cachePath); err == nil {
+		return nil
+	}
+
+	if err := verifyBlob(digest.Digest(id), blobPath); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Link(blobPath, cachePath); err == nil || os.IsExist(err) {
+		return nil
+	}
+
+	// Copy the blob to a temporary file first, so that partial copies are never found in the
+	// cache.
+	tempPath := fmt.Sprintf("%s.%d.tmp", cachePath, os.Getpid())
+	if err := copyFile(blobPath, tempPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	return os.Rename(tempPath, cachePath)
+}
+
+// verifyBlob ensures that the content of the file found at the given path matches the given
+// digest.
+func verifyBlob(blobDigest digest.Digest, blobPath string) error {
+	verifier, err := digest.NewDigestVerifier(blobDigest)
+	if err != nil {
+		return err
+	}
+
+	blobFile, err := os.Open(blobPath)
+	if err != nil {
+		return err
+	}
+	defer blobFile.Close()
+
+	if _, err := io.Copy(verifier, blobFile); err != nil {
+		return err
+	}
+
+	if !verifier.Verified() {
+		return fmt.Errorf("content of %v does not match digest %v", blobPath, blobDigest)
+	}
+
+	return nil
+}
+
+// downloadedBlobsFolder is the name of the folder, within the torrent folder, indexing the blobs
+// downloaded via BitTorrent by their digest, as symbolic links to their content.
+const downloadedBlobsFolder = ".blobs"
+
+// recordDownloadedBlob indexes the blob identified by the given torrent ID, downloaded to blobPath
+// within the given torrent folder, so that a later pull can reuse it without starting its torrent,
+// e.g. when retrying a pull whose load was interrupted.
+func recordDownloadedBlob(torrentFolder, id, blobPath string) error {
+	linkPath, ok := blobCachePath(filepath.Join(torrentFolder, downloadedBlobsFolder), id)
+	if !ok {
+		return nil
+	}
+
+	target, err := filepath.Abs(blobPath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(linkPath), 0755); err != nil {
+		return err
+	}
+
+	os.Remove(linkPath)
+	return os.Symlink(target, linkPath)
+}
+
+// lookupDownloadedBlob returns the path of the blob identified by the given torrent ID, if a
+// previous pull downloaded it to the given torrent folder, via BitTorrent or from the registry,
+// and its content still matches its digest.
+func lookupDownloadedBlob(torrentFolder, id string) (string, bool) {
+	for _, folder := range []string{downloadedBlobsFolder, registryBlobsFolder} {
+		blobPath, found := lookupBlobCache(filepath.Join(torrentFolder, folder), id)
+		if !found {
+			continue
+		}
+
+		// Resolve the link, so that the blob can be hard-linked, and ensure that the torrent
+		// was not evicted and downloaded again partially since.
+		blobPath, err := filepath.EvalSymlinks(blobPath)
+		if err != nil || verifyBlob(digest.Digest(id), blobPath) != nil {
+			continue
+		}
+
+		return blobPath, true
+	}
+
+	return "", false
+}
@@ -16,6 +16,8 @@ package engine
 
 import (
 	"github.com/spf13/cobra"
+
+	"github.com/coreos/quayctl/dockerdist"
 )
 
 // layersOption specifies an option to the RetrieveTorrents call on whether to download
@@ -53,10 +55,15 @@ type engineTorrentHandler interface {
 	// needed by this container engine.
 	DecorateCommand(command *cobra.Command)
 
-	// RetrieveTorrents retrieves all the torrents to be downloaded for the container image.
-	RetrieveTorrents(image string, insecureFlag bool, option layersOption) ([]torrentInfo, interface{}, error)
+	// CheckEngine ensures that the container engine can be used, before any download begins.
+	CheckEngine() error
+
+	// RetrieveTorrents retrieves all the torrents to be downloaded for the container image. If the
+	// given lockfile is not nil, the manifest of the image (if any) is verified against it.
+	RetrieveTorrents(image string, insecureFlag bool, option layersOption, lock dockerdist.Lockfile) ([]torrentInfo, interface{}, error)
 
 	// LoadImage performs the loading of the downloaded container image into the container
-	// engine.
-	LoadImage(image string, downloadInfo downloadTorrentInfo, ctx interface{}) error
+	// engine, and returns the digest (or ID) identifying the loaded image, or an empty string if
+	// it is unknown.
+	LoadImage(image string, downloadInfo downloadTorrentInfo, ctx interface{}) (string, error)
 }
@@ -0,0 +1,208 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/coreos/quayctl/bittorrent"
+)
+
+// controlledTorrent describes a torrent of the BitTorrent client, as returned by the control API.
+type controlledTorrent struct {
+	Source string            `json:"source"`
+	Status bittorrent.Status `json:"status"`
+}
+
+// controlError describes an error, as returned by the control API.
+type controlError struct {
+	Error string `json:"error"`
+}
+
+// controlServer is an HTTP server exposing the control API, which keeps track of the requests being
+// handled.
+type controlServer struct {
+	net.Listener
+
+	mux      *http.ServeMux
+	lock     sync.Mutex
+	closed   bool
+	handlers sync.WaitGroup
+}
+
+// Close stops the server and waits for the requests being handled to complete, so that the client
+// can be stopped once it returns. The requests received afterwards, e.g. on kept-alive
+// connections, are refused.
+func (s *controlServer) Close() error {
+	err := s.Listener.Close()
+
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+
+	s.handlers.Wait()
+	return err
+}
+
+func (s *controlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		writeControlError(w, http.StatusServiceUnavailable, errors.New("client stopped"))
+		return
+	}
+	s.handlers.Add(1)
+	s.lock.Unlock()
+
+	defer s.handlers.Done()
+	s.mux.ServeHTTP(w, r)
+}
+
+// startControlServer starts an HTTP server listening on the unix socket found at the given path,
+// which exposes a JSON API controlling the given client:
+//   - GET /torrents lists the torrents of the client along with their status,
+//   - GET /torrents/status?source=<source> returns the status of a torrent,
+//   - POST /torrents/pause?source=<source> and /torrents/resume?source=<source> pause and resume a
+//     torrent,
+//   - POST /torrents?source=<source> adds a torrent, downloaded to the torrent folder and seeded
+//     for the given duration (if not nil),
+//   - POST /stop stops the client, by closing the given channel.
+//
+// The server runs until the returned listener is closed, which waits for the requests being
+// handled.
+func startControlServer(socketPath string, bt *bittorrent.Client, torrentFolder string, seedDuration *time.Duration,
+	downloadConfig bittorrent.DownloadConfig, stop chan struct{}) (net.Listener, error) {
+
+	// Remove the socket left behind by a previous process, if any.
+	if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(socketPath)
+	}
+
+	// Only the owner of the process may control it: the socket is created with a restrictive umask,
+	// rather than restricted once created, so that it is never accessible to other users. The umask
+	// is process-wide, but the socket is created before the torrents are downloaded.
+	oldUmask := syscall.Umask(0177)
+	ln, err := net.Listen("unix", socketPath)
+	syscall.Umask(oldUmask)
+	if err != nil {
+		return nil, fmt.Errorf("Could not start control server: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/torrents", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			torrents := []controlledTorrent{}
+			for _, source := range bt.ActiveTorrents() {
+				if status, err := bt.GetStatus(source); err == nil {
+					torrents = append(torrents, controlledTorrent{Source: source, Status: status})
+				}
+			}
+			writeControlResponse(w, http.StatusOK, torrents)
+
+		case "POST":
+			source := r.URL.Query().Get("source")
+			if source == "" {
+				writeControlError(w, http.StatusBadRequest, errors.New("missing source"))
+				return
+			}
+
+			go func() {
+				if _, _, err := bt.Download(source, torrentFolder, seedDuration, downloadConfig); err != nil {
+					log.Errorf("Could not download torrent %v added via the control API: %v", source, err)
+					return
+				}
+
+				log.Printf("Completed download of torrent %v added via the control API", source)
+			}()
+			writeControlResponse(w, http.StatusAccepted, controlledTorrent{Source: source})
+
+		default:
+			writeControlError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+		}
+	})
+
+	mux.HandleFunc("/torrents/status", func(w http.ResponseWriter, r *http.Request) {
+		source := r.URL.Query().Get("source")
+		status, err := bt.GetStatus(source)
+		if err != nil {
+			writeControlError(w, http.StatusNotFound, err)
+			return
+		}
+
+		writeControlResponse(w, http.StatusOK, controlledTorrent{Source: source, Status: status})
+	})
+
+	handleTorrentAction := func(action func(string) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				writeControlError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+				return
+			}
+
+			source := r.URL.Query().Get("source")
+			if err := action(source); err != nil {
+				writeControlError(w, http.StatusNotFound, err)
+				return
+			}
+
+			status, _ := bt.GetStatus(source)
+			writeControlResponse(w, http.StatusOK, controlledTorrent{Source: source, Status: status})
+		}
+	}
+
+	mux.HandleFunc("/torrents/pause", handleTorrentAction(bt.Pause))
+	mux.HandleFunc("/torrents/resume", handleTorrentAction(bt.Resume))
+
+	var stopOnce sync.Once
+	mux.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeControlError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+			return
+		}
+
+		writeControlResponse(w, http.StatusAccepted, struct{}{})
+		stopOnce.Do(func() { close(stop) })
+	})
+
+	server := &controlServer{Listener: ln, mux: mux}
+
+	// Serve returns an error once the listener is closed, which is expected.
+	go http.Serve(ln, server)
+
+	return server, nil
+}
+
+// writeControlResponse writes the given value, encoded in JSON, as the response of the control API.
+func writeControlResponse(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeControlError writes the given error as the response of the control API.
+func writeControlError(w http.ResponseWriter, statusCode int, err error) {
+	writeControlResponse(w, statusCode, controlError{err.Error()})
+}
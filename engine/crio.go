@@ -0,0 +1,163 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/docker/reference"
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/quayctl/dockerdist"
+)
+
+var crioStorageFlag string
+
+// CRIEngine defines an engine interface for interacting with CRI-O, or any CRI runtime storing its
+// images in containers-storage.
+type CRIEngine struct{}
+
+func (ce CRIEngine) Name() string {
+	return "crio"
+}
+
+func (ce CRIEngine) Title() string {
+	return "Commands for pulling images into CRI-O from Quay"
+}
+
+func (ce CRIEngine) TorrentHandler() engineTorrentHandler {
+	return &criTorrentHandler{}
+}
+
+type criContext struct {
+	v1Manifest *schema1.SignedManifest
+	named      reference.Named
+}
+
+// criTorrentHandler defines an interface for pulling an image into CRI-O via torrent.
+//
+// The downloaded image is written as an OCI image layout, which is imported into the image store
+// of CRI-O by skopeo.
+type criTorrentHandler struct{}
+
+func (cth criTorrentHandler) DecorateCommand(command *cobra.Command) {
+	command.PersistentFlags().StringVar(&crioStorageFlag, "storage", "", "The containers-storage specification ([driver@graphroot+runroot]) of the image store of CRI-O. If not specified, the default store is used.")
+}
+
+func (cth criTorrentHandler) CheckEngine() error {
+	if _, err := exec.LookPath("skopeo"); err != nil {
+		return fmt.Errorf("Cannot find skopeo: %v", err)
+	}
+
+	return nil
+}
+
+func (cth criTorrentHandler) RetrieveTorrents(image string, insecureFlag bool, option layersOption, lock dockerdist.Lockfile) ([]torrentInfo, interface{}, error) {
+	// Retrieve the manifest for the image.
+	named, source, manifest, err := dockerdist.DownloadManifest(image, insecureFlag, lock)
+	if err != nil {
+		return []torrentInfo{}, nil, newPullError("Could not download image manifest", err)
+	}
+
+	v1Manifest, ok := manifest.(*schema1.SignedManifest)
+	if !ok {
+		return []torrentInfo{}, nil, errors.New("only v1 manifests are currently supported")
+	}
+
+	if err := validateV1Manifest(v1Manifest); err != nil {
+		return []torrentInfo{}, nil, fmt.Errorf("Invalid manifest for image %v: %v", image, err)
+	}
+
+	log.Printf("Downloaded manifest for image %v", image)
+
+	// Every layer is downloaded, as the layers present in the image store cannot be queried.
+	if option == MissingLayers {
+		log.Debugf("Pulling every layer of image %v, as CRI-O cannot be queried for its layers", image)
+	}
+
+	// Build the list of torrent URLs, one per file system layer, from the registry that served the
+	// manifest.
+	credentials, _ := dockerdist.GetAuthCredentials(source.String())
+	header := torrentAuthHeader(source.String(), insecureFlag)
+	torrents := dockerTorrentHandler{}.buildTorrentInfoForBlob(source, v1Manifest.FSLayers, credentials, header, insecureFlag)
+
+	return torrents, criContext{v1Manifest, named}, nil
+}
+
+// LoadImage writes the downloaded image as an OCI image layout and imports it into the image
+// store of CRI-O with skopeo, and returns the digest of the imported manifest.
+func (cth criTorrentHandler) LoadImage(image string, downloadInfo downloadTorrentInfo, ctx interface{}) (string, error) {
+	cctx := ctx.(criContext)
+
+	// Wait for all layers to be downloaded.
+	blobPaths := map[string]string{}
+	for _, fsLayer := range cctx.v1Manifest.FSLayers {
+		blobSum := fsLayer.BlobSum.String()
+		if _, found := blobPaths[blobSum]; found {
+			continue
+		}
+
+		blobPath, err := downloadInfo.waitForDownload(blobSum)
+		if err != nil {
+			if downloadInfo.HasProgressBars {
+				downloadInfo.Pool.Stop()
+			}
+
+			return "", fmt.Errorf("Could not load image %v: %v", image, err)
+		}
+		blobPaths[blobSum] = blobPath
+	}
+
+	if downloadInfo.HasProgressBars {
+		downloadInfo.Pool.Stop()
+	}
+
+	// Write the OCI image layout.
+	layoutPath, err := ioutil.TempDir("", "quayctl-oci")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(layoutPath)
+
+	tagName := dockerdist.TagName(cctx.named)
+	manifestDigest, err := writeOCILayout(layoutPath, tagName, cctx.v1Manifest, blobPaths)
+	if err != nil {
+		return "", fmt.Errorf("Could not write OCI image layout of image %v: %v", image, err)
+	}
+
+	// Import the layout into the image store.
+	log.Printf("Loading image %v", image)
+
+	destination := "containers-storage:"
+	if crioStorageFlag != "" {
+		destination += "[" + crioStorageFlag + "]"
+	}
+	destination += cctx.named.String()
+
+	cmd := exec.Command("skopeo", "copy", "oci:"+layoutPath+":"+tagName, destination)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Could not load image %v into CRI-O: %v", image, err)
+	}
+
+	return manifestDigest.String(), nil
+}
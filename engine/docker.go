@@ -15,15 +15,20 @@
 package engine
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"net/http"
 	"net/url"
 	"os"
 
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/digest"
 	"github.com/docker/distribution/manifest/schema1"
 	"github.com/docker/docker/reference"
 	"github.com/docker/engine-api/types"
+	"github.com/dustin/go-humanize"
 
 	"github.com/coreos/quayctl/dockerclient"
 	"github.com/coreos/quayctl/dockerdist"
@@ -31,8 +36,17 @@ import (
 )
 
 var (
-	squashedFlag bool
-	localIpFlag  string
+	squashedFlag     bool
+	localIpFlag      string
+	registryAddrFlag string
+	dockerHostFlag   string
+	dockerCertFlag   string
+	loadMethodFlag   string
+	saveSquashedFlag string
+	fromDockerFlag   bool
+	spillSizeFlag    string
+	tagFlags         []string
+	verifySquashed   bool
 )
 
 // DockerEngine defines an engine interface for interacting with Docker.
@@ -55,40 +69,166 @@ type dockerTorrentHandler struct{}
 
 func (dth dockerTorrentHandler) DecorateCommand(command *cobra.Command) {
 	command.PersistentFlags().BoolVar(&squashedFlag, "squashed", false, "If specified, the squashed version of the image will be pulled")
-	command.PersistentFlags().StringVar(&localIpFlag, "local-ip", "localhost", "The IP address of the local machine. Used to connect Docker to quayctl.")
+	command.PersistentFlags().StringVar(&saveSquashedFlag, "save-squashed", "", "If specified with --squashed, the downloaded squashed image is copied to the given path once imported")
+	command.PersistentFlags().BoolVar(&verifySquashed, "verify-squashed", false, "If specified with --squashed, the SHA256 digest of the downloaded squashed image is logged, and checked against the one advertised by the registry (if any) before importing it. Use --save-squashed to also keep the image.")
+	command.PersistentFlags().StringVar(&localIpFlag, "local-ip", "localhost", "The IP address of the local machine. Used to connect Docker to quayctl. 'auto' detects the address on the route to Docker.")
+	command.PersistentFlags().StringVar(&dockerHostFlag, "docker-host", "", "The address of the Docker daemon. If not specified, the DOCKER_HOST environment variable is used.")
+	command.PersistentFlags().StringVar(&dockerCertFlag, "docker-cert-path", "", "The directory containing the TLS certificates of the Docker daemon. If not specified, the DOCKER_CERT_PATH environment variable is used.")
+	command.PersistentFlags().StringVar(&loadMethodFlag, "load-method", "registry", "How the image is loaded into Docker: 'registry' serves the layers to Docker via a temporary registry, 'tar' streams them via docker load.")
+	command.PersistentFlags().BoolVar(&fromDockerFlag, "from-docker", false, "If specified, the layers of the image already present in Docker are exported from it and seeded, rather than downloaded, e.g. to seed an image that was pulled with docker pull. The layers whose export does not match the blobs of the registry are downloaded, as no torrent is generated for them")
+	command.PersistentFlags().StringVar(&registryAddrFlag, "registry-addr", "localhost:5000", "The address (host:port) on which quayctl's temporary registry listens. Must be reachable by the Docker daemon. A port of 0 picks a free port.")
+	command.PersistentFlags().StringSliceVar(&tagFlags, "tag", []string{}, "If specified, additional name (e.g. myalias or myalias:latest) with which the pulled image is tagged in Docker. Can be repeated.")
+	command.PersistentFlags().StringVar(&spillSizeFlag, "registry-spill-size", "0", "If not 0, size (e.g. 1MB) above which the data served by the temporary registry, such as the manifests, is written to temp files rather than kept in memory, e.g. when loading very large or numerous images")
 }
 
-func (dth dockerTorrentHandler) RetrieveTorrents(image string, insecureFlag bool, option layersOption) ([]torrentInfo, interface{}, error) {
+// daemonConfig returns the configuration of the Docker daemon specified by the flags.
+func daemonConfig() dockerclient.DaemonConfig {
+	return dockerclient.DaemonConfig{
+		Host:     dockerHostFlag,
+		CertPath: dockerCertFlag,
+	}
+}
+
+func (dth dockerTorrentHandler) CheckEngine() error {
+	return dockerclient.Ping(daemonConfig())
+}
+
+func (dth dockerTorrentHandler) RetrieveTorrents(image string, insecureFlag bool, option layersOption, lock dockerdist.Lockfile) ([]torrentInfo, interface{}, error) {
+	if loadMethodFlag != "registry" && loadMethodFlag != "tar" {
+		return []torrentInfo{}, nil, fmt.Errorf("invalid value for --load-method: %v (expected 'registry' or 'tar')", loadMethodFlag)
+	}
+
+	if saveSquashedFlag != "" && !squashedFlag {
+		return []torrentInfo{}, nil, errors.New("--save-squashed requires --squashed")
+	}
+
+	if fromDockerFlag && squashedFlag {
+		return []torrentInfo{}, nil, errors.New("--from-docker cannot be used with --squashed")
+	}
+
+	if verifySquashed && !squashedFlag {
+		return []torrentInfo{}, nil, errors.New("--verify-squashed requires --squashed")
+	}
+
+	if len(tagFlags) > 0 && squashedFlag {
+		return []torrentInfo{}, nil, errors.New("--tag cannot be used with --squashed")
+	}
+
+	if _, err := parseTagFlags(); err != nil {
+		return []torrentInfo{}, nil, err
+	}
+
+	if _, err := humanize.ParseBytes(spillSizeFlag); err != nil {
+		return []torrentInfo{}, nil, fmt.Errorf("invalid value for --registry-spill-size: %v (expected a size, e.g. 1MB)", spillSizeFlag)
+	}
+
 	if squashedFlag {
-		return dth.retrieveTorrentsForSquashed(image, insecureFlag)
+		return dth.retrieveTorrentsForSquashed(image, insecureFlag, lock)
 	}
 
-	return dth.retrieveTorrents(image, insecureFlag, option)
+	return dth.retrieveTorrents(image, insecureFlag, option, lock)
 }
 
-func (dth dockerTorrentHandler) LoadImage(image string, downloadInfo downloadTorrentInfo, ctx interface{}) error {
+func (dth dockerTorrentHandler) LoadImage(image string, downloadInfo downloadTorrentInfo, ctx interface{}) (string, error) {
 	if squashedFlag {
-		return dth.loadSquashedImage(image, downloadInfo, ctx)
+		return "", dth.loadSquashedImage(image, downloadInfo, ctx)
 	}
 
 	return dth.loadImage(image, downloadInfo, ctx)
 }
 
 func (dth dockerTorrentHandler) loadSquashedImage(image string, downloadInfo downloadTorrentInfo, ctx interface{}) error {
-	// Wait for the torrent to complete.
-	<-downloadInfo.CompleteChannel
+	// Wait for the torrent to be downloaded.
+	path, err := downloadInfo.waitForDownload("squashed")
+
+	if downloadInfo.HasProgressBars {
+		downloadInfo.Pool.Stop()
+	}
+
+	if err != nil {
+		return err
+	}
 
 	// Call docker-load on the squashed image.
-	path, _ := downloadInfo.TorrentPaths.Get("squashed")
-	squashedFile, err := os.Open(path.(string))
+	squashedFile, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 
 	defer squashedFile.Close()
 
+	// Check the squashed image before importing it, if requested.
+	if verifySquashed {
+		if err := dth.verifySquashedImage(squashedFile, ctx.(squashedContext), downloadInfo.HTTPClient); err != nil {
+			return err
+		}
+
+		if _, err := squashedFile.Seek(0, os.SEEK_SET); err != nil {
+			return err
+		}
+	}
+
 	log.Println("Importing squashed image")
-	return dockerclient.DockerLoadTar(squashedFile)
+	if err := dockerclient.DockerLoadTar(daemonConfig(), squashedFile); err != nil {
+		return err
+	}
+
+	// Keep a copy of the squashed image, if requested.
+	if saveSquashedFlag != "" {
+		if err := copyFile(path, saveSquashedFlag); err != nil {
+			return fmt.Errorf("Could not save squashed image to %v: %v", saveSquashedFlag, err)
+		}
+
+		log.Printf("Saved squashed image to %v", saveSquashedFlag)
+	}
+
+	return nil
+}
+
+// squashedContext holds the URL of the squashed image and the HTTP headers authorizing its
+// download.
+type squashedContext struct {
+	squashedURL string
+	header      http.Header
+}
+
+// verifySquashedImage logs the digest of the given squashed image, and ensures that it matches the
+// one advertised by the registry in the Docker-Content-Digest header of the squashed image, if any.
+func (dth dockerTorrentHandler) verifySquashedImage(squashedFile *os.File, sctx squashedContext, client *http.Client) error {
+	squashedDigest, err := digest.FromReader(squashedFile)
+	if err != nil {
+		return fmt.Errorf("Could not compute the digest of the squashed image: %v", err)
+	}
+
+	log.Printf("Downloaded squashed image %v has digest %v", squashedFile.Name(), squashedDigest)
+
+	req, err := http.NewRequest("HEAD", sctx.squashedURL, nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range sctx.header {
+		req.Header[name] = values
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Warnf("Could not retrieve the expected digest of the squashed image: %v", err)
+		return nil
+	}
+	resp.Body.Close()
+
+	expectedDigest := resp.Header.Get("Docker-Content-Digest")
+	if resp.StatusCode/100 != 2 || expectedDigest == "" {
+		log.Printf("The registry does not advertise the digest of the squashed image")
+		return nil
+	}
+
+	if digest.Digest(expectedDigest) != squashedDigest {
+		return fmt.Errorf("Squashed image is corrupted: its digest is %v, but the registry expects %v", squashedDigest, expectedDigest)
+	}
+
+	log.Printf("Squashed image matches the digest advertised by the registry")
+	return nil
 }
 
 type dockerContext struct {
@@ -97,20 +237,47 @@ type dockerContext struct {
 	named      reference.Named
 }
 
-func (dth dockerTorrentHandler) loadImage(image string, downloadInfo downloadTorrentInfo, ctx interface{}) error {
+// loadImage loads the layers of the image into Docker, and returns the digest of its manifest.
+func (dth dockerTorrentHandler) loadImage(image string, downloadInfo downloadTorrentInfo, ctx interface{}) (string, error) {
 	dctx := ctx.(dockerContext)
 
 	named := dctx.named
 	v1Manifest := dctx.v1Manifest
 	layers := dctx.layers
 
+	manifestDigest := digest.FromBytes(v1Manifest.Canonical).String()
+
+	// Nothing needs to be loaded if every layer is already present in Docker. The image may then
+	// be known to Docker under another name, so failing to tag it is not fatal.
+	if len(layers) == 0 {
+		if downloadInfo.HasProgressBars {
+			downloadInfo.Pool.Stop()
+		}
+
+		if err := tagLoadedImage(named); err != nil {
+			log.Warnf("Could not apply --tag: %v", err)
+		}
+
+		return manifestDigest, nil
+	}
+
 	// Wait for all layers to be downloaded.
 	blobPaths := map[string]string{}
 	for _, layer := range layers {
 		blobSum := v1Manifest.FSLayers[layer.index].BlobSum.String()
-		<-downloadInfo.DownloadedChannels[blobSum]
-		blobPath, _ := downloadInfo.TorrentPaths.Get(blobSum)
-		blobPaths[blobSum] = blobPath.(string)
+		if _, found := blobPaths[blobSum]; found {
+			continue
+		}
+
+		blobPath, err := downloadInfo.waitForDownload(blobSum)
+		if err != nil {
+			if downloadInfo.HasProgressBars {
+				downloadInfo.Pool.Stop()
+			}
+
+			return "", fmt.Errorf("Could not load layer %v: %v", layer.info.ID, err)
+		}
+		blobPaths[blobSum] = blobPath
 	}
 
 	if downloadInfo.HasProgressBars {
@@ -118,11 +285,65 @@ func (dth dockerTorrentHandler) loadImage(image string, downloadInfo downloadTor
 	}
 
 	// Perform the docker load.
-	return dockerclient.DockerLoad(named, v1Manifest, blobPaths, localIpFlag)
+	var err error
+	if loadMethodFlag == "tar" {
+		err = dockerclient.DockerLoadLayers(daemonConfig(), named, v1Manifest, blobPaths)
+	} else {
+		// The spill size was validated along with the other flags.
+		spillSize, _ := humanize.ParseBytes(spillSizeFlag)
+
+		err = dockerclient.DockerLoad(daemonConfig(), named, v1Manifest, blobPaths, dockerclient.LoadOptions{
+			RegistryAddr:   registryAddrFlag,
+			LocalIP:        localIpFlag,
+			SpillThreshold: int64(spillSize),
+			ProgressSink:   downloadInfo.ProgressSink,
+		})
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if err := tagLoadedImage(named); err != nil {
+		return "", err
+	}
+
+	return manifestDigest, nil
+}
+
+// parseTagFlags parses the additional names of the `--tag` flags, defaulting to the latest tag.
+func parseTagFlags() ([]reference.NamedTagged, error) {
+	var names []reference.NamedTagged
+	for _, tag := range tagFlags {
+		named, err := reference.ParseNamed(tag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for --tag: %v (%v)", tag, err)
+		}
+
+		tagged, ok := reference.WithDefaultTag(named).(reference.NamedTagged)
+		if !ok {
+			return nil, fmt.Errorf("invalid value for --tag: %v (expected a name and an optional tag, not a digest)", tag)
+		}
+
+		names = append(names, tagged)
+	}
+
+	return names, nil
+}
+
+// tagLoadedImage tags the given loaded image with the additional names of the `--tag` flags, if
+// any.
+func tagLoadedImage(named reference.Named) error {
+	names, err := parseTagFlags()
+	if err != nil || len(names) == 0 {
+		return err
+	}
+
+	return dockerclient.TagImage(daemonConfig(), fmt.Sprintf("%s:%s", named.FullName(), dockerdist.TagName(named)), names)
 }
 
 // retrieveTorrentsForSquashed returns the torrent for downloading a squashed Docker image.
-func (dth dockerTorrentHandler) retrieveTorrentsForSquashed(image string, insecureFlag bool) ([]torrentInfo, interface{}, error) {
+func (dth dockerTorrentHandler) retrieveTorrentsForSquashed(image string, insecureFlag bool, lock dockerdist.Lockfile) ([]torrentInfo, interface{}, error) {
 	// Retrieve the credentials (if any) for the current image.
 	credentials, _ := dockerdist.GetAuthCredentials(image)
 
@@ -132,46 +353,73 @@ func (dth dockerTorrentHandler) retrieveTorrentsForSquashed(image string, insecu
 		return []torrentInfo{}, nil, err
 	}
 
-	var tagName = "latest"
-	if tagged, ok := named.(reference.NamedTagged); ok {
-		tagName = tagged.Tag()
+	tagName, err := dth.squashedTagName(named, insecureFlag, lock)
+	if err != nil {
+		return []torrentInfo{}, nil, err
 	}
 
 	// Build the URL for the squashed image.
-	squashedURL := url.URL{
-		Scheme: "https",
-		Host:   named.Hostname(),
-		Path:   fmt.Sprintf("/c1/squash/%s/%s", named.RemoteName(), tagName),
+	squashedURL := registryURL(named, fmt.Sprintf("/c1/squash/%s/%s", named.RemoteName(), tagName), credentials, insecureFlag)
+
+	torrent := torrentInfo{
+		id:          "squashed",
+		torrentPath: squashedURL.String(),
+		title:       fmt.Sprintf("%s/%s:%s.squash", named.Hostname(), named.RemoteName(), tagName),
+		header:      torrentAuthHeader(image, insecureFlag),
 	}
 
-	if insecureFlag {
-		squashedURL.Scheme = "http"
+	return []torrentInfo{torrent}, squashedContext{torrent.torrentPath, torrent.header}, nil
+}
+
+// squashedTagName returns the name of the tag to use when requesting the squashed version of
+// the named image. The squash endpoint only operates on tags, so references by digest are resolved
+// to the tag recorded in their manifest, which must still refer to the same digest.
+func (dth dockerTorrentHandler) squashedTagName(named reference.Named, insecureFlag bool, lock dockerdist.Lockfile) (string, error) {
+	if tagged, ok := named.(reference.NamedTagged); ok {
+		return tagged.Tag(), nil
 	}
 
-	if credentials.Username != "" {
-		squashedURL.User = url.UserPassword(credentials.Username, credentials.Password)
+	canonical, ok := named.(reference.Canonical)
+	if !ok {
+		return dockerdist.TagName(named), nil
 	}
 
-	torrent := torrentInfo{
-		id:          "squashed",
-		torrentPath: squashedURL.String(),
-		title:       fmt.Sprintf("%s/%s:%s.squash", named.Hostname(), named.RemoteName(), tagName),
+	// Retrieve the manifest for the digest, to find its tag.
+	_, _, manifest, err := dockerdist.DownloadManifest(named.String(), insecureFlag, lock)
+	if err != nil {
+		return "", newPullError("Could not download image manifest", err)
+	}
+
+	v1Manifest, ok := manifest.(*schema1.SignedManifest)
+	if !ok || v1Manifest.Tag == "" {
+		return "", fmt.Errorf("Squashed images cannot be pulled by digest: could not find the tag referring to %v", canonical.Digest())
 	}
 
-	return []torrentInfo{torrent}, nil, nil
+	// Ensure the tag still refers to the requested digest, since the squashed image will be
+	// computed from whatever the tag currently points to.
+	tagDigest, err := dockerdist.GetTagDigest(named, v1Manifest.Tag, insecureFlag)
+	if err != nil {
+		return "", newPullError(fmt.Sprintf("Could not resolve tag %v", v1Manifest.Tag), err)
+	}
+
+	if tagDigest != canonical.Digest() {
+		return "", fmt.Errorf("Squashed images cannot be pulled by digest: tag %v no longer refers to %v", v1Manifest.Tag, canonical.Digest())
+	}
+
+	return v1Manifest.Tag, nil
 }
 
 // retrieveTorrents returns the torrents for downloading a Docker image.
-func (dth dockerTorrentHandler) retrieveTorrents(image string, insecureFlag bool, option layersOption) ([]torrentInfo, interface{}, error) {
-	// Retrieve the credentials (if any) for the current image.
-	credentials, _ := dockerdist.GetAuthCredentials(image)
-
+func (dth dockerTorrentHandler) retrieveTorrents(image string, insecureFlag bool, option layersOption, lock dockerdist.Lockfile) ([]torrentInfo, interface{}, error) {
 	// Retrieve the manifest for the image.
-	named, manifest, err := dockerdist.DownloadManifest(image, insecureFlag)
+	named, source, manifest, err := dockerdist.DownloadManifest(image, insecureFlag, lock)
 	if err != nil {
-		return []torrentInfo{}, nil, fmt.Errorf("Could not download image manifest: %v", err)
+		return []torrentInfo{}, nil, newPullError("Could not download image manifest", err)
 	}
 
+	// Retrieve the credentials (if any) for the registry that served the manifest.
+	credentials, _ := dockerdist.GetAuthCredentials(source.String())
+
 	// Ensure that the manifest type is supported.
 	switch manifest.(type) {
 	case *schema1.SignedManifest:
@@ -182,47 +430,159 @@ func (dth dockerTorrentHandler) retrieveTorrents(image string, insecureFlag bool
 	}
 
 	v1Manifest := manifest.(*schema1.SignedManifest)
+	if err := validateV1Manifest(v1Manifest); err != nil {
+		return []torrentInfo{}, nil, fmt.Errorf("Invalid manifest for image %v: %v", image, err)
+	}
+
 	log.Printf("Downloaded manifest for image %v", image)
 
+	// Ensure that the image can run on the Docker daemon before downloading it.
+	if err := checkImagePlatform(v1Manifest); err != nil {
+		return []torrentInfo{}, nil, err
+	}
+
 	// Build the lists of layers and blobs that we need to download.
 	layers, blobs := dth.requiredLayersAndBlobs(v1Manifest, option)
+	dctx := dockerContext{v1Manifest, layers, named}
 	if option == MissingLayers && len(layers) == 0 {
 		log.Printf("All layers already downloaded")
-		return []torrentInfo{}, nil, nil
+		return []torrentInfo{}, dctx, nil
 	}
 
-	// Build the list of torrent URLs, one per file system layer needed for download.
-	dctx := dockerContext{v1Manifest, layers, named}
-	return dth.buildTorrentInfoForBlob(named, blobs, credentials, insecureFlag), dctx, nil
+	// Build the list of torrent URLs, one per file system layer needed for download, from the
+	// registry that served the manifest. The image is still loaded under its own name.
+	header := torrentAuthHeader(source.String(), insecureFlag)
+	torrents := dth.buildTorrentInfoForBlob(source, blobs, credentials, header, insecureFlag)
+
+	// Seed the layers already present in Docker rather than downloading them, if requested.
+	if fromDockerFlag {
+		useDockerBlobs(named.String(), torrents)
+	}
+
+	return torrents, dctx, nil
+}
+
+// torrentAuthHeader returns the HTTP headers authorizing the download of the .torrent files of the
+// given image with a registry token, if the registry uses bearer tokens. Otherwise, the .torrent
+// files are downloaded with the credentials embedded in their URLs.
+func torrentAuthHeader(image string, insecureFlag bool) http.Header {
+	authorization, err := dockerdist.GetAuthorizationHeader(image, insecureFlag)
+	if err != nil {
+		log.Warnf("Could not retrieve registry token, using basic auth for .torrent files: %v", err)
+		return nil
+	}
+
+	if authorization == "" {
+		return nil
+	}
+
+	return http.Header{"Authorization": []string{authorization}}
+}
+
+// validateV1Manifest ensures that the layers of the manifest can be processed, i.e. that there
+// is at least one layer and that each layer has both a blob and an history entry.
+//
+// Even images built from scratch have a layer in their v1 manifest, so a manifest without any
+// layer is malformed.
+func validateV1Manifest(manifest *schema1.SignedManifest) error {
+	if len(manifest.FSLayers) == 0 {
+		return errors.New("the manifest has no layers")
+	}
+
+	if len(manifest.FSLayers) != len(manifest.History) {
+		return fmt.Errorf("the manifest has %d layers but %d history entries", len(manifest.FSLayers), len(manifest.History))
+	}
+
+	return nil
+}
+
+// v1ImageConfig holds the platform of an image, as found in the V1 compatibility information of
+// its top-most layer.
+type v1ImageConfig struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+}
+
+// checkImagePlatform returns an error if the operating system of the image described by the
+// manifest differs from the one of the Docker daemon, as such images cannot be loaded. A different
+// architecture only produces a warning, since the daemon may be able to emulate it.
+func checkImagePlatform(manifest *schema1.SignedManifest) error {
+	var config v1ImageConfig
+	if err := json.Unmarshal([]byte(manifest.History[0].V1Compatibility), &config); err != nil {
+		return fmt.Errorf("Could not parse the configuration of the image: %v", err)
+	}
+
+	if config.Architecture == "" {
+		config.Architecture = manifest.Architecture
+	}
+
+	daemonOS, daemonArch, err := dockerclient.DaemonPlatform(daemonConfig())
+	if err != nil {
+		log.Warnf("Could not determine the platform of the Docker daemon: %v", err)
+		return nil
+	}
+
+	if config.OS != "" && daemonOS != "" && config.OS != daemonOS {
+		return fmt.Errorf("image OS %v does not match daemon OS %v", config.OS, daemonOS)
+	}
+
+	if config.Architecture != "" && daemonArch != "" && config.Architecture != daemonArch {
+		log.Warnf("Image architecture %v does not match daemon architecture %v", config.Architecture, daemonArch)
+	}
+
+	return nil
+}
+
+// registryURL returns the URL of the given path on the registry hosting the named image, with the
+// given credentials (if any).
+// The hostname of the named image includes its port, if any, so registries listening on
+// non-standard ports are supported.
+func registryURL(named reference.Named, path string, credentials types.AuthConfig, insecureFlag bool) url.URL {
+	registryURL := *dockerdist.EndpointURL(named, insecureFlag)
+	registryURL.Path = path
+
+	if credentials.Username != "" {
+		registryURL.User = url.UserPassword(credentials.Username, credentials.Password)
+	}
+
+	return registryURL
 }
 
 // buildTorrentInfoForBlob builds the slice of torrentInfo structs representing each blob sum to be
-// downloaded, along with its torrent URL.
-func (dth dockerTorrentHandler) buildTorrentInfoForBlob(named reference.Named, blobs []schema1.FSLayer, credentials types.AuthConfig, insecureFlag bool) []torrentInfo {
+// downloaded, along with its torrent URL, which BlobSources (if any) may override.
+func (dth dockerTorrentHandler) buildTorrentInfoForBlob(named reference.Named, blobs []schema1.FSLayer, credentials types.AuthConfig, header http.Header, insecureFlag bool) []torrentInfo {
 	blobSet := map[string]struct{}{}
 
 	var torrents = make([]torrentInfo, 0)
 	for _, blob := range blobs {
 		blobSum := blob.BlobSum.String()
-		torrentURL := url.URL{
-			Scheme: "https",
-			Host:   named.Hostname(),
-			Path:   fmt.Sprintf("/c1/torrent/%s/blobs/%s", named.RemoteName(), blobSum),
-		}
+		torrentURL := registryURL(named, fmt.Sprintf("/c1/torrent/%s/blobs/%s", named.RemoteName(), blobSum), credentials, insecureFlag)
 
-		if insecureFlag {
-			torrentURL.Scheme = "http"
+		if _, found := blobSet[blobSum]; found {
+			continue
 		}
 
-		if credentials.Username != "" {
-			torrentURL.User = url.UserPassword(credentials.Username, credentials.Password)
+		blobDigest := blob.BlobSum
+		torrent := torrentInfo{
+			id:          blobSum,
+			torrentPath: torrentURL.String(),
+			title:       blobSum,
+			header:      header,
+			registryDownload: func(w io.Writer) error {
+				return dockerdist.DownloadBlob(named, blobDigest, insecureFlag, w)
+			},
 		}
 
-		if _, found := blobSet[blobSum]; found {
-			continue
+		// Use the alternative source of the blob, if any. The registry credentials are not sent
+		// to it.
+		if BlobSources != nil {
+			if source, found := BlobSources.ResolveBlobSource(blobSum); found {
+				torrent.torrentPath = source
+				torrent.header = nil
+			}
 		}
 
-		torrents = append(torrents, torrentInfo{blobSum, torrentURL.String(), blobSum})
+		torrents = append(torrents, torrent)
 		blobSet[blobSum] = struct{}{}
 	}
 
@@ -263,7 +623,7 @@ func (dth dockerTorrentHandler) requiredLayersAndBlobs(manifest *schema1.SignedM
 	// Check each layer for its existance in Docker.
 	var blobsToDownload = make([]schema1.FSLayer, 0)
 	for index := range manifest.History {
-		found, _ := dockerclient.HasImage(manifest.FSLayers[index].BlobSum.String())
+		found, _ := dockerclient.HasImage(daemonConfig(), manifest.FSLayers[index].BlobSum.String())
 		if found {
 			return dth.loadLayerInfo(manifest.History[0:index]), blobsToDownload
 		}
@@ -0,0 +1,89 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/docker/reference"
+)
+
+// emptyLayerBlobSum is the digest of the empty layer, the only layer of the images built from
+// scratch.
+const emptyLayerBlobSum = "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+
+// scratchManifest returns the v1 manifest of an image built from scratch.
+func scratchManifest() *schema1.SignedManifest {
+	manifest := &schema1.SignedManifest{Canonical: []byte(`{"name": "coreos/scratch", "tag": "latest"}`)}
+	manifest.FSLayers = []schema1.FSLayer{{BlobSum: emptyLayerBlobSum}}
+	manifest.History = []schema1.History{{V1Compatibility: `{"id": "5b3d3c5ccf3b21c8d8a2e0b6a1e1f7a0c0b8d6f3e1d2c4b5a69788796a5b4c3d", "os": "linux", "architecture": "amd64"}`}}
+	return manifest
+}
+
+func TestValidateV1Manifest(t *testing.T) {
+	noLayers := scratchManifest()
+	noLayers.FSLayers, noLayers.History = nil, nil
+
+	missingHistory := scratchManifest()
+	missingHistory.History = nil
+
+	tests := []struct {
+		name        string
+		manifest    *schema1.SignedManifest
+		expectError bool
+	}{
+		{"scratch image", scratchManifest(), false},
+		{"no layers", noLayers, true},
+		{"layer without history", missingHistory, true},
+	}
+
+	for _, test := range tests {
+		err := validateV1Manifest(test.manifest)
+		if test.expectError && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+	}
+}
+
+func TestScratchImage(t *testing.T) {
+	var dth dockerTorrentHandler
+	manifest := scratchManifest()
+
+	// The empty layer of the image is downloaded like any other layer.
+	layers, blobs := dth.requiredLayersAndBlobs(manifest, AllLayers)
+	if len(layers) != 1 || len(blobs) != 1 || blobs[0].BlobSum != emptyLayerBlobSum {
+		t.Fatalf("got %d layers and blobs %v, expected the empty layer", len(layers), blobs)
+	}
+
+	// Once the empty layer is present in Docker, there is nothing left to download nor to load.
+	named, err := reference.ParseNamed("quay.io/coreos/scratch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := dockerContext{v1Manifest: manifest, named: named}
+	manifestDigest, err := dth.loadImage(named.String(), downloadTorrentInfo{}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := digest.FromBytes(manifest.Canonical).String(); manifestDigest != expected {
+		t.Errorf("got manifest digest %v, expected %v", manifestDigest, expected)
+	}
+}
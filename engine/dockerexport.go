@@ -0,0 +1,141 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/digest"
+
+	"github.com/coreos/quayctl/dockerclient"
+)
+
+// dockerBlobsFolder is the name of the folder, within the temp directory, to which the layers
+// exported from Docker are written until they are moved into the torrent folder.
+const dockerBlobsFolder = "quayctl-docker-blobs"
+
+// useDockerBlobs exports the given image from Docker and sets the local path of each torrent
+// whose blob can be reproduced from it, so that it is seeded without being downloaded. The other
+// torrents are downloaded as usual.
+func useDockerBlobs(image string, torrents []torrentInfo) {
+	ids := make(map[digest.Digest]struct{}, len(torrents))
+	for _, torrent := range torrents {
+		ids[digest.Digest(torrent.id)] = struct{}{}
+	}
+
+	blobPaths, err := exportDockerBlobs(image, ids)
+	if err != nil {
+		log.Warnf("Could not export image %v from Docker, downloading its layers: %v", image, err)
+		return
+	}
+
+	for index := range torrents {
+		if blobPath, found := blobPaths[digest.Digest(torrents[index].id)]; found {
+			torrents[index].localPath = blobPath
+		}
+	}
+
+	log.Printf("Found %d of %d layers of image %v in Docker", len(blobPaths), len(torrents), image)
+}
+
+// exportDockerBlobs exports the given image from Docker, compresses each of its layers and returns
+// the paths of those that match one of the given blob digests.
+//
+// Docker only keeps the uncompressed layers, so the layers that were not compressed the same way
+// when they were pushed cannot be reproduced, and are left out.
+func exportDockerBlobs(image string, blobDigests map[digest.Digest]struct{}) (map[digest.Digest]string, error) {
+	folder := filepath.Join(os.TempDir(), dockerBlobsFolder)
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return nil, err
+	}
+
+	reader, writer := io.Pipe()
+	defer reader.Close()
+
+	go func() {
+		writer.CloseWithError(dockerclient.DockerSave(daemonConfig(), image, writer))
+	}()
+
+	blobPaths := map[digest.Digest]string{}
+	removeBlobs := func() {
+		for _, blobPath := range blobPaths {
+			os.Remove(blobPath)
+		}
+	}
+
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			removeBlobs()
+			return nil, err
+		}
+
+		if path.Base(header.Name) != "layer.tar" {
+			continue
+		}
+
+		blobPath, blobDigest, err := compressLayer(archive, folder)
+		if err != nil {
+			removeBlobs()
+			return nil, err
+		}
+
+		_, wanted := blobDigests[blobDigest]
+		if _, found := blobPaths[blobDigest]; !wanted || found {
+			os.Remove(blobPath)
+			continue
+		}
+
+		blobPaths[blobDigest] = blobPath
+	}
+
+	return blobPaths, nil
+}
+
+// compressLayer gzips the given uncompressed layer into a temp file of the given folder, and
+// returns its path and digest.
+func compressLayer(layer io.Reader, folder string) (string, digest.Digest, error) {
+	f, err := ioutil.TempFile(folder, "blob")
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	digester := digest.Canonical.New()
+	gzipWriter := gzip.NewWriter(io.MultiWriter(f, digester.Hash()))
+	if _, err := io.Copy(gzipWriter, layer); err != nil {
+		os.Remove(f.Name())
+		return "", "", err
+	}
+
+	if err := gzipWriter.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", "", err
+	}
+
+	return f.Name(), digester.Digest(), nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/api/v2"
+
+	"github.com/coreos/quayctl/bittorrent"
+	"github.com/coreos/quayctl/dockerdist"
+)
+
+// FailureKind is the category of the failure of a pull, which tells e.g. an image that does not
+// exist from a network error worth retrying.
+type FailureKind int
+
+const (
+	// UnknownFailure is any failure that does not fall in the other categories.
+	UnknownFailure FailureKind = iota
+
+	// AuthFailure means that the credentials were missing or refused by the registry.
+	AuthFailure
+
+	// ImageNotFoundFailure means that the image, or its tag, does not exist.
+	ImageNotFoundFailure
+
+	// NetworkFailure means that the registry could not be reached, or that the layers could not
+	// be downloaded.
+	NetworkFailure
+
+	// LoadFailure means that the downloaded image could not be loaded into the container engine.
+	LoadFailure
+
+	// TimeoutFailure means that the pull did not complete within its timeout.
+	TimeoutFailure
+)
+
+// PullError is an error returned by Pull, along with the category of the failure.
+type PullError struct {
+	Kind FailureKind
+	Err  error
+}
+
+func (e *PullError) Error() string {
+	return e.Err.Error()
+}
+
+// FailureKindOf returns the category of the failure described by the given error: that of a
+// PullError, or UnknownFailure for any other error.
+func FailureKindOf(err error) FailureKind {
+	if pullErr, ok := err.(*PullError); ok {
+		return pullErr.Kind
+	}
+
+	return UnknownFailure
+}
+
+// newPullError returns an error made of the given message followed by the given underlying error,
+// whose failure category is kept.
+func newPullError(message string, err error) error {
+	return &PullError{Kind: failureKind(err), Err: fmt.Errorf("%s: %v", message, err)}
+}
+
+// failureKind returns the failure category of the given error, as returned by the registries,
+// their HTTP clients or the helpers of this package.
+func failureKind(err error) FailureKind {
+	switch err := err.(type) {
+	case *PullError:
+		return err.Kind
+
+	case errcode.Errors:
+		for _, e := range err {
+			if kind := failureKind(e); kind != UnknownFailure {
+				return kind
+			}
+		}
+
+	case errcode.Error:
+		switch err.Code {
+		case errcode.ErrorCodeUnauthorized, errcode.ErrorCodeDenied:
+			return AuthFailure
+		case v2.ErrorCodeNameUnknown, v2.ErrorCodeManifestUnknown:
+			return ImageNotFoundFailure
+		}
+
+	case net.Error:
+		return NetworkFailure
+	}
+
+	if err == dockerdist.ErrTagUnavailable {
+		return ImageNotFoundFailure
+	}
+
+	return UnknownFailure
+}
+
+// httpStatusFailureKind returns the failure category of an HTTP request that got the given status
+// code.
+func httpStatusFailureKind(statusCode int) FailureKind {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return AuthFailure
+	case statusCode == http.StatusNotFound:
+		return ImageNotFoundFailure
+	case statusCode/100 == 5:
+		return NetworkFailure
+	}
+
+	return UnknownFailure
+}
+
+// torrentFailureKind returns the failure category of the given error, met while downloading a
+// torrent. The .torrent files refused or not found by their server are categorized by their status
+// code, while those that could not be reached are network failures.
+func torrentFailureKind(err error) FailureKind {
+	if err == bittorrent.ErrTorrentNotFound {
+		return httpStatusFailureKind(http.StatusNotFound)
+	}
+
+	if torrentFileErr, ok := err.(*bittorrent.TorrentFileError); ok {
+		if torrentFileErr.StatusCode == 0 {
+			return NetworkFailure
+		}
+
+		return httpStatusFailureKind(torrentFileErr.StatusCode)
+	}
+
+	return failureKind(err)
+}
@@ -0,0 +1,46 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coreos/quayctl/bittorrent"
+)
+
+func TestTorrentFailureKind(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected FailureKind
+	}{
+		{"not found", bittorrent.ErrTorrentNotFound, ImageNotFoundFailure},
+		{"unauthorized", &bittorrent.TorrentFileError{StatusCode: 401}, AuthFailure},
+		{"forbidden", &bittorrent.TorrentFileError{StatusCode: 403}, AuthFailure},
+		{"server error", &bittorrent.TorrentFileError{StatusCode: 503}, NetworkFailure},
+		{"unreachable", &bittorrent.TorrentFileError{}, NetworkFailure},
+		{"timeout", &bittorrent.TorrentFileError{Timeout: time.Minute}, NetworkFailure},
+		{"no torrent endpoint", &PullError{Kind: ImageNotFoundFailure, Err: noTorrentEndpointError("https://registry.example.com/c1/torrent", false)}, ImageNotFoundFailure},
+		{"other", errors.New("Torrent download cancelled"), UnknownFailure},
+	}
+
+	for _, test := range tests {
+		if kind := torrentFailureKind(test.err); kind != test.expected {
+			t.Errorf("%s: got failure kind %v, expected %v", test.name, kind, test.expected)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	distlib "github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+
+	"github.com/coreos/quayctl/dockerdist"
+)
+
+// FetchBlobs downloads via torrent every blob referenced by the manifest of the given reference,
+// and writes them to outputDir, without loading anything into a container engine. This allows
+// fetching any artifact stored in the registry, whether or not it is a runnable image.
+//
+// The manifest is written to outputDir/manifest.json and each blob to
+// outputDir/<algorithm>/<hex>, e.g. outputDir/sha256/4a5b...
+//
+// The blobs are downloaded with the given options, but never seeded. Closing the stop channel (if
+// not nil) stops the downloads, keeping the partially downloaded data, and makes FetchBlobs return
+// ErrStopped.
+func FetchBlobs(ref, outputDir string, insecureFlag bool, opts DownloadOptions, stop <-chan struct{}) error {
+	// Retrieve the manifest for the reference.
+	_, source, manifest, err := dockerdist.DownloadManifest(ref, insecureFlag, nil)
+	if err != nil {
+		return fmt.Errorf("Could not download manifest: %v", err)
+	}
+
+	// Retrieve the credentials (if any) for the registry that served the manifest.
+	credentials, _ := dockerdist.GetAuthCredentials(source.String())
+
+	blobs, err := referencedBlobs(manifest)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(outputDir, "manifest.json"), payload, 0644); err != nil {
+		return fmt.Errorf("Could not write manifest: %v", err)
+	}
+
+	if len(blobs) == 0 {
+		return nil
+	}
+
+	// Download the blobs, using the same torrents as the image layers.
+	fsLayers := make([]schema1.FSLayer, 0, len(blobs))
+	for _, blob := range blobs {
+		fsLayers = append(fsLayers, schema1.FSLayer{BlobSum: blob})
+	}
+
+	header := torrentAuthHeader(source.String(), insecureFlag)
+	torrents := dockerTorrentHandler{}.buildTorrentInfoForBlob(source, fsLayers, credentials, header, insecureFlag)
+
+	// Download the configuration blob of schema2 manifests first, as it is tiny but required to
+	// use the image, and record the sizes of their blobs.
+	if m, ok := manifest.(*schema2.DeserializedManifest); ok {
+		sizes := map[string]int64{}
+		for _, descriptor := range append([]distlib.Descriptor{m.Target()}, m.References()...) {
+			sizes[descriptor.Digest.String()] = descriptor.Size
+		}
+
+		for index := range torrents {
+			if torrents[index].id == m.Target().Digest.String() {
+				torrents[index].highPriority = true
+			}
+			torrents[index].size = sizes[torrents[index].id]
+		}
+	}
+
+	opts.Seed = false
+	downloadInfo := DownloadTorrents(torrents, opts)
+	defer downloadInfo.Release()
+
+	go func() {
+		select {
+		case <-stop:
+			downloadInfo.Stop()
+		case <-downloadInfo.CompleteChannel:
+		}
+	}()
+
+	blobPaths := make(map[digest.Digest]string, len(blobs))
+	for _, blob := range blobs {
+		blobPath, err := downloadInfo.waitForDownload(blob.String())
+		if err != nil {
+			downloadInfo.Stop()
+			return downloadInfo.Wait()
+		}
+		blobPaths[blob] = blobPath
+	}
+
+	if downloadInfo.HasProgressBars {
+		downloadInfo.Pool.Stop()
+	}
+
+	// Write the blobs to the output directory.
+	for _, blob := range blobs {
+		outputPath := filepath.Join(outputDir, string(blob.Algorithm()), blob.Hex())
+		if err := copyFile(blobPaths[blob], outputPath); err != nil {
+			return fmt.Errorf("Could not write blob %v: %v", blob, err)
+		}
+
+		log.Printf("Wrote blob %v", outputPath)
+	}
+
+	return downloadInfo.Wait()
+}
+
+// referencedBlobs returns the distinct digests of the blobs referenced by the given manifest,
+// including the configuration blob of schema2 manifests.
+func referencedBlobs(manifest distlib.Manifest) ([]digest.Digest, error) {
+	var descriptors []distlib.Descriptor
+	switch m := manifest.(type) {
+	case *schema1.SignedManifest:
+		descriptors = m.References()
+
+	case *schema2.DeserializedManifest:
+		descriptors = append([]distlib.Descriptor{m.Target()}, m.References()...)
+
+	case *manifestlist.DeserializedManifestList:
+		return nil, errors.New("manifest lists are not supported: fetch one of the manifests of the list by digest instead")
+
+	default:
+		return nil, errors.New("unsupported manifest type")
+	}
+
+	blobSet := map[digest.Digest]struct{}{}
+	blobs := make([]digest.Digest, 0, len(descriptors))
+	for _, descriptor := range descriptors {
+		if _, found := blobSet[descriptor.Digest]; found {
+			continue
+		}
+
+		blobs = append(blobs, descriptor.Digest)
+		blobSet[descriptor.Digest] = struct{}{}
+	}
+
+	return blobs, nil
+}
+
+// copyFile copies the file found at sourcePath to destinationPath, creating its parent directory
+// if necessary.
+func copyFile(sourcePath, destinationPath string) error {
+	if err := os.MkdirAll(filepath.Dir(destinationPath), 0755); err != nil {
+		return err
+	}
+
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.Create(destinationPath)
+	if err != nil {
+		return err
+	}
+	defer destination.Close()
+
+	_, err = io.Copy(destination, source)
+	return err
+}
@@ -0,0 +1,125 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/streamrail/concurrent-map"
+
+	"github.com/coreos/quayctl/bittorrent"
+)
+
+// metric describes a metric exposed by the metrics server.
+type metric struct {
+	name       string
+	help       string
+	metricType string
+}
+
+var (
+	torrentDownloadedBytesMetric = metric{"quayctl_torrent_downloaded_bytes_total", "Number of bytes downloaded for the torrent.", "counter"}
+	torrentUploadedBytesMetric   = metric{"quayctl_torrent_uploaded_bytes_total", "Number of bytes uploaded for the torrent.", "counter"}
+	torrentPeersMetric           = metric{"quayctl_torrent_peers", "Number of peers connected for the torrent.", "gauge"}
+	torrentSeedsMetric           = metric{"quayctl_torrent_seeds", "Number of seeds connected for the torrent.", "gauge"}
+	torrentRatioMetric           = metric{"quayctl_torrent_ratio", "Ratio of uploaded to downloaded bytes for the torrent.", "gauge"}
+	downloadedBytesMetric        = metric{"quayctl_downloaded_bytes_total", "Number of bytes downloaded by the client.", "counter"}
+	uploadedBytesMetric          = metric{"quayctl_uploaded_bytes_total", "Number of bytes uploaded by the client.", "counter"}
+	downloadRateMetric           = metric{"quayctl_download_rate_bytes", "Current download rate of the client, in bytes/s.", "gauge"}
+	uploadRateMetric             = metric{"quayctl_upload_rate_bytes", "Current upload rate of the client, in bytes/s.", "gauge"}
+	peersMetric                  = metric{"quayctl_peers", "Number of peers connected to the client.", "gauge"}
+)
+
+// startMetricsServer starts an HTTP server listening on the given address, which exposes the
+// metrics of the given client and torrents in the Prometheus text format under /metrics.
+//
+// The server runs until the returned listener is closed.
+func startMetricsServer(addr string, bt *bittorrent.Client, torrents []torrentInfo, sources cmap.ConcurrentMap) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Could not start metrics server: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(renderMetrics(bt, torrents, sources))
+	})
+
+	// Serve returns an error once the listener is closed, which is expected.
+	go http.Serve(ln, mux)
+
+	return ln, nil
+}
+
+// renderMetrics returns the metrics of the given client and torrents in the Prometheus text
+// format.
+func renderMetrics(bt *bittorrent.Client, torrents []torrentInfo, sources cmap.ConcurrentMap) []byte {
+	// Retrieve the status of the torrents which are still active.
+	statuses := map[string]bittorrent.Status{}
+	for _, torrent := range torrents {
+		if status, err := bt.GetStatus(torrentSource(torrent, sources)); err == nil {
+			statuses[torrent.id] = status
+		}
+	}
+
+	var buf bytes.Buffer
+	writeTorrentMetric := func(m metric, value func(bittorrent.Status) interface{}) {
+		writeMetricHeader(&buf, m)
+		for _, torrent := range torrents {
+			if status, found := statuses[torrent.id]; found {
+				fmt.Fprintf(&buf, "%s{torrent=%q} %v\n", m.name, torrent.id, value(status))
+			}
+		}
+	}
+
+	writeTorrentMetric(torrentDownloadedBytesMetric, func(s bittorrent.Status) interface{} { return s.TotalDownload })
+	writeTorrentMetric(torrentUploadedBytesMetric, func(s bittorrent.Status) interface{} { return s.TotalUpload })
+	writeTorrentMetric(torrentPeersMetric, func(s bittorrent.Status) interface{} { return s.NumPeers })
+	writeTorrentMetric(torrentSeedsMetric, func(s bittorrent.Status) interface{} { return s.NumSeeds })
+	writeTorrentMetric(torrentRatioMetric, func(s bittorrent.Status) interface{} {
+		if s.TotalDownload == 0 {
+			return 0
+		}
+		return float64(s.TotalUpload) / float64(s.TotalDownload)
+	})
+
+	sessionStatus, err := bt.GetSessionStatus()
+	if err != nil {
+		return buf.Bytes()
+	}
+
+	writeSessionMetric := func(m metric, value interface{}) {
+		writeMetricHeader(&buf, m)
+		fmt.Fprintf(&buf, "%s %v\n", m.name, value)
+	}
+
+	writeSessionMetric(downloadedBytesMetric, sessionStatus.TotalDownload)
+	writeSessionMetric(uploadedBytesMetric, sessionStatus.TotalUpload)
+	writeSessionMetric(downloadRateMetric, int64(sessionStatus.DownloadRate*1024))
+	writeSessionMetric(uploadRateMetric, int64(sessionStatus.UploadRate*1024))
+	writeSessionMetric(peersMetric, sessionStatus.NumPeers)
+
+	return buf.Bytes()
+}
+
+// writeMetricHeader writes the HELP and TYPE lines of the given metric.
+func writeMetricHeader(buf *bytes.Buffer, m metric) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", m.name, m.metricType)
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// BlobSourceResolver provides alternative sources for the blobs of Docker images, e.g. to download
+// them from a local mirror rather than from the registry.
+type BlobSourceResolver interface {
+	// ResolveBlobSource returns the torrent path (URL, magnet link or local file) from which the
+	// blob with the given blobSum is downloaded, if it is overridden.
+	ResolveBlobSource(blobSum string) (string, bool)
+}
+
+// BlobSources, if not nil, is consulted for each blob to download: the torrent path it returns,
+// if any, is used instead of the one served by the registry.
+var BlobSources BlobSourceResolver
+
+// MirrorManifest is a BlobSourceResolver mapping blobSums to the torrent paths from which they are
+// downloaded. It is encoded as a JSON object, e.g.
+// {"sha256:4a5b...": "https://cdn.example.com/4a5b.torrent"}.
+type MirrorManifest map[string]string
+
+// ResolveBlobSource implements BlobSourceResolver.
+func (m MirrorManifest) ResolveBlobSource(blobSum string) (string, bool) {
+	source, found := m[blobSum]
+	return source, found && source != ""
+}
+
+// LoadMirrorManifest reads the mirror manifest found at the given location, which is either an
+// HTTP(S) URL, downloaded with the given client, or a local file path.
+func LoadMirrorManifest(location string, client *http.Client) (MirrorManifest, error) {
+	var r io.Reader
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		resp, err := client.Get(location)
+		if err != nil {
+			return nil, fmt.Errorf("Could not download mirror manifest: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Could not download mirror manifest: got %v from %v", resp.StatusCode, location)
+		}
+
+		r = resp.Body
+	} else {
+		f, err := os.Open(location)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read mirror manifest: %v", err)
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	var manifest MirrorManifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("Could not parse mirror manifest %v: %v", location, err)
+	}
+
+	return manifest, nil
+}
@@ -0,0 +1,241 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema1"
+)
+
+const (
+	ociLayoutVersion     = "1.0.0"
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+	ociSchemaVersion     = 2
+)
+
+// ociDescriptor describes a blob of an OCI image layout.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      digest.Digest     `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest is an OCI image manifest.
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// ociIndex is the index of an OCI image layout, referencing its manifests.
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// v1LayerHistory holds the fields of the V1 compatibility information of a layer that make up the
+// history of the image.
+type v1LayerHistory struct {
+	Created         time.Time `json:"created"`
+	Author          string    `json:"author,omitempty"`
+	Comment         string    `json:"comment,omitempty"`
+	ThrowAway       bool      `json:"throwaway,omitempty"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd"`
+	} `json:"container_config"`
+}
+
+// ociHistory is an entry of the history of an OCI image configuration.
+type ociHistory struct {
+	Created    time.Time `json:"created"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	Author     string    `json:"author,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+}
+
+// v1OnlyFields are the fields of the V1 compatibility information that are specific to the layer
+// rather than to the image, and are therefore not part of the OCI image configuration.
+var v1OnlyFields = []string{"id", "parent", "parent_id", "layer_id", "throwaway", "Size"}
+
+// writeOCILayout writes the image described by the given schema1 manifest, whose downloaded blobs
+// are found at the given paths, as an OCI image layout in the given folder, referenced by the
+// given tag. The blobs are hard-linked into the layout, or copied if they are on a different file
+// system. It returns the digest of the OCI manifest.
+func writeOCILayout(layoutPath, tagName string, manifest *schema1.SignedManifest, blobPaths map[string]string) (digest.Digest, error) {
+	// Add the layers, from the bottom-most one, skipping the empty layers of metadata-only
+	// instructions.
+	var layers []ociDescriptor
+	var diffIDs []digest.Digest
+	var history []ociHistory
+	for index := len(manifest.History) - 1; index >= 0; index-- {
+		var v1History v1LayerHistory
+		if err := json.Unmarshal([]byte(manifest.History[index].V1Compatibility), &v1History); err != nil {
+			return "", err
+		}
+
+		history = append(history, ociHistory{
+			Created:    v1History.Created,
+			CreatedBy:  strings.Join(v1History.ContainerConfig.Cmd, " "),
+			Author:     v1History.Author,
+			Comment:    v1History.Comment,
+			EmptyLayer: v1History.ThrowAway,
+		})
+
+		if v1History.ThrowAway {
+			continue
+		}
+
+		blobSum := manifest.FSLayers[index].BlobSum
+		blobPath := blobPaths[blobSum.String()]
+
+		diffID, err := layerDiffID(blobPath)
+		if err != nil {
+			return "", err
+		}
+
+		stat, err := os.Stat(blobPath)
+		if err != nil {
+			return "", err
+		}
+
+		if err := linkOCIBlob(layoutPath, blobSum, blobPath); err != nil {
+			return "", err
+		}
+
+		layers = append(layers, ociDescriptor{MediaType: ociLayerMediaType, Digest: blobSum, Size: stat.Size()})
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	// Convert the V1 compatibility information of the top-most layer into the image configuration.
+	var config map[string]interface{}
+	if err := json.Unmarshal([]byte(manifest.History[0].V1Compatibility), &config); err != nil {
+		return "", err
+	}
+
+	for _, field := range v1OnlyFields {
+		delete(config, field)
+	}
+
+	config["rootfs"] = map[string]interface{}{"type": "layers", "diff_ids": diffIDs}
+	config["history"] = history
+
+	configDescriptor, err := writeOCIJSON(layoutPath, ociConfigMediaType, config)
+	if err != nil {
+		return "", err
+	}
+
+	manifestDescriptor, err := writeOCIJSON(layoutPath, ociManifestMediaType, ociManifest{
+		SchemaVersion: ociSchemaVersion,
+		Config:        configDescriptor,
+		Layers:        layers,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Reference the manifest from the index of the layout.
+	manifestDescriptor.Annotations = map[string]string{ociRefNameAnnotation: tagName}
+	index, err := json.Marshal(ociIndex{SchemaVersion: ociSchemaVersion, Manifests: []ociDescriptor{manifestDescriptor}})
+	if err != nil {
+		return "", err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(layoutPath, "index.json"), index, 0644); err != nil {
+		return "", err
+	}
+
+	layout := []byte(`{"imageLayoutVersion": "` + ociLayoutVersion + `"}`)
+	if err := ioutil.WriteFile(filepath.Join(layoutPath, "oci-layout"), layout, 0644); err != nil {
+		return "", err
+	}
+
+	return manifestDescriptor.Digest, nil
+}
+
+// ociBlobPath returns the path of the blob with the given digest in the given OCI image layout.
+func ociBlobPath(layoutPath string, blobDigest digest.Digest) string {
+	return filepath.Join(layoutPath, "blobs", string(blobDigest.Algorithm()), blobDigest.Hex())
+}
+
+// linkOCIBlob adds the blob with the given digest, found at the given path, to the given OCI image
+// layout.
+func linkOCIBlob(layoutPath string, blobDigest digest.Digest, blobPath string) error {
+	targetPath := ociBlobPath(layoutPath, blobDigest)
+	if _, err := os.Stat(targetPath); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Link(blobPath, targetPath); err == nil {
+		return nil
+	}
+
+	return copyFile(blobPath, targetPath)
+}
+
+// writeOCIJSON adds the given value, encoded in JSON, as a blob of the given media type to the
+// given OCI image layout, and returns its descriptor.
+func writeOCIJSON(layoutPath, mediaType string, v interface{}) (ociDescriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+
+	blobDigest := digest.FromBytes(data)
+	targetPath := ociBlobPath(layoutPath, blobDigest)
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return ociDescriptor{}, err
+	}
+
+	if err := ioutil.WriteFile(targetPath, data, 0644); err != nil {
+		return ociDescriptor{}, err
+	}
+
+	return ociDescriptor{MediaType: mediaType, Digest: blobDigest, Size: int64(len(data))}, nil
+}
+
+// layerDiffID returns the digest of the uncompressed content of the layer blob found at the given
+// path, which identifies the layer in the image configuration.
+func layerDiffID(blobPath string) (digest.Digest, error) {
+	blobFile, err := os.Open(blobPath)
+	if err != nil {
+		return "", err
+	}
+	defer blobFile.Close()
+
+	uncompressed, err := gzip.NewReader(blobFile)
+	if err != nil {
+		return "", err
+	}
+	defer uncompressed.Close()
+
+	return digest.Canonical.FromReader(uncompressed)
+}
@@ -0,0 +1,124 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/quayctl/dockerclient"
+)
+
+// progressEventInterval defines the time between each progress event of a torrent.
+const progressEventInterval = time.Second
+
+// progressServer sends the progress events of the torrents to the connected clients.
+type progressServer struct {
+	net.Listener
+
+	lock    sync.Mutex
+	clients map[chan []byte]struct{}
+}
+
+// startProgressServer starts an HTTP server listening on the given address, which streams the
+// progress events broadcast to it as Server-Sent Events under /events, one JSON object per event,
+// in the same form as the JSON progress mode.
+//
+// The server runs until it is closed.
+func startProgressServer(addr string) (*progressServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Could not start progress server: %v", err)
+	}
+
+	server := &progressServer{Listener: ln, clients: map[chan []byte]struct{}{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", server.serveEvents)
+
+	// Serve returns an error once the listener is closed, which is expected.
+	go http.Serve(ln, mux)
+
+	return server, nil
+}
+
+// serveEvents streams the progress events to the client until it disconnects.
+func (s *progressServer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Events are dropped rather than blocking the broadcast when the client lags behind.
+	events := make(chan []byte, 64)
+	s.lock.Lock()
+	s.clients[events] = struct{}{}
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.clients, events)
+		s.lock.Unlock()
+	}()
+
+	// The dashboard consuming the events is usually served from another origin.
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case event := <-events:
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", event); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// broadcast sends the given progress events to every connected client.
+func (s *progressServer) broadcast(events []dockerclient.ProgressEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.clients) == 0 {
+		return
+	}
+
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+
+		for client := range s.clients {
+			select {
+			case client <- data:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"errors"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/quayctl/dockerdist"
+)
+
+// PullOptions holds the options of a pull performed by Pull.
+type PullOptions struct {
+	// Engine is the container engine into which the image is loaded.
+	Engine ContainerEngine
+
+	// Insecure specifies that HTTP is used in place of HTTPS to talk to the registry.
+	Insecure bool
+
+	// Layers specifies which layers of the image are pulled: AllLayers or MissingLayers.
+	Layers layersOption
+
+	// Lock, if not nil, is the lockfile against which the manifest of the image is verified.
+	// Images missing from it cannot be pulled.
+	Lock dockerdist.Lockfile
+
+	// DownloadOptions configure the downloads of the layers, and their seeding once the image has
+	// been pulled, if Seed is set.
+	DownloadOptions
+
+	// Stop, if not nil, stops the pull, or the seeding that follows it, once closed.
+	Stop <-chan struct{}
+
+	// OnPulled is called (if not nil) once the image has been loaded, before seeding, with the
+	// digest (or ID) identifying the loaded image. The pull fails if it returns an error.
+	OnPulled func(digest string) error
+}
+
+// pullResult holds the outcome of the loading of an image by Pull.
+type pullResult struct {
+	digest       string
+	downloadInfo downloadTorrentInfo
+	err          error
+}
+
+// Pull downloads the given image via BitTorrent and loads it into the container engine specified
+// by the options. The failure of the download of a layer makes it return an error, rather than
+// exit.
+//
+// The context bounds the pull itself: if it is done before the image is loaded, the downloads are
+// aborted, removing the partially downloaded data, and its error is returned, as a PullError of
+// kind TimeoutFailure if its deadline has passed. Once the image has been loaded, the seeding (if
+// any) lasts for the seed duration of the options.
+//
+// Closing the Stop channel of the options, or sending a stop request to the control socket, stops
+// the pull or the seeding at any step, keeping the partially downloaded data so that a later pull
+// resumes it, and makes Pull return ErrStopped.
+func Pull(ctx context.Context, image string, opts PullOptions) error {
+	if opts.Engine == nil {
+		return errors.New("No container engine specified")
+	}
+
+	handler := opts.Engine.TorrentHandler()
+
+	// Pull the image in the background, so that the context can interrupt it at any step.
+	var interruptLock sync.Mutex
+	var downloads *downloadTorrentInfo
+	var interrupted bool
+
+	pulled := make(chan pullResult, 1)
+	go func() {
+		// Ensure the image can be loaded once downloaded.
+		if err := handler.CheckEngine(); err != nil {
+			pulled <- pullResult{err: &PullError{Kind: LoadFailure, Err: err}}
+			return
+		}
+
+		// Load the torrents for the image.
+		torrents, engineCtx, err := handler.RetrieveTorrents(image, opts.Insecure, opts.Layers, opts.Lock)
+		if err != nil {
+			pulled <- pullResult{err: err}
+			return
+		}
+
+		// Download the image layer(s), unless the pull has been interrupted in the meantime.
+		interruptLock.Lock()
+		if interrupted {
+			interruptLock.Unlock()
+			removeLocalContent(torrents)
+			return
+		}
+
+		downloadInfo := DownloadTorrents(torrents, opts.DownloadOptions)
+		downloads = &downloadInfo
+		interruptLock.Unlock()
+
+		// Load the image, and then release the downloaded layers, which can be evicted or pruned
+		// from then on. If the torrent ops ended beforehand, e.g. because the download of a layer
+		// failed, their error is the cause of the failure.
+		digest, err := handler.LoadImage(image, downloadInfo, engineCtx)
+		downloadInfo.Release()
+		if err != nil {
+			if isClosed(downloadInfo.CompleteChannel) && downloadInfo.result.err != nil {
+				err = downloadInfo.result.err
+			} else if FailureKindOf(err) == UnknownFailure {
+				err = &PullError{Kind: LoadFailure, Err: err}
+			}
+
+			downloadInfo.Stop()
+		}
+		pulled <- pullResult{digest: digest, downloadInfo: downloadInfo, err: err}
+	}()
+
+	var result pullResult
+	select {
+	case result = <-pulled:
+	case <-opts.Stop:
+		interruptLock.Lock()
+		interrupted = true
+		if downloads != nil {
+			downloads.Stop()
+		}
+		interruptLock.Unlock()
+
+		return ErrStopped
+
+	case <-ctx.Done():
+		interruptLock.Lock()
+		interrupted = true
+		if downloads != nil {
+			downloads.Abort()
+		}
+		interruptLock.Unlock()
+
+		if ctx.Err() == context.DeadlineExceeded {
+			return &PullError{Kind: TimeoutFailure, Err: ctx.Err()}
+		}
+
+		return ctx.Err()
+	}
+
+	if result.err != nil {
+		return result.err
+	}
+
+	if opts.OnPulled != nil {
+		if err := opts.OnPulled(result.digest); err != nil {
+			result.downloadInfo.Stop()
+			return err
+		}
+	}
+
+	// Keep seeding the downloaded layer(s), if requested.
+	if opts.Seed {
+		log.Printf("Seeding image %v", image)
+
+		select {
+		case <-result.downloadInfo.CompleteChannel:
+		case <-opts.Stop:
+			result.downloadInfo.Stop()
+		}
+	}
+
+	return result.downloadInfo.Wait()
+}
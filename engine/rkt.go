@@ -16,20 +16,30 @@ package engine
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"runtime"
+	"strings"
+	"sync"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/appc/spec/discovery"
 	"github.com/spf13/cobra"
+
+	"github.com/coreos/quayctl/dockerdist"
+	"github.com/coreos/quayctl/httpclient"
 )
 
+var platformFlag string
+
 // RktEngine defines an engine interface for interacting with rkt.
 type RktEngine struct{}
 
@@ -46,7 +56,7 @@ func (re RktEngine) TorrentHandler() engineTorrentHandler {
 }
 
 type rktContext struct {
-	signatureUrl *url.URL
+	signatureUrls map[string]*url.URL // Map from ACI URL -> signature URL
 }
 
 // rktConfig is a structure representing the data that is returned by the `rkt config` command.
@@ -88,15 +98,35 @@ type rktCredentials struct {
 // rktTorrentHandler defines an interface for pulling a rkt image via torrent.
 type rktTorrentHandler struct{}
 
-func (rth rktTorrentHandler) DecorateCommand(command *cobra.Command) {}
+func (rth rktTorrentHandler) DecorateCommand(command *cobra.Command) {
+	command.PersistentFlags().StringVar(&platformFlag, "platform", "", "The platform (os/arch) of the image to fetch, e.g. linux/arm64. If not specified, the platform of the image labels or of this machine is used.")
+}
+
+func (rth rktTorrentHandler) CheckEngine() error {
+	if _, err := exec.LookPath("rkt"); err != nil {
+		return fmt.Errorf("Cannot find rkt: %v", err)
+	}
 
-func (rth rktTorrentHandler) RetrieveTorrents(image string, insecureFlag bool, option layersOption) ([]torrentInfo, interface{}, error) {
+	return nil
+}
+
+func (rth rktTorrentHandler) RetrieveTorrents(image string, insecureFlag bool, option layersOption, lock dockerdist.Lockfile) ([]torrentInfo, interface{}, error) {
 	// Parse the image string.
 	app, err := discovery.NewAppFromString(image)
 	if err != nil {
 		return []torrentInfo{}, nil, err
 	}
 
+	if platformFlag != "" {
+		platformOS, platformArch, err := parsePlatform(platformFlag)
+		if err != nil {
+			return []torrentInfo{}, nil, err
+		}
+
+		app.Labels["os"] = platformOS
+		app.Labels["arch"] = platformArch
+	}
+
 	if _, ok := app.Labels["arch"]; !ok {
 		app.Labels["arch"] = runtime.GOARCH
 	}
@@ -107,29 +137,16 @@ func (rth rktTorrentHandler) RetrieveTorrents(image string, insecureFlag bool, o
 	// Perform discovery for the image.
 	var insecureOption = discovery.InsecureNone
 	if insecureFlag {
-		insecureOption = discovery.InsecureHTTP
+		insecureOption |= discovery.InsecureHTTP
+	}
+	if dockerdist.TLSSkipVerify {
+		insecureOption |= discovery.InsecureTLS
 	}
 
 	log.Printf("Discovering image %v", image)
 	endpoints, _, err := discovery.DiscoverACIEndpoints(*app, nil, insecureOption)
 	if err != nil {
-		return []torrentInfo{}, nil, fmt.Errorf("Could not discover %v: %v", app, err)
-	}
-
-	// Build the URL for the ACI image.
-	aciUrl, err := url.Parse(endpoints[0].ACI)
-	if err != nil {
-		return []torrentInfo{}, nil, fmt.Errorf("Could not download %v: %v", app, err)
-	}
-
-	signatureUrl, err := url.Parse(endpoints[0].ASC)
-	if err != nil {
-		return []torrentInfo{}, nil, fmt.Errorf("Could not download %v: %v", app, err)
-	}
-
-	if insecureFlag {
-		aciUrl.Scheme = "http"
-		signatureUrl.Scheme = "http"
+		return []torrentInfo{}, nil, newPullError(fmt.Sprintf("Could not discover %v", app), err)
 	}
 
 	// Find any auth credentials for the requests.
@@ -146,53 +163,107 @@ func (rth rktTorrentHandler) RetrieveTorrents(image string, insecureFlag bool, o
 		return []torrentInfo{}, nil, fmt.Errorf("Could unmarshal rkt config data: %v", err)
 	}
 
-	// Search for auth for the domain.
-	for _, config := range topLevel.Stage0 {
-		if config.RktKind == rktKindAuth && config.AuthType == rktAuthBasic {
-			for _, domain := range config.Domains {
-				if domain == aciUrl.Host {
-					log.Printf("Found credentials for image %v", image)
-					aciUrl.User = url.UserPassword(config.Credentials.Username, config.Credentials.Password)
-					signatureUrl.User = url.UserPassword(config.Credentials.Username, config.Credentials.Password)
+	// Build the URLs for the ACI image and its signature at every endpoint. The first endpoint is
+	// tried first, with the others used as fallbacks if the download cannot be started from it.
+	var aciUrls []string
+	signatureUrls := map[string]*url.URL{}
+	for _, endpoint := range endpoints {
+		aciUrl, err := url.Parse(endpoint.ACI)
+		if err != nil {
+			return []torrentInfo{}, nil, fmt.Errorf("Could not download %v: %v", app, err)
+		}
+
+		signatureUrl, err := url.Parse(endpoint.ASC)
+		if err != nil {
+			return []torrentInfo{}, nil, fmt.Errorf("Could not download %v: %v", app, err)
+		}
+
+		if insecureFlag {
+			aciUrl.Scheme = "http"
+			signatureUrl.Scheme = "http"
+		}
+
+		// Use the credentials given explicitly, if any. Otherwise, search for auth for the domain.
+		if dockerdist.RegistryUsername != "" {
+			aciUrl.User = url.UserPassword(dockerdist.RegistryUsername, dockerdist.RegistryPassword)
+			signatureUrl.User = url.UserPassword(dockerdist.RegistryUsername, dockerdist.RegistryPassword)
+		} else {
+			for _, config := range topLevel.Stage0 {
+				if config.RktKind == rktKindAuth && config.AuthType == rktAuthBasic {
+					for _, domain := range config.Domains {
+						if domain == aciUrl.Host {
+							log.Printf("Found credentials for image %v at %v", image, aciUrl.Host)
+							aciUrl.User = url.UserPassword(config.Credentials.Username, config.Credentials.Password)
+							signatureUrl.User = url.UserPassword(config.Credentials.Username, config.Credentials.Password)
+						}
+					}
 				}
 			}
 		}
+
+		aciUrls = append(aciUrls, aciUrl.String())
+		signatureUrls[aciUrl.String()] = signatureUrl
+	}
+
+	// Ensure that the signatures can be downloaded before downloading the ACI, skipping the
+	// endpoints whose signature is unavailable.
+	aciUrls, err = checkSignatures(aciUrls, signatureUrls)
+	if err != nil {
+		return []torrentInfo{}, nil, newPullError(fmt.Sprintf("Could not download signature for image %v", image), err)
 	}
 
 	log.Printf("Downloading torrent for image %v", image)
 	torrent := torrentInfo{
-		id:          "aci",
-		torrentPath: aciUrl.String(),
-		title:       image,
+		id:            "aci",
+		torrentPath:   aciUrls[0],
+		fallbackPaths: aciUrls[1:],
+		title:         image,
 	}
 
-	return []torrentInfo{torrent}, rktContext{signatureUrl}, nil
+	return []torrentInfo{torrent}, rktContext{signatureUrls}, nil
 }
 
-func (rth rktTorrentHandler) LoadImage(image string, downloadInfo downloadTorrentInfo, ctx interface{}) error {
-	// Wait for the torrent to complete.
-	<-downloadInfo.CompleteChannel
+func (rth rktTorrentHandler) LoadImage(image string, downloadInfo downloadTorrentInfo, ctx interface{}) (string, error) {
+	// Wait for the torrent to be downloaded.
+	aciPath, err := downloadInfo.waitForDownload("aci")
+
+	if downloadInfo.HasProgressBars {
+		downloadInfo.Pool.Stop()
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	// Download the signature from the endpoint the image was downloaded from.
+	aciUrl, _ := downloadInfo.TorrentSources.Get("aci")
+	if endpointUrl, err := url.Parse(aciUrl.(string)); err == nil {
+		log.Printf("Downloaded image %v from endpoint %v", image, endpointUrl.Host)
+	}
 
-	// Download the signature.
 	log.Printf("Downloading signature for image %v", image)
-	aciPath, _ := downloadInfo.TorrentPaths.Get("aci")
+	signatureUrl := ctx.(rktContext).signatureUrls[aciUrl.(string)]
+
 	signaturePath := fmt.Sprintf("%s.aci.asc", aciPath)
-	err := downloadFile(ctx.(rktContext).signatureUrl, signaturePath)
+	err = downloadFile(downloadInfo.HTTPClient, signatureUrl, signaturePath)
 	if err != nil {
-		return fmt.Errorf("Could not download signature for image %v: %v", image, err)
+		return "", newPullError(fmt.Sprintf("Could not download signature for image %v", image), err)
 	}
 
 	// Load the image into rkt via a fetch of the local file.
 	log.Printf("Loading image %v", image)
 	aciLocalPath := url.URL{
 		Scheme: "file",
-		Path:   aciPath.(string),
+		Path:   aciPath,
 	}
 
+	// rkt prints the ID of the fetched image on stdout.
+	var stdout bytes.Buffer
 	cmd := exec.Command("rkt", "fetch", aciLocalPath.String(), "--trust-keys-from-https=true")
+	cmd.Stdout = &stdout
 	cmdReader, err := cmd.StderrPipe()
 	if err != nil {
-		return fmt.Errorf("Could not load image %v into rkt: %v", image, err)
+		return "", fmt.Errorf("Could not load image %v into rkt: %v", image, err)
 	}
 
 	scanner := bufio.NewScanner(cmdReader)
@@ -204,30 +275,111 @@ func (rth rktTorrentHandler) LoadImage(image string, downloadInfo downloadTorren
 
 	err = cmd.Start()
 	if err != nil {
-		return fmt.Errorf("Could not load image %v into rkt: %v", image, err)
+		return "", fmt.Errorf("Could not load image %v into rkt: %v", image, err)
 	}
 
 	err = cmd.Wait()
 	if err != nil {
-		return fmt.Errorf("Could not load image %v into rkt: %v", image, err)
+		return "", fmt.Errorf("Could not load image %v into rkt: %v", image, err)
 	}
 
-	return nil
+	return strings.TrimSpace(stdout.String()), nil
 }
 
-func downloadFile(url *url.URL, filePath string) error {
-	file, err := os.Create(filePath)
+// checkSignatures sends a HEAD request to the signature URL of each of the given ACI URLs, in
+// parallel, and returns the ACI URLs whose signature is available, in the same order. An error is
+// returned if no signature is available.
+func checkSignatures(aciUrls []string, signatureUrls map[string]*url.URL) ([]string, error) {
+	client, err := httpclient.New(httpclient.Config{TLSSkipVerify: dockerdist.TLSSkipVerify, UserAgent: dockerdist.UserAgent})
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(aciUrls))
+	var wg sync.WaitGroup
+	for i, aciUrl := range aciUrls {
+		wg.Add(1)
+		go func(i int, signatureUrl *url.URL) {
+			defer wg.Done()
+			errs[i] = checkSignature(client, signatureUrl)
+		}(i, signatureUrls[aciUrl])
+	}
+	wg.Wait()
+
+	var availableUrls []string
+	for i, aciUrl := range aciUrls {
+		if errs[i] != nil {
+			log.Warnf("Skipping endpoint %v: %v", signatureUrls[aciUrl].Host, errs[i])
+			continue
+		}
+
+		availableUrls = append(availableUrls, aciUrl)
+	}
+
+	if len(availableUrls) == 0 {
+		return nil, errs[0]
+	}
+
+	return availableUrls, nil
+}
+
+// checkSignature ensures that the signature found at the given URL can be downloaded, via a HEAD
+// request. Servers that do not support HEAD requests are assumed to serve the signature.
+func checkSignature(client *http.Client, signatureUrl *url.URL) error {
+	resp, err := client.Head(signatureUrl.String())
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	resp.Body.Close()
+
+	// Never include the credentials of the URL (if any) in the errors.
+	redactedURL := *signatureUrl
+	redactedURL.User = nil
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+
+	case resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented:
+		return nil
+
+	default:
+		return &PullError{Kind: httpStatusFailureKind(resp.StatusCode), Err: fmt.Errorf("got %v for %v", resp.StatusCode, redactedURL.String())}
+	}
+}
 
-	resp, err := http.Get(url.String())
+// errorSnippetSize is the maximum number of bytes of an error page included in the errors of
+// downloadFile.
+const errorSnippetSize = 256
+
+// downloadFile downloads the given URL to the given file path. An error page, i.e. a non-2xx
+// response or an HTML page, is reported as an error including the beginning of its body, rather
+// than written to the file.
+func downloadFile(client *http.Client, url *url.URL, filePath string) error {
+	resp, err := client.Get(url.String())
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
+	// Never include the credentials of the URL (if any) in the errors.
+	redactedURL := *url
+	redactedURL.User = nil
+
+	if resp.StatusCode/100 != 2 {
+		return &PullError{Kind: httpStatusFailureKind(resp.StatusCode), Err: fmt.Errorf("got %v for %v: %s", resp.StatusCode, redactedURL.String(), errorSnippet(resp.Body))}
+	}
+
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && mediaType == "text/html" {
+		return fmt.Errorf("got an HTML page for %v: %s", redactedURL.String(), errorSnippet(resp.Body))
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
 	_, err = io.Copy(file, resp.Body)
 	if err != nil {
 		return err
@@ -235,3 +387,24 @@ func downloadFile(url *url.URL, filePath string) error {
 
 	return nil
 }
+
+// errorSnippet returns the beginning of the given error page, on a single line.
+func errorSnippet(body io.Reader) string {
+	data, _ := ioutil.ReadAll(io.LimitReader(body, errorSnippetSize))
+	snippet := strings.Join(strings.Fields(string(data)), " ")
+	if snippet == "" {
+		return "(empty body)"
+	}
+
+	return snippet
+}
+
+// parsePlatform parses a platform of the form os/arch.
+func parsePlatform(platform string) (string, string, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid platform %v: expected os/arch", platform)
+	}
+
+	return parts[0], parts[1], nil
+}
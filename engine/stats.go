@@ -0,0 +1,155 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/streamrail/concurrent-map"
+
+	"github.com/coreos/quayctl/bittorrent"
+)
+
+// statsSampleInterval defines the time between each sample of the download rate of the torrents.
+const statsSampleInterval = time.Second
+
+// Where the content of a layer came from.
+const (
+	layerFromTorrent       = "torrent"
+	layerFromRegistry      = "registry"
+	layerFromBlobCache     = "blob cache"
+	layerFromTorrentFolder = "torrent folder"
+)
+
+// layerStats holds the download statistics of a layer.
+type layerStats struct {
+	title string
+
+	// source is where the content came from, or empty while it is being downloaded.
+	source string
+
+	// downloadedBytes is the number of bytes of the content downloaded so far, and webSeedBytes
+	// and peerBytes the number of bytes of a finished torrent downloaded from each source.
+	downloadedBytes int64
+	webSeedBytes    int64
+	peerBytes       int64
+
+	// elapsed is the time the layer took to be downloaded, once it is.
+	elapsed time.Duration
+}
+
+// downloadStats accumulates the statistics of the downloads of DownloadTorrents.
+type downloadStats struct {
+	lock     sync.Mutex
+	start    time.Time
+	peakRate float32
+	layers   map[string]*layerStats
+	order    []string
+	printed  sync.Once
+}
+
+// newDownloadStats returns the statistics of the downloads of the given torrents, starting now.
+func newDownloadStats(torrents []torrentInfo) *downloadStats {
+	stats := &downloadStats{start: time.Now(), layers: make(map[string]*layerStats, len(torrents))}
+	for _, torrent := range torrents {
+		stats.layers[torrent.id] = &layerStats{title: shortenName(torrent.title)}
+		stats.order = append(stats.order, torrent.id)
+	}
+
+	return stats
+}
+
+// sample records the total download rate of the given torrents and the progress of those that
+// are being downloaded.
+func (s *downloadStats) sample(bt *bittorrent.Client, torrents []torrentInfo, sources cmap.ConcurrentMap) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var downloadRate float32
+	for _, torrent := range torrents {
+		status, err := bt.GetStatus(torrentSource(torrent, sources))
+		if err != nil {
+			continue
+		}
+
+		downloadRate += status.DownloadRate
+		if layer := s.layers[torrent.id]; layer.source == "" {
+			layer.downloadedBytes = status.DownloadedBytes
+		}
+	}
+
+	if downloadRate > s.peakRate {
+		s.peakRate = downloadRate
+	}
+}
+
+// finish records that the layer with the given ID has been downloaded from the given source.
+func (s *downloadStats) finish(id, source string, downloadedBytes, webSeedBytes, peerBytes int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	layer := s.layers[id]
+	layer.source = source
+	layer.downloadedBytes = downloadedBytes
+	layer.webSeedBytes = webSeedBytes
+	layer.peerBytes = peerBytes
+	layer.elapsed = truncateDuration(time.Since(s.start))
+}
+
+// print writes the summary of the downloads to w, as a table. It is only written once, whichever
+// of the completion or the interruption of the downloads comes first.
+func (s *downloadStats) print(w io.Writer) {
+	s.printed.Do(func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(table, "LAYER\tDOWNLOADED\tFROM PEERS\tFROM WEB SEEDS\tSOURCE\tTIME")
+
+		var downloaded, fromPeers, fromWebSeeds int64
+		for _, id := range s.order {
+			layer := s.layers[id]
+			downloaded += layer.downloadedBytes
+			fromPeers += layer.peerBytes
+			fromWebSeeds += layer.webSeedBytes
+
+			source, elapsed := layer.source, layer.elapsed.String()
+			if source == "" {
+				source, elapsed = "incomplete", "-"
+			}
+
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n", layer.title, humanize.Bytes(uint64(layer.downloadedBytes)),
+				humanize.Bytes(uint64(layer.peerBytes)), humanize.Bytes(uint64(layer.webSeedBytes)), source, elapsed)
+		}
+		table.Flush()
+
+		fmt.Fprintf(w, "Downloaded %s in %v (peak rate %s/s)", humanize.Bytes(uint64(downloaded)), truncateDuration(time.Since(s.start)),
+			humanize.Bytes(uint64(s.peakRate*1024)))
+		if total := fromPeers + fromWebSeeds; total > 0 {
+			fmt.Fprintf(w, ": %d%% from peers, %d%% from web seeds", fromPeers*100/total, fromWebSeeds*100/total)
+		}
+		fmt.Fprintln(w)
+	})
+}
+
+// truncateDuration truncates the given duration to the millisecond, for display.
+func truncateDuration(d time.Duration) time.Duration {
+	return d - d%time.Millisecond
+}
@@ -15,56 +15,221 @@
 package engine
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
-	"os/signal"
-	"syscall"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/cheggaaa/pb"
+	"github.com/docker/distribution/digest"
 	"github.com/dustin/go-humanize"
 	"github.com/streamrail/concurrent-map"
 
 	"github.com/coreos/quayctl/bittorrent"
+	"github.com/coreos/quayctl/dockerclient"
 )
 
-// torrentSeedOption defines the option for whether to seed after a layer has been downloaded
-// via torrent.
-type torrentSeedOption int
+// ProgressMode defines how the progress is reported while downloading torrents.
+type ProgressMode string
 
 const (
-	TorrentNoSeed torrentSeedOption = iota
-	TorrentSeedAfterPull
+	// PerLayerProgress displays a progress bar for each torrent. It is the default.
+	PerLayerProgress ProgressMode = "per-layer"
+
+	// AggregateProgress displays a single progress bar for all the torrents.
+	AggregateProgress ProgressMode = "aggregate"
+
+	// BothProgress displays a progress bar for each torrent and one for all the torrents.
+	BothProgress ProgressMode = "both"
+
+	// JSONProgress writes the progress of the torrents, and then of the load of the image, to the
+	// standard output as ProgressEvents, one JSON object per line, instead of progress bars.
+	JSONProgress ProgressMode = "json"
 )
 
-// torrentInfo holds the blobSum and torrent path for a torrent.
+// DownloadOptions holds the options of the torrent ops of DownloadTorrents.
+type DownloadOptions struct {
+	// TorrentFolder is the folder in which the torrents are downloaded.
+	TorrentFolder string
+
+	// Seed specifies that the torrents keep being seeded once downloaded, for SeedDuration, or
+	// until the torrent ops are stopped if SeedDuration is 0.
+	Seed         bool
+	SeedDuration time.Duration
+
+	// ClientConfig and DownloadConfig configure the BitTorrent client and the downloads of the
+	// torrents, e.g. the trackers used.
+	ClientConfig   bittorrent.ClientConfig
+	DownloadConfig bittorrent.DownloadConfig
+
+	// MetricsAddr, if not empty, is the address on which the metrics of the torrents are exposed
+	// until all torrent ops are complete.
+	MetricsAddr string
+
+	// BlobCache, if not empty, is the path of the content-addressable cache to which the downloaded
+	// blobs are added, and from which they are reused without being downloaded again, unless they
+	// must be seeded.
+	BlobCache string
+
+	// RegistryFallback, if not 0, is the duration after which a blob whose torrent download stalls
+	// is downloaded directly from the registry instead, as are the blobs whose torrent download
+	// fails, if they support it.
+	RegistryFallback time.Duration
+
+	// StartStagger is the delay between the starts of the torrents, each of which is jittered by up
+	// to that delay, so that the connection attempts to the trackers and peers ramp up smoothly on
+	// images with many layers. If 0, every torrent is started at once.
+	StartStagger time.Duration
+
+	// WebSeed, if not empty, is the base URL of the web seed replacing those of the torrents of the
+	// blobs, e.g. to serve them from a cache: the URL of the web seed of a blob is the base URL
+	// followed by its blobSum.
+	WebSeed string
+
+	// Progress selects how the progress of the torrents is reported. Progress bars are displayed
+	// for each torrent by default.
+	Progress ProgressMode
+
+	// ProgressHTTPAddr, if not empty, is the address on which a Server-Sent Events stream of the
+	// progress of the torrents is exposed under /events, e.g. for a web dashboard.
+	ProgressHTTPAddr string
+
+	// ControlSocket, if not empty, is the path of the unix socket on which a JSON API controlling
+	// the BitTorrent client is exposed, e.g. to list, pause or add torrents.
+	ControlSocket string
+
+	// PrintStats, if set to true, prints a summary of the downloads (bytes downloaded from peers
+	// and from web seeds, peak rate and time elapsed, per layer and in total) once they are
+	// complete, or when they are interrupted.
+	PrintStats bool
+}
+
+// torrentInfo holds the blobSum and torrent path for a torrent, along with the HTTP headers (if
+// any) required to download its .torrent file.
+//
+// If fallbackPaths is not empty, the download is retried from each of these paths in turn when it
+// cannot be started from torrentPath.
+//
+// If highPriority is true, the torrent takes precedence over the others, e.g. because it is small
+// but required before the others can be used.
+//
+// If registryDownload is not nil, it downloads the content of the torrent directly from the
+// registry, which is used when the torrent download fails or stalls.
+//
+// If localPath is not empty, it is the path of a file holding the content of the torrent, e.g.
+// exported from the container engine, which is seeded rather than downloaded.
+//
+// If size is not 0, it is the size of the content of the torrent, as known before downloading it,
+// e.g. from the manifest.
 type torrentInfo struct {
-	id          string
-	torrentPath string
-	title       string
+	id               string
+	torrentPath      string
+	title            string
+	header           http.Header
+	fallbackPaths    []string
+	highPriority     bool
+	registryDownload func(w io.Writer) error
+	localPath        string
+	size             int64
 }
 
+const (
+	// registryBlobsFolder is the name of the folder, within the torrent folder, to which the blobs
+	// downloaded directly from the registry are written.
+	registryBlobsFolder = ".registry"
+
+	// stallCheckInterval defines the time between each check of the progress of the torrents that
+	// can fall back to the registry.
+	stallCheckInterval = 5 * time.Second
+)
+
+// ErrStopped is returned once the torrent ops of DownloadTorrents are stopped before completing,
+// e.g. by a stop request sent to the control socket.
+var ErrStopped = errors.New("Downloads stopped")
+
 // downloadTorrentInfo contains data structures populated and signaled by the DownloadTorrents
 // method.
 type downloadTorrentInfo struct {
-	DownloadedChannels map[string]chan struct{} // Map of torrent ID -> channel to await download
-	CompleteChannel    chan struct{}            // Channel to await completion of all torrent ops
-	Pool               *pb.Pool                 // ProgressBar pool
-	HasProgressBars    bool                     // Whether progress bars are running.
-	TorrentPaths       cmap.ConcurrentMap       // Map from torrent ID -> downloaded path
+	DownloadedChannels map[string]chan struct{}  // Map of torrent ID -> channel to await download
+	CompleteChannel    chan struct{}             // Channel to await the end of all torrent ops
+	Pool               *pb.Pool                  // ProgressBar pool
+	HasProgressBars    bool                      // Whether progress bars are running.
+	TorrentPaths       cmap.ConcurrentMap        // Map from torrent ID -> downloaded path
+	TorrentSources     cmap.ConcurrentMap        // Map from torrent ID -> torrent path downloaded from
+	HTTPClient         *http.Client              // HTTP client for any additional download
+	ProgressSink       dockerclient.ProgressSink // Sink of the progress of the load, nil for progress bars
+	Abort              func()                    // Interrupts all torrent ops, removing partial downloads
+	Stop               func()                    // Interrupts all torrent ops, keeping partial downloads
+	Release            func()                    // Unpins the downloaded content once used, e.g. loaded
+
+	// result holds the error that ended the torrent ops, once CompleteChannel is closed.
+	result *downloadResult
 }
 
-// DownloadTorrents starts the downloads of all the specified torrents, with optional seeding once
-// completed. Returns immediately with a downloadTorrentInfo struct.
-func DownloadTorrents(torrents []torrentInfo, torrentFolder string, seedOption torrentSeedOption,
-	torrentSeedDuration time.Duration, clientConfig bittorrent.ClientConfig,
-	downloadConfig bittorrent.DownloadConfig) downloadTorrentInfo {
+// downloadResult holds the outcome of the torrent ops of DownloadTorrents.
+type downloadResult struct {
+	once sync.Once
+	err  error
+}
+
+// Wait waits for the end of all torrent ops, and returns the error that ended them, if any: the
+// failure of a download, or ErrStopped if they were stopped or aborted.
+func (info downloadTorrentInfo) Wait() error {
+	<-info.CompleteChannel
+	return info.result.err
+}
+
+// waitForDownload waits for the torrent with the given ID to be downloaded, and returns the path
+// of its content. It fails rather than blocking forever if the torrent was never started, if the
+// torrent ops end before it is downloaded, and if its content is not available once downloaded.
+func (info downloadTorrentInfo) waitForDownload(id string) (string, error) {
+	downloaded, found := info.DownloadedChannels[id]
+	if !found {
+		return "", fmt.Errorf("%v was not downloaded", id)
+	}
+
+	select {
+	case <-downloaded:
+	case <-info.CompleteChannel:
+		if !isClosed(downloaded) {
+			return "", info.result.err
+		}
+	}
+
+	path, found := info.TorrentPaths.Get(id)
+	if !found {
+		return "", fmt.Errorf("the downloaded content of %v is missing", id)
+	}
+
+	return path.(string), nil
+}
+
+// DownloadTorrents starts the downloads of all the specified torrents, with the given options.
+// Returns immediately with a downloadTorrentInfo struct.
+func DownloadTorrents(torrents []torrentInfo, opts DownloadOptions) downloadTorrentInfo {
+	if opts.Progress == "" {
+		opts.Progress = PerLayerProgress
+	}
+
+	// Download each blob once, even if several layers share it, so that its channels are only
+	// closed once.
+	torrents = uniqueTorrents(torrents)
 
 	// Add a channel for each torrent to track state.
 	torrentDownloadedChannels := map[string]chan struct{}{}
 	torrentCompletedChannels := map[string]chan struct{}{}
 	torrentPaths := cmap.New()
+	torrentSources := cmap.New()
+	result := &downloadResult{}
 
 	// Create the torrent channels.
 	for _, torrent := range torrents {
@@ -72,85 +237,285 @@ func DownloadTorrents(torrents []torrentInfo, torrentFolder string, seedOption t
 		torrentCompletedChannels[torrent.id] = make(chan struct{})
 	}
 
-	// Create a progress bar for each of the torrents.
+	// Create a progress bar for each of the torrents, displayed unless only the aggregate progress
+	// is requested.
 	pbMap := map[string]*pb.ProgressBar{}
 	var bars = make([]*pb.ProgressBar, 0)
 	for _, torrent := range torrents {
-		progressBar := pb.New(100).Prefix(shortenName(torrent.title)).Postfix(" Initializing")
-		progressBar.SetMaxWidth(80)
-		progressBar.ShowCounters = false
-		progressBar.AlwaysUpdate = true
+		progressBar := newProgressBar(shortenName(torrent.title))
 
 		pbMap[torrent.id] = progressBar
-		bars = append(bars, progressBar)
+		if opts.Progress != AggregateProgress {
+			bars = append(bars, progressBar)
+		}
 	}
 
-	// Create a pool of progress bars.
-	pool, err := pb.StartPool(bars...)
-	var hasProgressBars = true
-	if err != nil {
-		hasProgressBars = false
+	// Create a progress bar for the total progress of the torrents, if requested.
+	var aggregateBar *pb.ProgressBar
+	if opts.Progress != PerLayerProgress {
+		aggregateBar = newProgressBar("Total")
+		bars = append(bars, aggregateBar)
 	}
 
-	if clientConfig.Debug {
-		pool.Stop()
-		hasProgressBars = false
+	// Create a pool of progress bars, unless debugging or informational messages are disabled.
+	var pool *pb.Pool
+	var hasProgressBars = false
+	if opts.Progress != JSONProgress && !opts.ClientConfig.Debug && log.GetLevel() >= log.InfoLevel {
+		var err error
+		pool, err = pb.StartPool(bars...)
+		hasProgressBars = err == nil
 	}
 
-	// Initialize Bittorrent client.
-	bt, err := initBitTorrentClient(torrentFolder, clientConfig)
+	// Create the completed channel, closed once every torrent op is complete, or once they are
+	// interrupted, and the done channel, closed beforehand, on which the goroutines of the torrent
+	// ops exit.
+	completed := make(chan struct{})
+	done := make(chan struct{})
+
+	var bt *bittorrent.Client
+	var metricsListener, controlListener, progressListener net.Listener
+	var stats *downloadStats
+
+	// finish ends the torrent ops with the given error (nil once they are complete), and releases
+	// everything they use, including what was started before a failure to start the others. The
+	// partially downloaded content is removed if abort is set, and kept otherwise, so that the
+	// downloads can be resumed later.
+	finish := func(err error, abort bool) {
+		result.once.Do(func() {
+			close(done)
+
+			if hasProgressBars {
+				pool.Stop()
+			}
+
+			for _, listener := range []net.Listener{metricsListener, controlListener, progressListener} {
+				if listener != nil {
+					listener.Close()
+				}
+			}
+
+			if bt != nil {
+				if abort {
+					bt.Abort()
+				} else {
+					bt.Stop()
+				}
+			}
+
+			removeLocalContent(torrents)
+
+			if stats != nil {
+				stats.print(os.Stderr)
+			}
+
+			result.err = err
+			close(completed)
+		})
+	}
+
+	httpClient := opts.ClientConfig.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	info := downloadTorrentInfo{
+		DownloadedChannels: torrentDownloadedChannels,
+		CompleteChannel:    completed,
+		Pool:               pool,
+		HasProgressBars:    hasProgressBars,
+		TorrentPaths:       torrentPaths,
+		TorrentSources:     torrentSources,
+		HTTPClient:         httpClient,
+		Abort:              func() { finish(ErrStopped, true) },
+		Stop:               func() { finish(ErrStopped, false) },
+		result:             result,
+	}
+
+	// The content downloaded to the torrent folder is pinned until released, so that neither the
+	// cache eviction of the later torrents nor the prunes of other processes remove it before it
+	// has been used.
+	var releaseOnce sync.Once
+	info.Release = func() {
+		releaseOnce.Do(func() {
+			if bt == nil {
+				return
+			}
+
+			for _, torrent := range torrents {
+				if contentPath, found := torrentPaths.Get(torrent.id); found {
+					bt.Unpin(opts.TorrentFolder, contentPath.(string))
+				}
+			}
+		})
+	}
+
+	// Initialize Bittorrent client. Failing to start it, or any of the servers below, ends the
+	// torrent ops right away with the error.
+	var err error
+	bt, err = initBitTorrentClient(opts.TorrentFolder, opts.ClientConfig)
 	if err != nil {
-		panic(fmt.Errorf("Could not initialize torrent client: %v", err))
+		finish(fmt.Errorf("Could not initialize torrent client: %v", err), false)
+		return info
 	}
 
-	// Listen for Ctrl-C.
-	go catchShutdownSignals(bt, pool, hasProgressBars)
+	// Start the metrics server, if requested.
+	if opts.MetricsAddr != "" {
+		metricsListener, err = startMetricsServer(opts.MetricsAddr, bt, torrents, torrentSources)
+		if err != nil {
+			finish(err, false)
+			return info
+		}
+	}
 
 	// For each torrent, download the data in parallel, call post-processing and (optionally)
 	// seed.
 	var localSeedDuration *time.Duration
-	if seedOption == TorrentSeedAfterPull {
-		localSeedDuration = &torrentSeedDuration
+	if opts.Seed {
+		localSeedDuration = &opts.SeedDuration
 	}
 
-	// Create the completed channel.
-	completed := make(chan struct{})
+	// Start the control server, if requested.
+	stop := make(chan struct{})
+	if opts.ControlSocket != "" {
+		controlListener, err = startControlServer(opts.ControlSocket, bt, opts.TorrentFolder, localSeedDuration, opts.DownloadConfig, stop)
+		if err != nil {
+			finish(err, false)
+			return info
+		}
+	}
+
+	// Start the progress server, if requested.
+	var progress *progressServer
+	if opts.ProgressHTTPAddr != "" {
+		progress, err = startProgressServer(opts.ProgressHTTPAddr)
+		if err != nil {
+			finish(err, false)
+			return info
+		}
+		progressListener = progress
+	}
+
+	// Write the progress of the torrents as JSON, if requested.
+	if opts.Progress == JSONProgress {
+		info.ProgressSink = dockerclient.NewJSONProgressSink(os.Stdout)
+	}
+
+	// Stream the progress events of the torrents to the clients of the progress server, and write
+	// them as JSON, if requested.
+	if progress != nil || info.ProgressSink != nil {
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+
+				case <-time.After(progressEventInterval):
+					events := torrentProgressEvents(bt, torrents, torrentSources, torrentDownloadedChannels)
+					if progress != nil {
+						progress.broadcast(events)
+					}
+
+					if info.ProgressSink != nil {
+						for _, event := range events {
+							info.ProgressSink.Event(event)
+						}
+					}
+				}
+			}
+		}()
+	}
+
+	// Accumulate the download statistics, if requested.
+	if opts.PrintStats {
+		stats = newDownloadStats(torrents)
+
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+
+				case <-time.After(statsSampleInterval):
+					stats.sample(bt, torrents, torrentSources)
+				}
+			}
+		}()
+	}
+
+	// Listen for stop requests.
+	go func() {
+		select {
+		case <-stop:
+			log.Println("Received stop request")
+			finish(ErrStopped, false)
+		case <-done:
+		}
+	}()
 
 	// Start a goroutine to query the torrent system for its status. Since libtorrent is single
 	// threaded via cgo, we need this to be done in a central source.
 	// Add a goroutine to update the progessbar for the torrent.
 	if hasProgressBars {
+		// The number of bytes downloaded and to download of each torrent, once known.
+		downloadedBytes := map[string]int64{}
+		totalBytes := map[string]int64{}
+		for _, torrent := range torrents {
+			if torrent.size > 0 {
+				totalBytes[torrent.id] = torrent.size
+			}
+		}
+
 		go func() {
 			for {
 				select {
-				case <-completed:
+				case <-done:
 					return
 
 				case <-time.After(250 * time.Millisecond):
+					var downloadRate float32
+					var pending int
 					for _, torrent := range torrents {
 						progressBar := pbMap[torrent.id]
-						status, err := bt.GetStatus(torrent.torrentPath)
+						status, err := bt.GetStatus(torrentSource(torrent, torrentSources))
 						if err == nil {
 							progressBar.Set(int(status.Progress))
-							progressBar.Postfix(fmt.Sprintf(" %s DL%v/s UL%v/s", status.Status, humanize.Bytes(uint64(status.DownloadRate*1024)), humanize.Bytes(uint64(status.UploadRate*1024))))
+							progressBar.Postfix(fmt.Sprintf(" %s %d/%d pieces DL%v/s UL%v/s", status.Status, status.NumPiecesDownloaded, status.NumPieces, humanize.Bytes(uint64(status.DownloadRate*1024)), humanize.Bytes(uint64(status.UploadRate*1024))))
+
+							if status.TotalBytes > 0 {
+								totalBytes[torrent.id] = status.TotalBytes
+								downloadedBytes[torrent.id] = status.DownloadedBytes
+							}
+							downloadRate += status.DownloadRate
 						}
+
+						// The torrent is no longer in the client once downloaded, unless seeded, nor
+						// ever if its content was found locally or downloaded from the registry.
+						if isClosed(torrentDownloadedChannels[torrent.id]) {
+							downloadedBytes[torrent.id] = totalBytes[torrent.id]
+						} else if _, found := totalBytes[torrent.id]; !found {
+							pending++
+						}
+					}
+
+					if aggregateBar != nil {
+						updateAggregateBar(aggregateBar, downloadedBytes, totalBytes, pending, downloadRate)
 					}
 				}
 			}
 		}()
-	} else {
+	} else if info.ProgressSink == nil {
 		// Write the status every 30s for each torrent.
 		go func() {
 			for {
 				select {
-				case <-completed:
+				case <-done:
 					return
 
 				case <-time.After(30 * time.Second):
 					for _, torrent := range torrents {
-						status, err := bt.GetStatus(torrent.torrentPath)
+						status, err := bt.GetStatus(torrentSource(torrent, torrentSources))
 						if err == nil {
-							log.Printf("Torrent %v: %s DL%v/s UL%v/s", shortenName(torrent.title), status.Status, humanize.Bytes(uint64(status.DownloadRate*1024)), humanize.Bytes(uint64(status.UploadRate*1024)))
+							log.Printf("Torrent %v: %s %d/%d pieces DL%v/s UL%v/s", shortenName(torrent.title), status.Status, status.NumPiecesDownloaded, status.NumPieces, humanize.Bytes(uint64(status.DownloadRate*1024)), humanize.Bytes(uint64(status.UploadRate*1024)))
 						}
 					}
 				}
@@ -159,26 +524,162 @@ func DownloadTorrents(torrents []torrentInfo, torrentFolder string, seedOption t
 	}
 
 	// Start the downloads for each torrent.
+	startDelays := staggerStarts(torrents, opts.StartStagger)
 	for _, torrent := range torrents {
-		go func(torrent torrentInfo) {
-			// Start downloading the torrent.
-			path, keepSeeding, err := bt.Download(torrent.torrentPath, torrentFolder, localSeedDuration, downloadConfig)
-			if err != nil {
-				if hasProgressBars {
-					pool.Stop()
+		go func(torrent torrentInfo, startDelay time.Duration) {
+			// Reuse the blob from the blob cache, if present, or the one downloaded to the
+			// torrent folder by a previous pull, e.g. one whose load was interrupted.
+			if localSeedDuration == nil {
+				var reusedPath, reusedFrom string
+				if opts.BlobCache != "" {
+					if cachePath, found := lookupBlobCache(opts.BlobCache, torrent.id); found {
+						reusedPath, reusedFrom = cachePath, layerFromBlobCache
+					}
+				}
+
+				if reusedPath == "" {
+					if blobPath, found := lookupDownloadedBlob(opts.TorrentFolder, torrent.id); found {
+						reusedPath, reusedFrom = blobPath, layerFromTorrentFolder
+						bt.Pin(opts.TorrentFolder, blobPath)
+					}
+				}
+
+				if reusedPath != "" {
+					torrentPaths.Set(torrent.id, reusedPath)
+
+					if hasProgressBars {
+						pbMap[torrent.id].ShowBar = false
+						pbMap[torrent.id].ShowPercent = false
+						pbMap[torrent.id].ShowTimeLeft = false
+						pbMap[torrent.id].ShowSpeed = false
+						pbMap[torrent.id].Postfix(" Found in " + reusedFrom).Set(100)
+					} else {
+						log.Printf("Found layer %v in %s\n", torrent.id, reusedFrom)
+					}
+
+					if stats != nil {
+						stats.finish(torrent.id, reusedFrom, 0, 0, 0)
+					}
+
+					close(torrentDownloadedChannels[torrent.id])
+					close(torrentCompletedChannels[torrent.id])
+					return
+				}
+			}
+
+			select {
+			case <-time.After(startDelay):
+			case <-done:
+				return
+			}
+
+			torrentDownloadConfig := opts.DownloadConfig
+			if torrent.header != nil {
+				torrentDownloadConfig.Header = torrent.header
+			}
+			torrentDownloadConfig.HighPriority = torrent.highPriority
+			torrentDownloadConfig.WebSeed = webSeedURL(opts.WebSeed, torrent.id)
+			torrentDownloadConfig.ContentPath = torrent.localPath
+			torrentDownloadConfig.ExpectedSize = torrent.size
+			torrentDownloadConfig.Pin = true
+
+			// Cancel the download if it stalls, so that it falls back to the registry.
+			canFallback := opts.RegistryFallback > 0 && torrent.registryDownload != nil
+
+			var stopWatching chan struct{}
+			if canFallback {
+				stopWatching = make(chan struct{})
+				go watchStalledDownload(bt, torrent, torrentSources, opts.RegistryFallback, stopWatching)
+			}
+
+			// Start downloading the torrent, falling back to the next source if it cannot be
+			// started.
+			var path string
+			var keepSeeding chan struct{}
+			var err error
+
+			sources := append([]string{torrent.torrentPath}, torrent.fallbackPaths...)
+			for i, source := range sources {
+				torrentSources.Set(torrent.id, source)
+
+				path, keepSeeding, err = bt.Download(source, opts.TorrentFolder, localSeedDuration, torrentDownloadConfig)
+				if err == nil || i == len(sources)-1 {
+					break
+				}
+
+				log.Warnf("Could not download %v, trying the next source: %v", shortenName(torrent.title), err)
+			}
+
+			// Explain the most common mistake: pulling from a registry that does not serve torrents.
+			if err == bittorrent.ErrTorrentNotFound && torrent.registryDownload != nil {
+				err = &PullError{
+					Kind: torrentFailureKind(err),
+					Err:  noTorrentEndpointError(torrentSource(torrent, torrentSources), canFallback),
 				}
+			}
 
-				log.Fatal(err)
+			// Download the content directly from the registry, as a last resort.
+			fromRegistry := false
+			if canFallback {
+				close(stopWatching)
+
+				if err != nil && !isClosed(done) {
+					log.Warnf("Could not download %v via BitTorrent, downloading it from the registry: %v", shortenName(torrent.title), err)
+					path, err = downloadFromRegistry(torrent, opts.TorrentFolder)
+					fromRegistry = err == nil
+				}
+			}
+
+			// Interrupt the torrent ops, unless they were interrupted in the meantime, which made the
+			// download fail.
+			if err != nil {
+				if !isClosed(done) {
+					finish(&PullError{Kind: torrentFailureKind(err), Err: err}, false)
+				}
+				return
 			}
 
 			torrentPaths.Set(torrent.id, path)
 
+			// Index the blob, so that it is reused if the pull is retried.
+			if !fromRegistry && !opts.ClientConfig.ReadOnlySeed {
+				if err := recordDownloadedBlob(opts.TorrentFolder, torrent.id, path); err != nil {
+					log.Warnf("Could not index downloaded layer %v: %v", torrent.id, err)
+				}
+			}
+
+			if stats != nil {
+				if fromRegistry {
+					var size int64
+					if info, err := os.Stat(path); err == nil {
+						size = info.Size()
+					}
+					stats.finish(torrent.id, layerFromRegistry, size, 0, 0)
+				} else {
+					webSeedBytes, peerBytes, _ := bt.GetDownloadSources(torrentSource(torrent, torrentSources))
+					stats.finish(torrent.id, layerFromTorrent, webSeedBytes+peerBytes, webSeedBytes, peerBytes)
+				}
+			}
+
+			// Add the blob to the blob cache, if any.
+			if opts.BlobCache != "" {
+				if err := storeBlobCache(opts.BlobCache, torrent.id, path); err != nil {
+					log.Warnf("Could not add layer %v to blob cache: %v", torrent.id, err)
+				}
+			}
+
 			if hasProgressBars {
 				pbMap[torrent.id].ShowBar = false
 				pbMap[torrent.id].ShowPercent = false
 				pbMap[torrent.id].ShowTimeLeft = false
 				pbMap[torrent.id].ShowSpeed = false
-				pbMap[torrent.id].Postfix(" Completed").Set(100)
+				if fromRegistry {
+					pbMap[torrent.id].Postfix(" Downloaded from registry").Set(100)
+				} else {
+					pbMap[torrent.id].Postfix(" Completed").Set(100)
+				}
+			} else if fromRegistry {
+				log.Printf("Downloaded layer %v from registry\n", torrent.id)
 			} else {
 				log.Printf("Completed download of layer %v\n", torrent.id)
 			}
@@ -186,41 +687,71 @@ func DownloadTorrents(torrents []torrentInfo, torrentFolder string, seedOption t
 			// Mark the download as complete.
 			close(torrentDownloadedChannels[torrent.id])
 
-			// Wait for seed to finish.
-			if localSeedDuration != nil {
+			// Wait for seed to finish. The content downloaded from the registry is not seeded.
+			if localSeedDuration != nil && !fromRegistry {
 				if !hasProgressBars {
 					log.Printf("Seeding layer %v\n", torrent.id)
 				}
-				<-keepSeeding
+				select {
+				case <-keepSeeding:
+				case <-done:
+					return
+				}
 			}
 
 			// Signal success.
 			close(torrentCompletedChannels[torrent.id])
-		}(torrent)
+		}(torrent, startDelays[torrent.id])
 	}
 
 	// Start a goroutine to wait for all torrents to complete.
 	go func() {
 		// Wait for every torrent to finish.
 		for _, torrent := range torrents {
-			<-torrentCompletedChannels[torrent.id]
-		}
-
-		if hasProgressBars {
-			pool.Stop()
+			select {
+			case <-torrentCompletedChannels[torrent.id]:
+			case <-done:
+				return
+			}
 		}
 
-		bt.Stop()
-		close(completed)
+		finish(nil, false)
 	}()
 
-	return downloadTorrentInfo{torrentDownloadedChannels, completed, pool, hasProgressBars, torrentPaths}
+	return info
+}
+
+// staggerStarts returns the delay after which each of the given torrents is started, by torrent ID,
+// spacing them by the given stagger plus a random jitter. High-priority torrents are started first.
+func staggerStarts(torrents []torrentInfo, stagger time.Duration) map[string]time.Duration {
+	delays := make(map[string]time.Duration, len(torrents))
+	if stagger <= 0 {
+		return delays
+	}
+
+	index := 0
+	for _, highPriority := range []bool{true, false} {
+		for _, torrent := range torrents {
+			if torrent.highPriority != highPriority {
+				continue
+			}
+
+			delays[torrent.id] = time.Duration(index)*stagger + time.Duration(rand.Int63n(int64(stagger)))
+			index++
+		}
+	}
+
+	return delays
 }
 
 // initBitTorrentClient inityializes a bittorrent client.
 func initBitTorrentClient(torrentFolder string, clientConfig bittorrent.ClientConfig) (*bittorrent.Client, error) {
-	// Ensure destination folder exists.
-	if err := os.MkdirAll(torrentFolder, 0755); err != nil {
+	// Ensure destination folder exists. When seeding read-only, it must already hold the content.
+	if clientConfig.ReadOnlySeed {
+		if _, err := os.Stat(torrentFolder); err != nil {
+			return nil, err
+		}
+	} else if err := os.MkdirAll(torrentFolder, 0755); err != nil {
 		return nil, err
 	}
 
@@ -235,19 +766,233 @@ func initBitTorrentClient(torrentFolder string, clientConfig bittorrent.ClientCo
 	return bt, nil
 }
 
-func catchShutdownSignals(btClient *bittorrent.Client, progressBars *pb.Pool, hasProgressBars bool) {
-	shutdown := make(chan os.Signal)
-	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
-	<-shutdown
+// removeLocalContent removes the files holding the content of the given torrents found locally,
+// e.g. exported from Docker. They are moved into the torrent folder once staged, and are no longer
+// needed otherwise, e.g. once the torrent was found in the blob cache or the torrent ops ended.
+func removeLocalContent(torrents []torrentInfo) {
+	for _, torrent := range torrents {
+		if torrent.localPath != "" {
+			os.Remove(torrent.localPath)
+		}
+	}
+}
 
-	if hasProgressBars {
-		progressBars.Stop()
+// uniqueTorrents returns the given torrents without the duplicate IDs, e.g. the blobs shared by
+// several layers, in order. A torrent has a high priority if any of its duplicates has.
+func uniqueTorrents(torrents []torrentInfo) []torrentInfo {
+	indexes := map[string]int{}
+	unique := make([]torrentInfo, 0, len(torrents))
+	for _, torrent := range torrents {
+		if index, found := indexes[torrent.id]; found {
+			unique[index].highPriority = unique[index].highPriority || torrent.highPriority
+			continue
+		}
+
+		indexes[torrent.id] = len(unique)
+		unique = append(unique, torrent)
 	}
 
-	btClient.Stop()
+	return unique
+}
+
+// newProgressBar returns a progress bar, expressed in percents, with the given prefix.
+func newProgressBar(prefix string) *pb.ProgressBar {
+	progressBar := pb.New(100).Prefix(prefix).Postfix(" Initializing")
+
+	// The bar follows the width of the terminal, falling back to 80 columns when it is unknown.
+	if _, err := pb.GetTerminalWidth(); err != nil {
+		progressBar.SetWidth(80)
+	}
+
+	progressBar.ShowCounters = false
+	progressBar.AlwaysUpdate = true
+
+	return progressBar
+}
+
+// updateAggregateBar sets the given progress bar to the total progress of the torrents, given the
+// number of bytes downloaded and to download of each of them, the number of torrents still to
+// download whose size is not known yet, and their total download rate.
+//
+// The progress stays below 100% while some sizes are unknown, as the total would still grow.
+func updateAggregateBar(progressBar *pb.ProgressBar, downloadedBytes, totalBytes map[string]int64, pending int, downloadRate float32) {
+	var downloaded, total int64
+	for id, size := range totalBytes {
+		downloaded += downloadedBytes[id]
+		total += size
+	}
+
+	percent := 0
+	if total > 0 {
+		percent = int(downloaded * 100 / total)
+	}
+
+	postfix := fmt.Sprintf(" %v/%v DL%v/s", humanize.Bytes(uint64(downloaded)), humanize.Bytes(uint64(total)), humanize.Bytes(uint64(downloadRate*1024)))
+	if pending > 0 {
+		if percent > 99 {
+			percent = 99
+		}
+		postfix += fmt.Sprintf(" (%d of unknown size)", pending)
+	}
+
+	progressBar.Set(percent)
+	progressBar.Postfix(postfix)
+}
+
+// torrentProgressEvents returns the progress events of the given torrents that are started, given
+// their sources and the channels closed once they are downloaded.
+func torrentProgressEvents(bt *bittorrent.Client, torrents []torrentInfo, sources cmap.ConcurrentMap, downloaded map[string]chan struct{}) []dockerclient.ProgressEvent {
+	events := make([]dockerclient.ProgressEvent, 0, len(torrents))
+	for _, torrent := range torrents {
+		event := dockerclient.ProgressEvent{Phase: dockerclient.DownloadPhase, ID: torrent.id, Title: torrent.title}
+
+		// The torrent is no longer in the client once downloaded, unless seeded.
+		status, err := bt.GetStatus(torrentSource(torrent, sources))
+		switch {
+		case err == nil:
+			event.Status = string(status.Status)
+			event.Current = status.DownloadedBytes
+			event.Total = status.TotalBytes
+			event.DownloadRate = int64(status.DownloadRate * 1024)
+			event.UploadRate = int64(status.UploadRate * 1024)
+			event.NumPeers = status.NumPeers
+			event.NumSeeds = status.NumSeeds
+			event.Done = isClosed(downloaded[torrent.id])
+		case isClosed(downloaded[torrent.id]):
+			event.Status = "Downloaded"
+			event.Done = true
+		default:
+			continue
+		}
+
+		events = append(events, event)
+	}
+
+	return events
+}
+
+// isClosed returns whether the given channel is closed.
+func isClosed(channel chan struct{}) bool {
+	select {
+	case <-channel:
+		return true
+	default:
+		return false
+	}
+}
+
+// webSeedURL returns the URL of the web seed replacing those of the torrent with the given ID,
+// given the base URL of the web seed, or an empty string if they are kept, e.g. because the
+// torrent is not the one of a blob.
+func webSeedURL(webSeed, id string) string {
+	if webSeed == "" {
+		return ""
+	}
+
+	if _, err := digest.ParseDigest(id); err != nil {
+		return ""
+	}
+
+	if !strings.HasSuffix(webSeed, "/") {
+		return webSeed + "/" + id
+	}
+
+	return webSeed + id
+}
+
+// watchStalledDownload cancels the download of the given torrent whenever it does not progress for
+// the given duration, until stop is closed.
+func watchStalledDownload(bt *bittorrent.Client, torrent torrentInfo, sources cmap.ConcurrentMap, stallTimeout time.Duration, stop chan struct{}) {
+	lastPieces := -1
+	lastProgress := time.Now()
+
+	for {
+		select {
+		case <-stop:
+			return
+
+		case <-time.After(stallCheckInterval):
+		}
+
+		source := torrentSource(torrent, sources)
+		status, err := bt.GetStatus(source)
+		if err != nil {
+			continue
+		}
+
+		if status.NumPiecesDownloaded != lastPieces {
+			lastPieces = status.NumPiecesDownloaded
+			lastProgress = time.Now()
+			continue
+		}
+
+		if time.Since(lastProgress) >= stallTimeout {
+			log.Warnf("Download of %v stalled for %v", shortenName(torrent.title), stallTimeout)
+			bt.Cancel(source)
+
+			lastPieces = -1
+			lastProgress = time.Now()
+		}
+	}
+}
+
+// downloadFromRegistry downloads the content of the given torrent directly from the registry, to
+// the torrent folder, and returns its path.
+func downloadFromRegistry(torrent torrentInfo, torrentFolder string) (string, error) {
+	blobPath, ok := blobCachePath(filepath.Join(torrentFolder, registryBlobsFolder), torrent.id)
+	if !ok {
+		return "", fmt.Errorf("%v cannot be downloaded from the registry", torrent.id)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return "", err
+	}
+
+	// Download the blob to a temporary file first, so that partial downloads are never used.
+	tempPath := fmt.Sprintf("%s.%d.tmp", blobPath, os.Getpid())
+	f, err := os.Create(tempPath)
+	if err != nil {
+		return "", err
+	}
+
+	if err := torrent.registryDownload(f); err != nil {
+		f.Close()
+		os.Remove(tempPath)
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tempPath)
+		return "", err
+	}
+
+	return blobPath, os.Rename(tempPath, blobPath)
+}
+
+// noTorrentEndpointError returns the error reported when the registry serving the given torrent URL
+// responds with a 404, which usually means that it does not support BitTorrent distribution, e.g.
+// because it is not Quay.
+func noTorrentEndpointError(torrentURL string, canFallback bool) error {
+	host := torrentURL
+	if parsed, err := url.Parse(torrentURL); err == nil {
+		host = parsed.Host
+	}
+
+	if canFallback {
+		return fmt.Errorf("Registry %v does not support BitTorrent distribution (no /c1/torrent endpoint)", host)
+	}
+
+	return fmt.Errorf("Registry %v does not support BitTorrent distribution (no /c1/torrent endpoint): specify --fallback-registry to download the layers directly from it, or check the registry of the image (the images without a hostname are pulled from --default-registry)", host)
+}
+
+// torrentSource returns the path from which the given torrent is being downloaded, which differs
+// from its torrentPath if the download fell back to one of its fallbackPaths.
+func torrentSource(torrent torrentInfo, sources cmap.ConcurrentMap) string {
+	if source, found := sources.Get(torrent.id); found {
+		return source.(string)
+	}
 
-	log.Println("Received signal and cleanly shutdown.")
-	os.Exit(0)
+	return torrent.torrentPath
 }
 
 func shortenName(name string) string {
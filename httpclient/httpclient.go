@@ -0,0 +1,196 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package httpclient provides helper methods for creating the HTTP clients used
+// to download files (.torrent files, signatures) from the registry.
+package httpclient
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Resolve maps hostnames to the IP addresses connected to in their place, like curl's --resolve
+// option, e.g. to reach a staging registry whose hostname is not in DNS. It applies to the
+// connections made by Dial, i.e. by the HTTP clients of quayctl, but not to the requests sent via
+// an HTTP or SOCKS5 proxy, which resolves the hostnames itself.
+var Resolve map[string]string
+
+// directDialer is the dialer used by Dial once the address is resolved.
+var directDialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// Dial connects to the given address, replacing its hostname with the IP address it maps to in
+// Resolve, if any.
+func Dial(network, address string) (net.Conn, error) {
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		if ip, found := Resolve[strings.ToLower(host)]; found {
+			address = net.JoinHostPort(ip, port)
+		}
+	}
+
+	return directDialer.Dial(network, address)
+}
+
+// Config represents the configuration of an HTTP client.
+type Config struct {
+	// Proxy is the URL of the proxy through which the requests are sent.
+	// Supported schemes are http, https and socks5. Credentials can be specified in the URL.
+	// If empty, the proxy is determined from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+	// variables.
+	Proxy string
+
+	// TLSSkipVerify disables the verification of the TLS certificates of the servers.
+	TLSSkipVerify bool
+
+	// UserAgent is the User-Agent header sent with the requests. If empty, Go's default is used.
+	UserAgent string
+}
+
+// New returns a new HTTP client using the specified configuration.
+func New(config Config) (*http.Client, error) {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial:  Dial,
+	}
+
+	if config.TLSSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	if config.Proxy != "" {
+		proxyURL, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy URL %v: %v", config.Proxy, err)
+		}
+
+		switch proxyURL.Scheme {
+		case "http", "https":
+			transport.Proxy = http.ProxyURL(proxyURL)
+
+		case "socks5":
+			dialer, err := proxy.FromURL(proxyURL, proxy.Direct)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid proxy URL %v: %v", config.Proxy, err)
+			}
+
+			transport.Proxy = nil
+			transport.Dial = dialer.Dial
+
+		default:
+			return nil, fmt.Errorf("Invalid proxy URL %v: unsupported scheme %v", config.Proxy, proxyURL.Scheme)
+		}
+	}
+
+	return &http.Client{
+		Transport:     WithUserAgent(transport, config.UserAgent),
+		CheckRedirect: checkRedirect,
+	}, nil
+}
+
+// maxRedirects is the maximum number of redirects followed for a request, as with Go's default
+// policy.
+const maxRedirects = 10
+
+// checkRedirect carries the credentials of the original request over to its redirects, e.g. to a
+// CDN, as long as they target the same host or one of its subdomains (e.g. quay.io and
+// cdn.quay.io) without downgrading to HTTP. Otherwise, the redirected request would be
+// unauthenticated, as the credentials embedded in URLs and the Authorization header are not kept.
+func checkRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+
+	original := via[0]
+	if !isSameOrSubdomain(original.URL.Host, request.URL.Host) || (original.URL.Scheme == "https" && request.URL.Scheme != "https") {
+		request.Header.Del("Authorization")
+		return nil
+	}
+
+	if authorization := original.Header.Get("Authorization"); authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	} else if user := original.URL.User; user != nil {
+		password, _ := user.Password()
+		request.SetBasicAuth(user.Username(), password)
+	}
+
+	return nil
+}
+
+// isSameOrSubdomain returns whether the given redirect host is the given original host or one of
+// its subdomains, ignoring their ports. Sibling hosts are not considered the same, as their common
+// parent may be a public suffix (e.g. co.uk) shared with unrelated parties.
+func isSameOrSubdomain(originalHost, redirectHost string) bool {
+	originalHost, redirectHost = hostname(originalHost), hostname(redirectHost)
+	if originalHost == redirectHost {
+		return true
+	}
+
+	if net.ParseIP(originalHost) != nil {
+		return false
+	}
+
+	return strings.HasSuffix(redirectHost, "."+originalHost)
+}
+
+// hostname returns the given host, lowercased and without its port.
+func hostname(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	return strings.ToLower(host)
+}
+
+// WithUserAgent returns a transport sending the requests with the given User-Agent header via the
+// given transport, unless they already have one. If the User-Agent is empty, the given transport
+// is returned as is.
+func WithUserAgent(transport http.RoundTripper, userAgent string) http.RoundTripper {
+	if userAgent == "" {
+		return transport
+	}
+
+	return &userAgentTransport{transport: transport, userAgent: userAgent}
+}
+
+// userAgentTransport is an http.RoundTripper adding a User-Agent header to the requests.
+type userAgentTransport struct {
+	transport http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Header.Get("User-Agent") != "" {
+		return t.transport.RoundTrip(request)
+	}
+
+	// Round trippers must not modify the original request.
+	clone := *request
+	clone.Header = make(http.Header, len(request.Header)+1)
+	for key, values := range request.Header {
+		clone.Header[key] = values
+	}
+	clone.Header.Set("User-Agent", t.userAgent)
+
+	return t.transport.RoundTrip(&clone)
+}
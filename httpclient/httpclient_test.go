@@ -0,0 +1,59 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpclient
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCheckRedirectCredentials(t *testing.T) {
+	tests := []struct {
+		original    string
+		redirect    string
+		credentials bool
+	}{
+		{"https://quay.io/a.torrent", "https://quay.io/b.torrent", true},
+		{"https://quay.io/a.torrent", "https://cdn.quay.io/a.torrent", true},
+		{"https://quay.io:443/a.torrent", "https://CDN.Quay.io/a.torrent", true},
+		{"https://quay.io/a.torrent", "http://cdn.quay.io/a.torrent", false},
+		{"https://registry.example.com/a.torrent", "https://cdn.example.com/a.torrent", false},
+		{"https://registry.example.co.uk/a.torrent", "https://attacker.co.uk/a.torrent", false},
+		{"https://quay.io/a.torrent", "https://notquay.io/a.torrent", false},
+		{"https://10.0.0.1/a.torrent", "https://10.0.0.1:8443/a.torrent", true},
+		{"https://10.0.0.1/a.torrent", "https://1.10.0.0.1/a.torrent", false},
+	}
+
+	for _, test := range tests {
+		original, err := http.NewRequest("GET", test.original, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		original.Header.Set("Authorization", "Bearer token")
+
+		redirect, err := http.NewRequest("GET", test.redirect, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := checkRedirect(redirect, []*http.Request{original}); err != nil {
+			t.Fatal(err)
+		}
+
+		if credentials := redirect.Header.Get("Authorization") != ""; credentials != test.credentials {
+			t.Errorf("redirect from %v to %v: got credentials %v, expected %v", test.original, test.redirect, credentials, test.credentials)
+		}
+	}
+}